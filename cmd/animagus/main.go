@@ -1,42 +1,148 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/xxuejie/animagus/pkg/generic"
 	"github.com/xxuejie/animagus/pkg/indexer"
+	"github.com/xxuejie/animagus/pkg/store"
 	"google.golang.org/grpc"
 )
 
-var astFile = flag.String("astFile", "./ast.bin", "AST file to load")
+var astFile = flag.String("astFile", "./ast.bin", "AST file to load, names in it are not namespaced")
+var astDir = flag.String("astDir", "", "Directory of AST files to load, calls and streams are named as <file name without extension>.<name>. When set, astFile is only loaded if specified explicitly")
 var redisUrl = flag.String("redisUrl", "redis://127.0.0.1:6379", "Redis URL")
+var dbPath = flag.String("dbPath", "", "Embedded database file, when set, data is kept there instead of Redis")
 var rpcUrl = flag.String("rpcUrl", "http://127.0.0.1:8114", "CKB RPC URL")
 var grpcListenAddress = flag.String("grpcListenAddress", ":4000", "GRPC Listen Address")
+var startBlock = flag.Uint64("startBlock", 0, "First block to index when the database is empty")
+var checkpointFile = flag.String("checkpoint", "", "Trusted snapshot of live cells in JSON, when set, an empty database is seeded from it")
+var prefetchWindow = flag.Int("prefetchWindow", 10, "Number of blocks fetched concurrently ahead of the block being indexed")
+var reloadInterval = flag.Duration("reloadInterval", 5*time.Second, "Interval for checking changes of AST files, 0 disables reloading")
+var maxReorgDepth = flag.Uint64("maxReorgDepth", 1000, "Deepest reorg that can be handled, revert data of older blocks are pruned, 0 keeps all of them")
+
+func loadASTFiles(loadAstFile bool) ([]indexer.ASTFile, error) {
+	var files []indexer.ASTFile
+	if *astDir != "" {
+		dirFiles, err := indexer.ReadASTDir(*astDir)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, dirFiles...)
+	}
+	if loadAstFile {
+		astContent, err := ioutil.ReadFile(*astFile)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, indexer.ASTFile{Content: astContent})
+	}
+	return files, nil
+}
+
+// watchASTFiles reloads AST files once they change, the current version
+// keeps being used when the new one cannot be loaded. It only returns when
+// the indexer cannot go back to the current version, leaving it out of sync
+// with the server.
+func watchASTFiles(loadAstFile bool, files []indexer.ASTFile, i *indexer.Indexer, server *generic.Server) error {
+	for range time.Tick(*reloadInterval) {
+		newFiles, err := loadASTFiles(loadAstFile)
+		if err != nil {
+			log.Printf("Error loading AST files: %v", err)
+			continue
+		}
+		if reflect.DeepEqual(newFiles, files) {
+			continue
+		}
+		// Indexer goes first so new queries start back-filling, the server
+		// rejects calls using them till back-filling is done.
+		err = i.Reload(newFiles)
+		if err != nil {
+			log.Printf("Error reloading AST files, keeping current version: %v", err)
+			continue
+		}
+		err = server.Reload(newFiles)
+		if err != nil {
+			log.Printf("Error reloading AST files, keeping current version: %v", err)
+			err = i.Reload(files)
+			if err != nil {
+				return fmt.Errorf("Error restoring current version of AST files in indexer: %v", err)
+			}
+			continue
+		}
+		files = newFiles
+		log.Printf("Reloaded AST files")
+	}
+	return nil
+}
 
 func main() {
 	flag.Parse()
 
-	astContent, err := ioutil.ReadFile(*astFile)
+	loadAstFile := *astDir == ""
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "astFile" {
+			loadAstFile = true
+		}
+	})
+	files, err := loadASTFiles(loadAstFile)
 	if err != nil {
 		log.Fatal(err)
 	}
-	redisPool := &redis.Pool{
-		MaxIdle:     2,
-		IdleTimeout: 60 * time.Second,
-		Dial:        func() (redis.Conn, error) { return redis.DialURL(*redisUrl) },
+	// log.Fatal skips deferred calls, the store is closed explicitly once
+	// animagus stops instead.
+	var s store.Store
+	var closeStore func() error
+	if *dbPath != "" {
+		boltStore, err := store.NewBoltStore(*dbPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s = boltStore
+		closeStore = boltStore.Close
+	} else {
+		redisPool := &redis.Pool{
+			MaxIdle:     2,
+			IdleTimeout: 60 * time.Second,
+			Dial:        func() (redis.Conn, error) { return redis.DialURL(*redisUrl) },
+		}
+		s = store.NewRedisStore(redisPool)
+		closeStore = redisPool.Close
 	}
-	// TODO: multiple call support later
-	i, err := indexer.NewIndexer(astContent, redisPool, *rpcUrl)
+	var checkpoint *indexer.Checkpoint
+	if *checkpointFile != "" {
+		checkpointContent, err := ioutil.ReadFile(*checkpointFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		checkpoint = &indexer.Checkpoint{}
+		err = json.Unmarshal(checkpointContent, checkpoint)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	i, err := indexer.NewIndexer(files, s, *rpcUrl, indexer.Options{
+		MaxReorgDepth:  *maxReorgDepth,
+		PrefetchWindow: *prefetchWindow,
+		StartBlock:     *startBlock,
+		Checkpoint:     checkpoint,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	genericServer, err := generic.NewServer(astContent, redisPool, *rpcUrl)
+	genericServer, err := generic.NewServer(files, s, *rpcUrl)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -47,9 +153,45 @@ func main() {
 	grpcServer := grpc.NewServer()
 	generic.RegisterGenericServiceServer(grpcServer, genericServer)
 
+	// Any of those returning stops animagus, so does a signal
+	indexed := make(chan error, 1)
+	stopped := make(chan error, 2)
 	go func() {
-		log.Fatal(i.Run())
+		indexed <- i.Run()
 	}()
+	if *reloadInterval > 0 {
+		go func() {
+			stopped <- watchASTFiles(loadAstFile, files, i, genericServer)
+		}()
+	}
+	go func() {
+		stopped <- grpcServer.Serve(lis)
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
-	grpcServer.Serve(lis)
+	running := true
+	select {
+	case err = <-indexed:
+		running = false
+	case err = <-stopped:
+	case sig := <-signals:
+		log.Printf("Received %v, stopping", sig)
+	}
+	grpcServer.Stop()
+	if running {
+		// Blocks being indexed are finished before closing the store
+		i.Stop()
+		indexErr := <-indexed
+		if err == nil {
+			err = indexErr
+		}
+	}
+	closeErr := closeStore()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -14,7 +14,8 @@ def main
   )
   response = stub.stream(request)
   response.each do |r|
-    puts "New NervosDAO deposit at tx hash: #{bin_to_hex(r.children[0].raw)}, index: #{r.children[1].u}"
+    next if r.kind == :REVERT
+    puts "New NervosDAO deposit at tx hash: #{bin_to_hex(r.value.children[0].raw)}, index: #{r.value.children[1].u}, block: #{r.block_number}"
   end
 end
 
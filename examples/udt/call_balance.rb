@@ -36,7 +36,7 @@ def main
   )
   response = stub.call(request)
   p response
-  puts "Amount: #{unpack_amount(response.raw)}"
+  puts "Amount: #{unpack_amount(response.value.raw)}"
 end
 
 main
@@ -44,7 +44,7 @@ def main
     ]
   )
   response = stub.call(request)
-  puts JSON.pretty_generate(JSON.parse(response.raw))
+  puts JSON.pretty_generate(JSON.parse(response.value.raw))
 end
 
 main
@@ -8,6 +8,7 @@ require (
 	github.com/gomodule/redigo v2.0.0+incompatible
 	github.com/kisielk/gotool v1.0.0 // indirect
 	github.com/minio/blake2b-simd v0.0.0-20160723061019-3f5f724cb5b1
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/tools v0.0.0-20191217011448-c39ce2148d8e // indirect
 	google.golang.org/grpc v1.26.0
 )
@@ -54,6 +54,12 @@ const (
 	Value_QUERY_CELLS Value_Type = 28
 	Value_MAP         Value_Type = 29
 	Value_FILTER      Value_Type = 30
+	// Transactions creating or consuming cells matching the query function,
+	// ordered by their positions in the chain. Optional second and third
+	// children are the number of transactions to skip and the maximum number
+	// of transactions to return, the latter defaults to all of them. Each
+	// transaction has the header of its block attached.
+	Value_QUERY_TRANSACTIONS Value_Type = 31
 	// Cell get operations
 	Value_GET_CAPACITY  Value_Type = 48
 	Value_GET_DATA      Value_Type = 49
@@ -126,6 +132,7 @@ var Value_Type_name = map[int32]string{
 	28:  "QUERY_CELLS",
 	29:  "MAP",
 	30:  "FILTER",
+	31:  "QUERY_TRANSACTIONS",
 	48:  "GET_CAPACITY",
 	49:  "GET_DATA",
 	50:  "GET_LOCK",
@@ -192,6 +199,7 @@ var Value_Type_value = map[string]int32{
 	"QUERY_CELLS":           28,
 	"MAP":                   29,
 	"FILTER":                30,
+	"QUERY_TRANSACTIONS":    31,
 	"GET_CAPACITY":          48,
 	"GET_DATA":              49,
 	"GET_LOCK":              50,
@@ -245,6 +253,41 @@ func (Value_Type) EnumDescriptor() ([]byte, []int) {
 	return fileDescriptor_37b5b141da493253, []int{0, 0}
 }
 
+// Kind decides what the filter gets evaluated upon:
+// * CELL filters run on each created or consumed cell, args are
+// (cell, "insert"/"remove", "index"/"revert")
+// * TRANSACTION filters run once per transaction, args are
+// (transaction with resolved input cells, header, "index"/"revert")
+// * BLOCK filters run once per block, args are
+// (header, list of transactions, "index"/"revert")
+type Stream_Kind int32
+
+const (
+	Stream_CELL        Stream_Kind = 0
+	Stream_TRANSACTION Stream_Kind = 1
+	Stream_BLOCK       Stream_Kind = 2
+)
+
+var Stream_Kind_name = map[int32]string{
+	0: "CELL",
+	1: "TRANSACTION",
+	2: "BLOCK",
+}
+
+var Stream_Kind_value = map[string]int32{
+	"CELL":        0,
+	"TRANSACTION": 1,
+	"BLOCK":       2,
+}
+
+func (x Stream_Kind) String() string {
+	return proto.EnumName(Stream_Kind_name, int32(x))
+}
+
+func (Stream_Kind) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_37b5b141da493253, []int{2, 0}
+}
+
 type Value struct {
 	T Value_Type `protobuf:"varint,1,opt,name=t,proto3,enum=ast.Value_Type" json:"t,omitempty"`
 	// Types that are valid to be assigned to Primitive:
@@ -357,8 +400,11 @@ func (*Value) XXX_OneofWrappers() []interface{} {
 }
 
 type Call struct {
-	Name                 string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
-	Result               *Value   `protobuf:"bytes,3,opt,name=result,proto3" json:"result,omitempty"`
+	Name   string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Result *Value `protobuf:"bytes,3,opt,name=result,proto3" json:"result,omitempty"`
+	// When set, changes made by a block to cells queried in this call are
+	// only indexed once the block has this many blocks on top of it.
+	Confirmations        uint64   `protobuf:"varint,4,opt,name=confirmations,proto3" json:"confirmations,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -403,9 +449,21 @@ func (m *Call) GetResult() *Value {
 	return nil
 }
 
+func (m *Call) GetConfirmations() uint64 {
+	if m != nil {
+		return m.Confirmations
+	}
+	return 0
+}
+
 type Stream struct {
-	Name                 string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
-	Filter               *Value   `protobuf:"bytes,2,opt,name=filter,proto3" json:"filter,omitempty"`
+	Name   string      `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Filter *Value      `protobuf:"bytes,2,opt,name=filter,proto3" json:"filter,omitempty"`
+	Kind   Stream_Kind `protobuf:"varint,3,opt,name=kind,proto3,enum=ast.Stream_Kind" json:"kind,omitempty"`
+	// When set, events of a block are only emitted once the block has this
+	// many blocks on top of it. Blocks reverted before that never emit any
+	// event.
+	Confirmations        uint64   `protobuf:"varint,4,opt,name=confirmations,proto3" json:"confirmations,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -450,6 +508,20 @@ func (m *Stream) GetFilter() *Value {
 	return nil
 }
 
+func (m *Stream) GetKind() Stream_Kind {
+	if m != nil {
+		return m.Kind
+	}
+	return Stream_CELL
+}
+
+func (m *Stream) GetConfirmations() uint64 {
+	if m != nil {
+		return m.Confirmations
+	}
+	return 0
+}
+
 type Root struct {
 	Calls                []*Call   `protobuf:"bytes,1,rep,name=calls,proto3" json:"calls,omitempty"`
 	Streams              []*Stream `protobuf:"bytes,2,rep,name=streams,proto3" json:"streams,omitempty"`
@@ -499,6 +571,7 @@ func (m *Root) GetStreams() []*Stream {
 
 func init() {
 	proto.RegisterEnum("ast.Value_Type", Value_Type_name, Value_Type_value)
+	proto.RegisterEnum("ast.Stream_Kind", Stream_Kind_name, Stream_Kind_value)
 	proto.RegisterType((*Value)(nil), "ast.Value")
 	proto.RegisterType((*Call)(nil), "ast.Call")
 	proto.RegisterType((*Stream)(nil), "ast.Stream")
@@ -508,58 +581,62 @@ func init() {
 func init() { proto.RegisterFile("ast.proto", fileDescriptor_37b5b141da493253) }
 
 var fileDescriptor_37b5b141da493253 = []byte{
-	// 836 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x54, 0xdd, 0x72, 0xdb, 0x36,
-	0x13, 0x35, 0x2d, 0xd9, 0x96, 0x20, 0xc7, 0x5e, 0x23, 0x9f, 0xf3, 0x29, 0x6d, 0xd3, 0x6a, 0xd4,
-	0x49, 0x47, 0x57, 0x76, 0xeb, 0xa4, 0xe9, 0x7f, 0x1a, 0x08, 0x44, 0x24, 0x24, 0x14, 0x40, 0x03,
-	0xa0, 0x13, 0xe5, 0x86, 0x43, 0xbb, 0xac, 0xa3, 0x56, 0xb2, 0x3c, 0x12, 0xd5, 0x3a, 0x8f, 0xd2,
-	0x67, 0xe8, 0x4b, 0x76, 0x16, 0x14, 0xe3, 0x69, 0x3b, 0xbd, 0xe3, 0x9e, 0x3d, 0x7b, 0x76, 0x01,
-	0x1c, 0x2e, 0x69, 0x66, 0xcb, 0xe2, 0xe8, 0x7a, 0x31, 0x2f, 0xe6, 0xb4, 0x96, 0x2d, 0x8b, 0xee,
-	0x9f, 0x0d, 0xb2, 0x75, 0x96, 0x4d, 0x57, 0x39, 0x7d, 0x40, 0x82, 0xa2, 0x1d, 0x74, 0x82, 0xde,
-	0xde, 0xc9, 0xfe, 0x11, 0xb2, 0x3c, 0x7c, 0xe4, 0xde, 0x5d, 0xe7, 0x26, 0x28, 0xe8, 0x1e, 0x09,
-	0xce, 0xdb, 0x9b, 0x9d, 0xa0, 0xd7, 0x18, 0x6e, 0x98, 0xe0, 0x1c, 0xe3, 0x55, 0xbb, 0xd6, 0x09,
-	0x7a, 0x75, 0x8c, 0x57, 0x94, 0x92, 0xda, 0x22, 0xfb, 0xbd, 0x5d, 0xef, 0x04, 0xbd, 0xdd, 0xe1,
-	0x86, 0xc1, 0x80, 0x7e, 0x46, 0x1a, 0x17, 0x6f, 0x27, 0xd3, 0x9f, 0x16, 0xf9, 0x55, 0xbb, 0xd1,
-	0xa9, 0xf5, 0x5a, 0x27, 0xe4, 0x56, 0xd9, 0xbc, 0xcf, 0x75, 0xff, 0xd8, 0x21, 0x75, 0xec, 0x43,
-	0x77, 0x48, 0x4d, 0xc9, 0x08, 0x36, 0x28, 0x21, 0xdb, 0x89, 0x54, 0xee, 0xc9, 0x63, 0x08, 0x68,
-	0x83, 0xd4, 0xfb, 0x5a, 0x47, 0xb0, 0x49, 0x9b, 0x64, 0xab, 0x3f, 0x76, 0xc2, 0x42, 0x0d, 0x3f,
-	0x85, 0x31, 0xda, 0x40, 0x1d, 0x8b, 0x98, 0x19, 0x00, 0x20, 0x16, 0x33, 0xc3, 0x46, 0x70, 0x40,
-	0xef, 0x90, 0xa6, 0x4e, 0x5c, 0x1a, 0x6b, 0xa9, 0x1c, 0x50, 0xba, 0x47, 0x08, 0x17, 0x51, 0x94,
-	0x4a, 0x15, 0x27, 0x0e, 0xee, 0xd2, 0x5d, 0xd2, 0xf0, 0x71, 0x28, 0x62, 0xf8, 0x1f, 0x36, 0xb3,
-	0xdc, 0xc8, 0xd8, 0xc1, 0x21, 0x36, 0xc3, 0x0c, 0xdc, 0xa3, 0xfb, 0xa4, 0xe5, 0x0c, 0x53, 0x96,
-	0x71, 0x27, 0xb5, 0x82, 0xff, 0x23, 0x6d, 0x28, 0x58, 0x28, 0x0c, 0xb4, 0xb1, 0x15, 0x8b, 0xe3,
-	0x68, 0x0c, 0xf7, 0x11, 0x36, 0x22, 0x4c, 0xb8, 0x80, 0x0f, 0xb0, 0x3a, 0x92, 0xd6, 0xc1, 0x87,
-	0x58, 0x7d, 0x9a, 0x08, 0x33, 0x4e, 0x51, 0xcd, 0xc2, 0x47, 0x38, 0xe5, 0x88, 0xc5, 0xf0, 0x00,
-	0xf9, 0xcf, 0x65, 0xe4, 0x84, 0x81, 0x8f, 0x29, 0x90, 0xdd, 0x81, 0x70, 0x29, 0x67, 0x31, 0xe3,
-	0xd2, 0x8d, 0xe1, 0x73, 0x9c, 0x0c, 0x91, 0x90, 0x39, 0x06, 0x5f, 0x54, 0x51, 0xa4, 0xf9, 0x4b,
-	0x38, 0xa9, 0x22, 0x37, 0x8e, 0x05, 0x3c, 0xa2, 0x07, 0xe4, 0x4e, 0xc5, 0x4c, 0x87, 0xcc, 0x0e,
-	0xe1, 0x71, 0x05, 0xdd, 0x9e, 0xfc, 0xcb, 0x0a, 0xe2, 0x3a, 0x14, 0x25, 0xeb, 0x49, 0x05, 0x61,
-	0x54, 0x6a, 0x7d, 0x55, 0x29, 0x33, 0x33, 0xb0, 0xf0, 0xf5, 0xfb, 0x9a, 0xf5, 0x0d, 0x59, 0xf8,
-	0x86, 0xde, 0x25, 0xfb, 0xbe, 0xc6, 0x9f, 0xbf, 0x04, 0xbf, 0xc5, 0x5b, 0x45, 0xd0, 0x5f, 0xaa,
-	0x85, 0xef, 0xf0, 0xcc, 0xeb, 0xf6, 0x1e, 0xf8, 0xbe, 0x12, 0x7a, 0x25, 0x9d, 0x12, 0xd6, 0x0a,
-	0x0b, 0x3f, 0xd0, 0x7b, 0x84, 0x96, 0xf3, 0x8c, 0x62, 0xc6, 0x5d, 0xea, 0x98, 0x19, 0x08, 0x07,
-	0x4f, 0x2b, 0xaa, 0x93, 0x23, 0x61, 0x1d, 0x1b, 0xc5, 0xf0, 0x63, 0x25, 0xaf, 0x92, 0x51, 0x5f,
-	0x18, 0x78, 0x86, 0x6f, 0x8a, 0xb1, 0x88, 0x35, 0x1f, 0x02, 0xab, 0x46, 0x8a, 0x99, 0x11, 0xaa,
-	0x3c, 0x0d, 0xf4, 0xe9, 0x7d, 0x72, 0xe8, 0x65, 0x6e, 0x1f, 0xce, 0xa6, 0x46, 0x6b, 0x07, 0xbc,
-	0xea, 0x1c, 0x1b, 0x1d, 0x6b, 0xcb, 0x22, 0x5b, 0x96, 0x84, 0x95, 0x4e, 0xa2, 0x78, 0x24, 0xd6,
-	0xa0, 0xa0, 0x2d, 0xb2, 0x53, 0x5e, 0xae, 0x86, 0xe7, 0x55, 0x63, 0xa5, 0x15, 0x17, 0x30, 0xa8,
-	0xe6, 0x5a, 0x7b, 0x61, 0x88, 0x8f, 0xee, 0xab, 0x24, 0x3d, 0x24, 0x07, 0x56, 0x18, 0xc9, 0x22,
-	0xf9, 0x46, 0xa4, 0x4e, 0xa7, 0x5c, 0x1b, 0x01, 0x2f, 0xfe, 0x05, 0xbf, 0xb0, 0x5a, 0xc1, 0x4b,
-	0x6f, 0x76, 0xed, 0x20, 0xf2, 0x06, 0x56, 0x21, 0x8c, 0xe8, 0x36, 0xd9, 0xd4, 0x06, 0x94, 0x37,
-	0xf7, 0x69, 0xc2, 0x22, 0x88, 0xbd, 0xa3, 0x84, 0xb5, 0x70, 0x8a, 0xac, 0x48, 0x28, 0x30, 0x98,
-	0xb5, 0x91, 0xe4, 0x02, 0x2c, 0x7e, 0x4a, 0x15, 0x8a, 0xd7, 0xe0, 0xbc, 0x48, 0x18, 0x42, 0x82,
-	0x6f, 0x69, 0x93, 0xbe, 0x33, 0x8c, 0x3b, 0x38, 0xc3, 0x68, 0x94, 0x44, 0x4e, 0xa2, 0x57, 0x5f,
-	0xa1, 0xf7, 0x42, 0x79, 0x26, 0x43, 0x01, 0xaf, 0xbd, 0x21, 0x75, 0x08, 0x63, 0x6f, 0x79, 0xad,
-	0x42, 0xb8, 0xa1, 0x94, 0xec, 0x39, 0x26, 0xa3, 0xd4, 0x08, 0x9e, 0x18, 0x8b, 0xae, 0x7f, 0xd7,
-	0x6f, 0x91, 0xe6, 0xf5, 0x62, 0x32, 0x9b, 0x14, 0x93, 0xdf, 0xf2, 0xee, 0x53, 0x52, 0xe7, 0xd9,
-	0x74, 0x4a, 0x29, 0xa9, 0x5f, 0x65, 0xb3, 0xdc, 0xaf, 0x8b, 0xa6, 0xf1, 0xdf, 0xb4, 0x4b, 0xb6,
-	0x17, 0xf9, 0x72, 0x35, 0x2d, 0xfc, 0x56, 0xf8, 0xfb, 0xaf, 0xbe, 0xce, 0x74, 0x9f, 0x91, 0x6d,
-	0x5b, 0x2c, 0xf2, 0x6c, 0xf6, 0x5f, 0x0a, 0x3f, 0x4f, 0xa6, 0x45, 0xbe, 0xf0, 0x7b, 0xe6, 0x1f,
-	0x0a, 0x65, 0xa6, 0xab, 0x48, 0xdd, 0xcc, 0xe7, 0x05, 0xfd, 0x84, 0x6c, 0x5d, 0x64, 0xd3, 0xe9,
-	0xb2, 0x1d, 0xf8, 0xbd, 0xd2, 0xf4, 0x54, 0x9c, 0xcd, 0x94, 0x38, 0x7d, 0x48, 0x76, 0x96, 0xbe,
-	0xd5, 0xb2, 0xbd, 0xe9, 0x29, 0x2d, 0x4f, 0x29, 0xdb, 0x9b, 0x2a, 0xd7, 0x7f, 0xf8, 0xe6, 0xd3,
-	0xcb, 0x49, 0xf1, 0x76, 0x75, 0x7e, 0x74, 0x31, 0x9f, 0x1d, 0xdf, 0xdc, 0xac, 0xf2, 0x5f, 0x26,
-	0xf9, 0x71, 0x76, 0x35, 0x99, 0x65, 0x97, 0xab, 0xe5, 0xf1, 0xf5, 0xaf, 0x97, 0xc7, 0xd9, 0xb2,
-	0x38, 0xdf, 0xf6, 0x2b, 0xf3, 0xd1, 0x5f, 0x01, 0x00, 0x00, 0xff, 0xff, 0xde, 0x1b, 0x30, 0xe7,
-	0x3f, 0x05, 0x00, 0x00,
+	// 904 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x54, 0x5b, 0x73, 0xdb, 0x44,
+	0x14, 0x8e, 0x6c, 0x25, 0xb1, 0x37, 0xb7, 0x93, 0x2d, 0x29, 0x2e, 0x50, 0x9a, 0x31, 0x2d, 0x93,
+	0x07, 0x26, 0x81, 0xb4, 0x94, 0xfb, 0x65, 0x2d, 0x6d, 0xed, 0x6d, 0x64, 0xad, 0xb2, 0xbb, 0x4a,
+	0xeb, 0xbe, 0x68, 0x94, 0x44, 0x4d, 0x45, 0x7d, 0xc9, 0xd8, 0x32, 0xa4, 0x3f, 0x8b, 0x57, 0x5e,
+	0xf9, 0x63, 0xcc, 0x59, 0x59, 0x69, 0x4a, 0x87, 0x19, 0xde, 0xf6, 0x7c, 0xe7, 0xf6, 0xe9, 0xd3,
+	0x39, 0x87, 0x34, 0xd3, 0x59, 0xb1, 0x7f, 0x39, 0x9d, 0x14, 0x13, 0x5a, 0x4f, 0x67, 0x45, 0xfb,
+	0xef, 0x06, 0x59, 0x3e, 0x49, 0x87, 0xf3, 0x8c, 0xde, 0x25, 0x4e, 0xd1, 0x72, 0x76, 0x9d, 0xbd,
+	0xcd, 0xc3, 0xad, 0x7d, 0x8c, 0xb2, 0xf0, 0xbe, 0x79, 0x73, 0x99, 0x29, 0xa7, 0xa0, 0x9b, 0xc4,
+	0x39, 0x6d, 0xd5, 0x76, 0x9d, 0xbd, 0x46, 0x6f, 0x49, 0x39, 0xa7, 0x68, 0xcf, 0x5b, 0xf5, 0x5d,
+	0x67, 0xcf, 0x45, 0x7b, 0x4e, 0x29, 0xa9, 0x4f, 0xd3, 0x3f, 0x5a, 0xee, 0xae, 0xb3, 0xb7, 0xde,
+	0x5b, 0x52, 0x68, 0xd0, 0xcf, 0x49, 0xe3, 0xec, 0x55, 0x3e, 0x3c, 0x9f, 0x66, 0xe3, 0x56, 0x63,
+	0xb7, 0xbe, 0xb7, 0x76, 0x48, 0xde, 0x56, 0x56, 0xd7, 0xbe, 0xf6, 0x9f, 0xab, 0xc4, 0xc5, 0x3e,
+	0x74, 0x95, 0xd4, 0x43, 0x11, 0xc0, 0x12, 0x25, 0x64, 0x25, 0x16, 0xa1, 0x79, 0xfc, 0x08, 0x1c,
+	0xda, 0x20, 0x6e, 0x47, 0xca, 0x00, 0x6a, 0xb4, 0x49, 0x96, 0x3b, 0x03, 0xc3, 0x35, 0xd4, 0xf1,
+	0xc9, 0x95, 0x92, 0x0a, 0x5c, 0x4c, 0x62, 0xaa, 0x0b, 0x80, 0x58, 0xc4, 0x14, 0xeb, 0xc3, 0x36,
+	0xdd, 0x20, 0x4d, 0x19, 0x9b, 0x24, 0x92, 0x22, 0x34, 0x40, 0xe9, 0x26, 0x21, 0x1e, 0x0f, 0x82,
+	0x44, 0x84, 0x51, 0x6c, 0xe0, 0x16, 0x5d, 0x27, 0x0d, 0x6b, 0xfb, 0x3c, 0x82, 0x0f, 0xb0, 0x99,
+	0xf6, 0x94, 0x88, 0x0c, 0xec, 0x60, 0x33, 0xf4, 0xc0, 0x6d, 0xba, 0x45, 0xd6, 0x8c, 0x62, 0xa1,
+	0x66, 0x9e, 0x11, 0x32, 0x84, 0x0f, 0x31, 0xac, 0xc7, 0x99, 0xcf, 0x15, 0xb4, 0xb0, 0x15, 0x8b,
+	0xa2, 0x60, 0x00, 0x77, 0x10, 0x56, 0xdc, 0x8f, 0x3d, 0x0e, 0x1f, 0x61, 0x76, 0x20, 0xb4, 0x81,
+	0x8f, 0x31, 0xfb, 0x38, 0xe6, 0x6a, 0x90, 0x60, 0x35, 0x0d, 0x9f, 0x20, 0xcb, 0x3e, 0x8b, 0xe0,
+	0x2e, 0xc6, 0x3f, 0x11, 0x81, 0xe1, 0x0a, 0x3e, 0xa5, 0xb7, 0x09, 0x2d, 0xa3, 0x6e, 0x74, 0xd2,
+	0x70, 0x8f, 0x02, 0x59, 0xef, 0x72, 0x93, 0x78, 0x2c, 0x62, 0x9e, 0x30, 0x03, 0xf8, 0x12, 0x19,
+	0x23, 0xe2, 0x33, 0xc3, 0xe0, 0xab, 0xca, 0x0a, 0xa4, 0x77, 0x04, 0x87, 0x95, 0x65, 0x06, 0x11,
+	0x87, 0x87, 0x74, 0x9b, 0x6c, 0x54, 0x91, 0x49, 0x8f, 0xe9, 0x1e, 0x3c, 0xaa, 0xa0, 0xb7, 0x8a,
+	0x7c, 0x5d, 0x41, 0x9e, 0xf4, 0x79, 0x19, 0xf5, 0xb8, 0x82, 0xd0, 0x2a, 0x6b, 0x7d, 0x53, 0x55,
+	0x66, 0xaa, 0xab, 0xe1, 0xdb, 0xeb, 0x9c, 0x85, 0x72, 0x1a, 0xbe, 0xa3, 0xb7, 0xc8, 0x96, 0xcd,
+	0xb1, 0xba, 0x94, 0xe0, 0xf7, 0xa8, 0x36, 0x82, 0x56, 0x6c, 0x0d, 0x3f, 0xa0, 0x16, 0x8b, 0xf6,
+	0x16, 0xf8, 0xb1, 0x2a, 0xf4, 0x4c, 0x98, 0x90, 0x6b, 0xcd, 0x35, 0xfc, 0x84, 0x4a, 0x94, 0x7c,
+	0xfa, 0x11, 0xf3, 0x4c, 0x62, 0x98, 0xea, 0x72, 0x03, 0x3f, 0x57, 0xa1, 0x46, 0xf4, 0xb9, 0x36,
+	0xac, 0x1f, 0xc1, 0x2f, 0x55, 0xf9, 0x30, 0xee, 0x77, 0xb8, 0x82, 0x5f, 0xf1, 0x5f, 0xa3, 0xcd,
+	0x23, 0xe9, 0xf5, 0x80, 0x55, 0x94, 0x22, 0xa6, 0x78, 0x58, 0x7e, 0x0d, 0x74, 0xe8, 0x1d, 0xb2,
+	0x63, 0xcb, 0xdc, 0x90, 0x39, 0x51, 0x52, 0x1a, 0xf0, 0xaa, 0xce, 0x91, 0x92, 0x91, 0xd4, 0x2c,
+	0xd0, 0x65, 0x8a, 0x5f, 0xd5, 0x89, 0x43, 0x2f, 0xe0, 0x0b, 0x90, 0xd3, 0x35, 0xb2, 0x5a, 0x8a,
+	0x2b, 0xe1, 0x49, 0xd5, 0x38, 0x94, 0xa1, 0xc7, 0xa1, 0x5b, 0xf1, 0x5a, 0xcc, 0x48, 0x0f, 0x87,
+	0xc1, 0x66, 0x09, 0xba, 0x43, 0xb6, 0x35, 0x57, 0x82, 0x05, 0xe2, 0x05, 0x4f, 0x8c, 0x4c, 0x3c,
+	0xa9, 0x38, 0x3c, 0x7d, 0x0f, 0x7e, 0xaa, 0x65, 0x08, 0x47, 0x76, 0x09, 0xa4, 0x81, 0x00, 0x1f,
+	0x2c, 0xf4, 0xa1, 0x4f, 0x57, 0x48, 0x4d, 0x2a, 0x08, 0xed, 0xd0, 0x1f, 0xc7, 0x2c, 0x80, 0xc8,
+	0x4e, 0x1a, 0xd7, 0x1a, 0x8e, 0x31, 0x2a, 0xe0, 0x21, 0x28, 0xf4, 0xea, 0x40, 0x78, 0x1c, 0x34,
+	0x3e, 0x45, 0xe8, 0xf3, 0xe7, 0x60, 0x6c, 0x11, 0xdf, 0x87, 0x18, 0xff, 0xa5, 0x8e, 0x3b, 0x46,
+	0x31, 0xcf, 0xc0, 0x09, 0x5a, 0xfd, 0x38, 0x30, 0x02, 0x67, 0xf8, 0x19, 0xce, 0xa4, 0x2f, 0x4e,
+	0x84, 0xcf, 0xe1, 0xb9, 0x1d, 0x54, 0xe9, 0xc3, 0xc0, 0xae, 0x82, 0x0c, 0x7d, 0xb8, 0xa2, 0x94,
+	0x6c, 0x1a, 0x26, 0x82, 0x44, 0x71, 0x2f, 0x56, 0x1a, 0xb7, 0xe1, 0x4d, 0x67, 0x8d, 0x34, 0x2f,
+	0xa7, 0xf9, 0x28, 0x2f, 0xf2, 0xdf, 0xb3, 0xf6, 0x39, 0x71, 0xbd, 0x74, 0x38, 0xa4, 0x94, 0xb8,
+	0xe3, 0x74, 0x94, 0xd9, 0x33, 0xd2, 0x54, 0xf6, 0x4d, 0xdb, 0x64, 0x65, 0x9a, 0xcd, 0xe6, 0xc3,
+	0xc2, 0x5e, 0x8b, 0x77, 0x4f, 0xc0, 0xc2, 0x43, 0xef, 0x93, 0x8d, 0xb3, 0xc9, 0xf8, 0x65, 0x3e,
+	0x1d, 0xa5, 0x45, 0x3e, 0x19, 0xcf, 0xec, 0x19, 0x71, 0xd5, 0xbb, 0x60, 0xfb, 0x2f, 0x87, 0xac,
+	0xe8, 0x62, 0x9a, 0xa5, 0xa3, 0xff, 0x6a, 0xf4, 0x32, 0x1f, 0x16, 0xd9, 0xb4, 0x55, 0x7b, 0xbf,
+	0x51, 0xe9, 0xa1, 0xf7, 0x89, 0xfb, 0x3a, 0x1f, 0x9f, 0x5b, 0x2a, 0x9b, 0x87, 0x60, 0x23, 0xca,
+	0x92, 0xfb, 0x47, 0xf9, 0xf8, 0x5c, 0x59, 0xef, 0xff, 0xa4, 0xf3, 0x05, 0x71, 0x31, 0xe7, 0xfa,
+	0x64, 0x2c, 0xfd, 0xfb, 0x64, 0x38, 0xf6, 0x60, 0xd9, 0x25, 0xad, 0xb5, 0x43, 0xe2, 0xaa, 0xc9,
+	0xa4, 0xa0, 0xf7, 0xc8, 0xf2, 0x59, 0x3a, 0x1c, 0xce, 0x5a, 0x8e, 0x3d, 0x88, 0x4d, 0x4b, 0x01,
+	0xc5, 0x53, 0x25, 0x4e, 0x1f, 0x90, 0xd5, 0x99, 0x65, 0x34, 0x6b, 0xd5, 0x6c, 0xc8, 0xda, 0x0d,
+	0x96, 0xaa, 0xf2, 0x75, 0x1e, 0xbc, 0xf8, 0xec, 0x22, 0x2f, 0x5e, 0xcd, 0x4f, 0xf7, 0xcf, 0x26,
+	0xa3, 0x83, 0xab, 0xab, 0x79, 0xf6, 0x5b, 0x9e, 0x1d, 0xa4, 0xe3, 0x7c, 0x94, 0x5e, 0xcc, 0x67,
+	0x07, 0x97, 0xaf, 0x2f, 0x0e, 0xd2, 0x59, 0x71, 0xba, 0x62, 0x6f, 0xfd, 0xc3, 0x7f, 0x06, 0x00,
+	0x9e, 0x64, 0xa6, 0xe1, 0xf8, 0x05, 0x00, 0x00,
 }
@@ -154,8 +154,114 @@ func ConvertCell(cell rpctypes.CellOutput, cellData rpctypes.Raw,
 		},
 		ConvertOutPoint(outPoint),
 	}
+	if header != nil {
+		children = append(children, ConvertHeader(*header))
+	}
 	return &Value{
 		T:        Value_CELL,
 		Children: children,
 	}
 }
+
+func ConvertCellInput(input rpctypes.CellInput) *Value {
+	children := []*Value{
+		ConvertOutPoint(input.PreviousOutput),
+		&Value{
+			T: Value_UINT64,
+			Primitive: &Value_U{
+				U: uint64(input.Since),
+			},
+		},
+	}
+	// Resolved input cells are kept as the third item
+	previousOutput := input.PreviousOutput
+	if previousOutput.Cell != nil && previousOutput.CellData != nil {
+		children = append(children, ConvertCell(*previousOutput.Cell,
+			*previousOutput.CellData, previousOutput, previousOutput.Header))
+	}
+	return &Value{
+		T:        Value_CELL_INPUT,
+		Children: children,
+	}
+}
+
+func ConvertCellDep(cellDep rpctypes.CellDep) *Value {
+	return &Value{
+		T: Value_CELL_DEP,
+		Children: []*Value{
+			ConvertOutPoint(cellDep.OutPoint),
+			&Value{
+				T: Value_UINT64,
+				Primitive: &Value_U{
+					U: uint64(cellDep.DepType),
+				},
+			},
+		},
+	}
+}
+
+// ConvertTransaction converts a transaction from the chain, unlike assembled
+// transactions which only have inputs, outputs and cell deps, header deps and
+// witnesses are also included.
+func ConvertTransaction(tx rpctypes.TransactionView) *Value {
+	inputs := make([]*Value, len(tx.Inputs))
+	for i, input := range tx.Inputs {
+		inputs[i] = ConvertCellInput(input)
+	}
+	outputs := make([]*Value, len(tx.Outputs))
+	for i, output := range tx.Outputs {
+		outputs[i] = ConvertCell(output, rpctypes.Raw(tx.OutputsData[i]),
+			rpctypes.OutPoint{
+				TxHash: tx.Hash,
+				Index:  rpctypes.Uint32(i),
+			}, nil)
+	}
+	cellDeps := make([]*Value, len(tx.CellDeps))
+	for i, cellDep := range tx.CellDeps {
+		cellDeps[i] = ConvertCellDep(cellDep)
+	}
+	headerDeps := make([]*Value, len(tx.HeaderDeps))
+	for i, headerDep := range tx.HeaderDeps {
+		h := headerDep
+		headerDeps[i] = &Value{
+			T: Value_BYTES,
+			Primitive: &Value_Raw{
+				Raw: h[:],
+			},
+		}
+	}
+	witnesses := make([]*Value, len(tx.Witnesses))
+	for i, witness := range tx.Witnesses {
+		witnesses[i] = &Value{
+			T: Value_BYTES,
+			Primitive: &Value_Raw{
+				Raw: witness,
+			},
+		}
+	}
+	return &Value{
+		T: Value_TRANSACTION,
+		Children: []*Value{
+			&Value{
+				T:        Value_LIST,
+				Children: inputs,
+			},
+			&Value{
+				T:        Value_LIST,
+				Children: outputs,
+			},
+			&Value{
+				T:        Value_LIST,
+				Children: cellDeps,
+			},
+			&Value{
+				T:        Value_LIST,
+				Children: headerDeps,
+			},
+			&Value{
+				T:        Value_LIST,
+				Children: witnesses,
+			},
+		},
+	}
+}
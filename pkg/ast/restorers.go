@@ -136,5 +136,18 @@ func RestoreTransaction(value *Value, validate bool) (tx rpctypes.Transaction, e
 		}
 		tx.CellDeps = append(tx.CellDeps, restoredDep)
 	}
+	if len(value.GetChildren()) >= 5 {
+		for _, headerDep := range value.GetChildren()[3].GetChildren() {
+			var h rpctypes.Hash
+			copy(h[:], headerDep.GetRaw())
+			tx.HeaderDeps = append(tx.HeaderDeps, h)
+		}
+		tx.Witnesses = []rpctypes.Bytes{}
+		for _, witness := range value.GetChildren()[4].GetChildren() {
+			w := make([]byte, len(witness.GetRaw()))
+			copy(w, witness.GetRaw())
+			tx.Witnesses = append(tx.Witnesses, w)
+		}
+	}
 	return
 }
@@ -66,8 +66,8 @@ func IsValidCell(value *Value) error {
 		return fmt.Errorf("Invalid cell!")
 	}
 	l := len(value.GetChildren())
-	if l != 4 && l != 6 {
-		return fmt.Errorf("Invalid number of out point items!")
+	if l < 4 || l > 6 {
+		return fmt.Errorf("Invalid number of cell items!")
 	}
 	if value.GetChildren()[0].GetT() != Value_UINT64 ||
 		(IsValidScript(value.GetChildren()[1]) != nil) ||
@@ -75,10 +75,12 @@ func IsValidCell(value *Value) error {
 		value.GetChildren()[3].GetT() != Value_BYTES {
 		return fmt.Errorf("Invalid child type")
 	}
-	if l == 6 {
+	if l >= 5 {
 		if err := IsValidOutPoint(value.GetChildren()[4]); err != nil {
 			return err
 		}
+	}
+	if l == 6 {
 		if err := IsValidHeader(value.GetChildren()[5]); err != nil {
 			return err
 		}
@@ -90,13 +92,19 @@ func IsValidCellInput(value *Value) error {
 	if value.GetT() != Value_CELL_INPUT {
 		return fmt.Errorf("Invalid cell input!")
 	}
-	if len(value.GetChildren()) != 2 {
+	l := len(value.GetChildren())
+	if l != 2 && l != 3 {
 		return fmt.Errorf("Invalid number of cell input items")
 	}
 	if IsValidOutPoint(value.GetChildren()[0]) != nil ||
 		value.GetChildren()[1].GetT() != Value_UINT64 {
 		return fmt.Errorf("Invalid child type")
 	}
+	if l == 3 {
+		if err := IsValidCell(value.GetChildren()[2]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -119,13 +127,20 @@ func IsValidTransaction(value *Value) error {
 	if value.GetT() != Value_TRANSACTION {
 		return fmt.Errorf("Invalid transaction!")
 	}
-	if len(value.GetChildren()) != 3 {
+	// Transactions from the chain also carry header deps and witnesses, and
+	// optionally the header of their block
+	l := len(value.GetChildren())
+	if l != 3 && l != 5 && l != 6 {
 		return fmt.Errorf("Invalid number of transaction items")
 	}
-	if value.GetChildren()[0].GetT() != Value_LIST ||
-		value.GetChildren()[1].GetT() != Value_LIST ||
-		value.GetChildren()[2].GetT() != Value_LIST {
-		return fmt.Errorf("Invalid child type")
+	for i, child := range value.GetChildren() {
+		if i == 5 {
+			if err := IsValidHeader(child); err != nil {
+				return err
+			}
+		} else if child.GetT() != Value_LIST {
+			return fmt.Errorf("Invalid child type")
+		}
 	}
 	for _, child := range value.GetChildren()[0].GetChildren() {
 		if err := IsValidCellInput(child); err != nil {
@@ -142,6 +157,18 @@ func IsValidTransaction(value *Value) error {
 			return err
 		}
 	}
+	if l >= 5 {
+		for _, child := range value.GetChildren()[3].GetChildren() {
+			if err := isValidBytes(child, 32); err != nil {
+				return err
+			}
+		}
+		for _, child := range value.GetChildren()[4].GetChildren() {
+			if child.GetT() != Value_BYTES {
+				return fmt.Errorf("Invalid witness type")
+			}
+		}
+	}
 	return nil
 }
 
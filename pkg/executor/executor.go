@@ -17,6 +17,10 @@ type Environment interface {
 	Param(i int) *ast.Value
 	IndexParam(i int, value *ast.Value) error
 	QueryCell(query *ast.Value) ([]*ast.Value, error)
+	QueryTransactions(query *ast.Value) ([]*ast.Value, error)
+	// QueryAggregate returns the result of a REDUCE value maintained by the
+	// indexer, or nil when it has to be evaluated.
+	QueryAggregate(reduce *ast.Value) (*ast.Value, error)
 }
 
 // One must make sure expr passes Verify function in verifier package before
@@ -251,6 +255,16 @@ func evaluateValueNonRecursion(expr *ast.Value, e Environment) (*ast.Value, erro
 			return nil, err
 		}
 		return value, nil
+	case ast.Value_CELL_INPUT:
+		value, err := evaluateChildren(expr, e)
+		if err != nil {
+			return nil, err
+		}
+		err = ast.IsValidCellInput(value)
+		if err != nil {
+			return nil, err
+		}
+		return value, nil
 	case ast.Value_OUT_POINT:
 		value, err := evaluateChildren(expr, e)
 		if err != nil {
@@ -271,6 +285,13 @@ func evaluateValueNonRecursion(expr *ast.Value, e Environment) (*ast.Value, erro
 			args: args,
 		})
 	case ast.Value_REDUCE:
+		aggregate, err := e.QueryAggregate(expr)
+		if err != nil {
+			return nil, err
+		}
+		if aggregate != nil {
+			return aggregate, nil
+		}
 		f := expr.GetChildren()[0]
 		currentValue, err := evaluateValueNonRecursion(expr.GetChildren()[1], e)
 		if err != nil {
@@ -355,11 +376,11 @@ func evaluateOp(op ast.Value_Type, operands []*ast.Value, e Environment) (*ast.V
 			operands[1].GetT() == ast.Value_UINT64 {
 			result = operands[0].GetU() < operands[1].GetU()
 		} else {
-			a, err := valueToBigInt(operands[0])
+			a, err := ValueToBigInt(operands[0])
 			if err != nil {
 				return nil, err
 			}
-			b, err := valueToBigInt(operands[1])
+			b, err := ValueToBigInt(operands[1])
 			if err != nil {
 				return nil, err
 			}
@@ -381,15 +402,15 @@ func evaluateOp(op ast.Value_Type, operands []*ast.Value, e Environment) (*ast.V
 				},
 			}, nil
 		}
-		a, err := valueToBigInt(operands[0])
+		a, err := ValueToBigInt(operands[0])
 		if err != nil {
 			return nil, err
 		}
-		b, err := valueToBigInt(operands[1])
+		b, err := ValueToBigInt(operands[1])
 		if err != nil {
 			return nil, err
 		}
-		return bigIntToValue(new(big.Int).Add(a, b)), nil
+		return BigIntToValue(new(big.Int).Add(a, b)), nil
 	case ast.Value_SUBTRACT:
 		if operands[0].GetT() == ast.Value_UINT64 &&
 			operands[1].GetT() == ast.Value_UINT64 {
@@ -400,15 +421,15 @@ func evaluateOp(op ast.Value_Type, operands []*ast.Value, e Environment) (*ast.V
 				},
 			}, nil
 		}
-		a, err := valueToBigInt(operands[0])
+		a, err := ValueToBigInt(operands[0])
 		if err != nil {
 			return nil, err
 		}
-		b, err := valueToBigInt(operands[1])
+		b, err := ValueToBigInt(operands[1])
 		if err != nil {
 			return nil, err
 		}
-		return bigIntToValue(new(big.Int).Sub(a, b)), nil
+		return BigIntToValue(new(big.Int).Sub(a, b)), nil
 	case ast.Value_MULTIPLY:
 		if operands[0].GetT() == ast.Value_UINT64 &&
 			operands[1].GetT() == ast.Value_UINT64 {
@@ -419,15 +440,15 @@ func evaluateOp(op ast.Value_Type, operands []*ast.Value, e Environment) (*ast.V
 				},
 			}, nil
 		}
-		a, err := valueToBigInt(operands[0])
+		a, err := ValueToBigInt(operands[0])
 		if err != nil {
 			return nil, err
 		}
-		b, err := valueToBigInt(operands[1])
+		b, err := ValueToBigInt(operands[1])
 		if err != nil {
 			return nil, err
 		}
-		return bigIntToValue(new(big.Int).Mul(a, b)), nil
+		return BigIntToValue(new(big.Int).Mul(a, b)), nil
 	case ast.Value_DIVIDE:
 		if operands[0].GetT() == ast.Value_UINT64 &&
 			operands[1].GetT() == ast.Value_UINT64 {
@@ -441,18 +462,18 @@ func evaluateOp(op ast.Value_Type, operands []*ast.Value, e Environment) (*ast.V
 				},
 			}, nil
 		}
-		a, err := valueToBigInt(operands[0])
+		a, err := ValueToBigInt(operands[0])
 		if err != nil {
 			return nil, err
 		}
-		b, err := valueToBigInt(operands[1])
+		b, err := ValueToBigInt(operands[1])
 		if err != nil {
 			return nil, err
 		}
 		if b.Cmp(new(big.Int)) == 0 {
 			return nil, fmt.Errorf("Divide by zero!")
 		}
-		return bigIntToValue(new(big.Int).Div(a, b)), nil
+		return BigIntToValue(new(big.Int).Div(a, b)), nil
 	case ast.Value_MOD:
 		if operands[0].GetT() == ast.Value_UINT64 &&
 			operands[1].GetT() == ast.Value_UINT64 {
@@ -466,18 +487,18 @@ func evaluateOp(op ast.Value_Type, operands []*ast.Value, e Environment) (*ast.V
 				},
 			}, nil
 		}
-		a, err := valueToBigInt(operands[0])
+		a, err := ValueToBigInt(operands[0])
 		if err != nil {
 			return nil, err
 		}
-		b, err := valueToBigInt(operands[1])
+		b, err := ValueToBigInt(operands[1])
 		if err != nil {
 			return nil, err
 		}
 		if b.Cmp(new(big.Int)) == 0 {
 			return nil, fmt.Errorf("Divide by zero!")
 		}
-		return bigIntToValue(new(big.Int).Mod(a, b)), nil
+		return BigIntToValue(new(big.Int).Mod(a, b)), nil
 	case ast.Value_NOT:
 		if operands[0].GetT() != ast.Value_BOOL {
 			return nil, fmt.Errorf("Invalid operand type %s to NOT!", operands[0].GetT().String())
@@ -577,6 +598,13 @@ func evaluateOpGet(field ast.Value_Type, value *ast.Value, e Environment) (*ast.
 		// Running GET on NIL values always results in NIL
 		return value, nil
 	}
+	if value.GetT() == ast.Value_CELL_INPUT && isCellGetOp(field) {
+		// Cell get operations on inputs work on the resolved input cell
+		if len(value.GetChildren()) < 3 {
+			return nil, fmt.Errorf("Provided input does not have a resolved cell!")
+		}
+		value = value.GetChildren()[2]
+	}
 	switch field {
 	case ast.Value_GET_CAPACITY:
 		return value.GetChildren()[0], nil
@@ -602,13 +630,16 @@ func evaluateOpGet(field ast.Value_Type, value *ast.Value, e Environment) (*ast.
 			},
 		}, nil
 	case ast.Value_GET_OUT_POINT:
+		if value.GetT() == ast.Value_CELL_INPUT {
+			return value.GetChildren()[0], nil
+		}
 		if len(value.GetChildren()) < 5 {
 			return nil, fmt.Errorf("Provided cell does not have out point!")
 		}
 		return value.GetChildren()[4], nil
 	case ast.Value_GET_HEADER:
 		if len(value.GetChildren()) < 6 {
-			return nil, fmt.Errorf("Provided cell does not have header!")
+			return nil, fmt.Errorf("Provided %s does not have header!", value.GetT().String())
 		}
 		return value.GetChildren()[5], nil
 	case ast.Value_GET_CODE_HASH:
@@ -617,6 +648,16 @@ func evaluateOpGet(field ast.Value_Type, value *ast.Value, e Environment) (*ast.
 		return value.GetChildren()[1], nil
 	case ast.Value_GET_ARGS:
 		return value.GetChildren()[2], nil
+	case ast.Value_GET_INPUTS:
+		return transactionField(value, 0)
+	case ast.Value_GET_OUTPUTS:
+		return transactionField(value, 1)
+	case ast.Value_GET_CELL_DEPS:
+		return transactionField(value, 2)
+	case ast.Value_GET_HEADER_DEPS:
+		return transactionField(value, 3)
+	case ast.Value_GET_WITNESSES:
+		return transactionField(value, 4)
 	case ast.Value_GET_COMPACT_TARGET:
 		return value.GetChildren()[0], nil
 	case ast.Value_GET_TIMESTAMP:
@@ -641,6 +682,37 @@ func evaluateOpGet(field ast.Value_Type, value *ast.Value, e Environment) (*ast.
 	return nil, fmt.Errorf("Invalid get field: %s", field.String())
 }
 
+func isCellGetOp(field ast.Value_Type) bool {
+	return (field >= ast.Value_GET_CAPACITY && field <= ast.Value_GET_DATA_HASH) ||
+		field == ast.Value_GET_HEADER
+}
+
+func transactionField(tx *ast.Value, index int) (*ast.Value, error) {
+	if tx.GetT() != ast.Value_TRANSACTION {
+		return nil, fmt.Errorf("Invalid transaction value type: %s", tx.GetT().String())
+	}
+	if index < len(tx.GetChildren()) {
+		return tx.GetChildren()[index], nil
+	}
+	// Assembled transactions do not have header deps or witnesses, those are
+	// returned here in the same way they are serialized.
+	var values []*ast.Value
+	if index == 4 {
+		for range tx.GetChildren()[0].GetChildren() {
+			values = append(values, &ast.Value{
+				T: ast.Value_BYTES,
+				Primitive: &ast.Value_Raw{
+					Raw: []byte{},
+				},
+			})
+		}
+	}
+	return &ast.Value{
+		T:        ast.Value_LIST,
+		Children: values,
+	}, nil
+}
+
 func evaluateList(list *ast.Value, e Environment) ([]*ast.Value, error) {
 	switch list.GetT() {
 	case ast.Value_LIST:
@@ -687,6 +759,19 @@ func evaluateList(list *ast.Value, e Environment) ([]*ast.Value, error) {
 		return results, nil
 	case ast.Value_QUERY_CELLS:
 		return e.QueryCell(list)
+	case ast.Value_QUERY_TRANSACTIONS:
+		return e.QueryTransactions(list)
+	}
+	if isGetOp(list) || list.GetT() == ast.Value_ARG {
+		// Get operations such as GET_OUTPUTS, as well as args, can also
+		// produce lists
+		value, err := evaluateValueNonRecursion(list, e)
+		if err != nil {
+			return nil, err
+		}
+		if value.GetT() == ast.Value_LIST {
+			return value.GetChildren(), nil
+		}
 	}
 	return nil, fmt.Errorf("Invalid list type: %s", list.GetT().String())
 }
@@ -715,6 +800,21 @@ func evaluateHash(value *ast.Value) (*ast.Value, error) {
 				Raw: h,
 			},
 		}, nil
+	case ast.Value_TRANSACTION:
+		tx, err := ast.RestoreTransaction(value, false)
+		if err != nil {
+			return nil, err
+		}
+		h, err := rpctypes.CalculateHash(tx.RawTransaction)
+		if err != nil {
+			return nil, err
+		}
+		return &ast.Value{
+			T: ast.Value_BYTES,
+			Primitive: &ast.Value_Raw{
+				Raw: h,
+			},
+		}, nil
 	}
 	return nil, fmt.Errorf("Invalid value type: %s, cannot calculate hash", value.GetT().String())
 }
@@ -750,7 +850,8 @@ func evaluateSerialize(value *ast.Value, toJson bool) (*ast.Value, error) {
 	return nil, fmt.Errorf("Invalid value type: %s", value.GetT().String())
 }
 
-func valueToBigInt(value *ast.Value) (*big.Int, error) {
+// ValueToBigInt treats BYTES as little endian unsigned integers.
+func ValueToBigInt(value *ast.Value) (*big.Int, error) {
 	i := new(big.Int)
 	if value.GetT() == ast.Value_BYTES {
 		a := make([]byte, len(value.GetRaw()))
@@ -768,7 +869,7 @@ func valueToBigInt(value *ast.Value) (*big.Int, error) {
 	return i, nil
 }
 
-func bigIntToValue(i *big.Int) *ast.Value {
+func BigIntToValue(i *big.Int) *ast.Value {
 	a := i.Bytes()
 	for i := len(a)/2 - 1; i >= 0; i-- {
 		opp := len(a) - 1 - i
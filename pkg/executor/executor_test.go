@@ -1,10 +1,12 @@
 package executor
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
 
 	"github.com/xxuejie/animagus/pkg/ast"
+	"github.com/xxuejie/animagus/pkg/rpctypes"
 )
 
 type testEnvironment struct {
@@ -42,6 +44,14 @@ func (e *testEnvironment) QueryCell(query *ast.Value) ([]*ast.Value, error) {
 	return nil, fmt.Errorf("Query cell is not expected!")
 }
 
+func (e *testEnvironment) QueryTransactions(query *ast.Value) ([]*ast.Value, error) {
+	return nil, fmt.Errorf("Query transactions is not expected!")
+}
+
+func (e *testEnvironment) QueryAggregate(reduce *ast.Value) (*ast.Value, error) {
+	return nil, nil
+}
+
 func uint_value(u uint64) *ast.Value {
 	return &ast.Value{
 		T: ast.Value_UINT64,
@@ -128,3 +138,167 @@ func TestTailRecursion(t *testing.T) {
 		t.Errorf("Invalid result: %d, expected: 89", value.GetU())
 	}
 }
+
+func fetch_field(field ast.Value_Type, value *ast.Value) *ast.Value {
+	return &ast.Value{
+		T:        field,
+		Children: []*ast.Value{value},
+	}
+}
+
+func index(i uint64, list *ast.Value) *ast.Value {
+	return &ast.Value{
+		T:        ast.Value_INDEX,
+		Children: []*ast.Value{uint_value(i), list},
+	}
+}
+
+func testTransaction() *ast.Value {
+	var previousTxHash, headerDep rpctypes.Hash
+	previousTxHash[0] = 1
+	headerDep[0] = 2
+	previousCell := rpctypes.CellOutput{Capacity: 1000}
+	previousData := rpctypes.Raw{}
+	tx := rpctypes.TransactionView{}
+	tx.Hash[0] = 3
+	tx.Inputs = []rpctypes.CellInput{
+		rpctypes.CellInput{
+			Since: 5,
+			PreviousOutput: rpctypes.OutPoint{
+				TxHash:   previousTxHash,
+				Index:    1,
+				Cell:     &previousCell,
+				CellData: &previousData,
+			},
+		},
+	}
+	tx.Outputs = []rpctypes.CellOutput{
+		rpctypes.CellOutput{Capacity: 300},
+		rpctypes.CellOutput{Capacity: 600},
+	}
+	tx.OutputsData = []rpctypes.Bytes{rpctypes.Bytes{}, rpctypes.Bytes{0x42}}
+	tx.HeaderDeps = []rpctypes.Hash{headerDep}
+	tx.Witnesses = []rpctypes.Bytes{rpctypes.Bytes{0x55, 0x66}}
+	return ast.ConvertTransaction(tx)
+}
+
+func TestTransactionGetters(t *testing.T) {
+	tx := testTransaction()
+	if err := ast.IsValidTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	e := &testEnvironment{
+		args: []*ast.Value{tx},
+	}
+
+	outputCapacities := &ast.Value{
+		T: ast.Value_REDUCE,
+		Children: []*ast.Value{
+			&ast.Value{
+				T:        ast.Value_ADD,
+				Children: []*ast.Value{arg(0), arg(1)},
+			},
+			uint_value(0),
+			&ast.Value{
+				T: ast.Value_MAP,
+				Children: []*ast.Value{
+					fetch_field(ast.Value_GET_CAPACITY, arg(0)),
+					fetch_field(ast.Value_GET_OUTPUTS, arg(0)),
+				},
+			},
+		},
+	}
+	value, err := Execute(outputCapacities, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.GetU() != 900 {
+		t.Errorf("Invalid output capacities: %d, expected: 900", value.GetU())
+	}
+
+	input := index(0, fetch_field(ast.Value_GET_INPUTS, arg(0)))
+	value, err = Execute(fetch_field(ast.Value_GET_CAPACITY, input), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.GetU() != 1000 {
+		t.Errorf("Invalid input capacity: %d, expected: 1000", value.GetU())
+	}
+	value, err = Execute(fetch_field(ast.Value_GET_OUT_POINT, input), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.GetT() != ast.Value_OUT_POINT || value.GetChildren()[1].GetU() != 1 {
+		t.Errorf("Invalid input out point: %s", value.String())
+	}
+
+	value, err = Execute(index(0, fetch_field(ast.Value_GET_HEADER_DEPS, arg(0))), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(value.GetRaw()) != 32 || value.GetRaw()[0] != 2 {
+		t.Errorf("Invalid header dep: %x", value.GetRaw())
+	}
+	value, err = Execute(index(0, fetch_field(ast.Value_GET_WITNESSES, arg(0))), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value.GetRaw(), []byte{0x55, 0x66}) {
+		t.Errorf("Invalid witness: %x", value.GetRaw())
+	}
+	value, err = Execute(fetch_field(ast.Value_GET_CELL_DEPS, arg(0)), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.GetT() != ast.Value_LIST || len(value.GetChildren()) != 0 {
+		t.Errorf("Invalid cell deps: %s", value.String())
+	}
+}
+
+func TestAssembledTransactionGetters(t *testing.T) {
+	tx := testTransaction()
+	outputs := tx.GetChildren()[1]
+	assembled := &ast.Value{
+		T: ast.Value_TRANSACTION,
+		Children: []*ast.Value{
+			&ast.Value{
+				T:        ast.Value_LIST,
+				Children: []*ast.Value{outputs.GetChildren()[0]},
+			},
+			&ast.Value{
+				T: ast.Value_LIST,
+				Children: []*ast.Value{
+					&ast.Value{
+						T:        ast.Value_CELL,
+						Children: outputs.GetChildren()[1].GetChildren()[:4],
+					},
+				},
+			},
+			&ast.Value{T: ast.Value_LIST},
+		},
+	}
+	e := &testEnvironment{}
+
+	value, err := Execute(fetch_field(ast.Value_GET_WITNESSES, assembled), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(value.GetChildren()) != 1 || len(value.GetChildren()[0].GetRaw()) != 0 {
+		t.Errorf("Invalid witnesses: %s", value.String())
+	}
+	value, err = Execute(fetch_field(ast.Value_GET_HEADER_DEPS, assembled), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(value.GetChildren()) != 0 {
+		t.Errorf("Invalid header deps: %s", value.String())
+	}
+	value, err = Execute(fetch_field(ast.Value_GET_INPUTS, assembled), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(value.GetChildren()) != 1 ||
+		value.GetChildren()[0].GetT() != ast.Value_CELL_INPUT {
+		t.Errorf("Invalid inputs: %s", value.String())
+	}
+}
@@ -43,3 +43,11 @@ func (e *prependEnvironment) IndexParam(i int, value *ast.Value) error {
 func (e *prependEnvironment) QueryCell(query *ast.Value) ([]*ast.Value, error) {
 	return e.e.QueryCell(query)
 }
+
+func (e *prependEnvironment) QueryTransactions(query *ast.Value) ([]*ast.Value, error) {
+	return e.e.QueryTransactions(query)
+}
+
+func (e *prependEnvironment) QueryAggregate(reduce *ast.Value) (*ast.Value, error) {
+	return e.e.QueryAggregate(reduce)
+}
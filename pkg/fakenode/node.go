@@ -0,0 +1,291 @@
+// Package fakenode implements a local CKB JSON-RPC node serving blocks from
+// memory, so components talking to CKB can be tested deterministically
+// without a live node. Only the RPC methods animagus uses are supported.
+package fakenode
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/xxuejie/animagus/pkg/rpctypes"
+)
+
+type request struct {
+	ID      int               `json:"id"`
+	Jsonrpc string            `json:"jsonrpc"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+}
+
+type response struct {
+	ID      int         `json:"id"`
+	Jsonrpc string      `json:"jsonrpc"`
+	Result  interface{} `json:"result"`
+	Error   *rpcError   `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type Node struct {
+	mutex sync.Mutex
+	// Canonical chain, indexed by block number
+	blocks map[uint64]rpctypes.BlockView
+	tip    uint64
+	empty  bool
+	// Used to make sure mined blocks never share the same hash, even when
+	// they contain the same transactions.
+	nonce  int64
+	calls  map[string]int
+	server *httptest.Server
+}
+
+// NewNode starts a node with an empty chain, it must be closed by Close.
+func NewNode() *Node {
+	n := &Node{
+		blocks: make(map[uint64]rpctypes.BlockView),
+		empty:  true,
+		calls:  make(map[string]int),
+	}
+	n.server = httptest.NewServer(n)
+	return n
+}
+
+// URL returns the RPC URL of the node
+func (n *Node) URL() string {
+	return n.server.URL
+}
+
+func (n *Node) Close() {
+	n.server.Close()
+}
+
+// LoadBlocks adds all JSON encoded blocks in dir to the chain, in the order
+// of block numbers.
+func (n *Node) LoadBlocks(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	blocks := make([]rpctypes.BlockView, len(paths))
+	for i, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &blocks[i])
+		if err != nil {
+			return fmt.Errorf("Error loading block %s: %v", path, err)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Header.Number < blocks[j].Header.Number
+	})
+	for _, block := range blocks {
+		n.AddBlock(block)
+	}
+	return nil
+}
+
+// AddBlock puts block on the canonical chain at its block number, all
+// blocks above it are dropped. Adding a block at an existing height hence
+// scripts a fork, the new block also becomes the tip.
+func (n *Node) AddBlock(block rpctypes.BlockView) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	number := uint64(block.Header.Number)
+	for blockNumber := range n.blocks {
+		if blockNumber > number {
+			delete(n.blocks, blockNumber)
+		}
+	}
+	n.blocks[number] = block
+	n.tip = number
+	n.empty = false
+}
+
+// SetTip changes the tip block number reported by the node, blocks above
+// the tip are kept but hidden from RPC calls. This can be used to advance
+// the chain one block at a time.
+func (n *Node) SetTip(number uint64) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if _, found := n.blocks[number]; !found {
+		return fmt.Errorf("Block %d does not exist!", number)
+	}
+	n.tip = number
+	return nil
+}
+
+// Rollback drops all blocks above number, blocks mined afterwards will fork
+// the chain from there.
+func (n *Node) Rollback(number uint64) error {
+	n.mutex.Lock()
+	block, found := n.blocks[number]
+	n.mutex.Unlock()
+	if !found {
+		return fmt.Errorf("Block %d does not exist!", number)
+	}
+	n.AddBlock(block)
+	return nil
+}
+
+// Mine builds a block containing transactions on top of the current tip,
+// adds it to the chain and returns it. Transaction and block hashes are
+// calculated the same way CKB does.
+func (n *Node) Mine(transactions ...rpctypes.Transaction) (rpctypes.BlockView, error) {
+	n.mutex.Lock()
+	var block rpctypes.BlockView
+	if !n.empty {
+		parent := n.blocks[n.tip]
+		block.Header.Number = parent.Header.Number + 1
+		block.Header.ParentHash = parent.Header.Hash
+		block.Header.Timestamp = parent.Header.Timestamp + 1000
+	}
+	n.nonce += 1
+	block.Header.Nonce = rpctypes.Uint128{V: big.NewInt(n.nonce)}
+	n.mutex.Unlock()
+
+	block.Header.Dao = make(rpctypes.Raw, 32)
+	block.Uncles = []rpctypes.UncleBlockView{}
+	block.Proposals = []rpctypes.ProposalShortId{}
+	block.Transactions = make([]rpctypes.TransactionView, len(transactions))
+	for i, tx := range transactions {
+		hash, err := rpctypes.CalculateHash(tx.RawTransaction)
+		if err != nil {
+			return block, err
+		}
+		block.Transactions[i].Transaction = tx
+		copy(block.Transactions[i].Hash[:], hash)
+	}
+	hash, err := rpctypes.CalculateHash(block.Header.Header)
+	if err != nil {
+		return block, err
+	}
+	copy(block.Header.Hash[:], hash)
+	n.AddBlock(block)
+	return block, nil
+}
+
+// Calls returns how many times method has been called
+func (n *Node) Calls(method string) int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.calls[method]
+}
+
+func (n *Node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req request
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := response{
+		ID:      req.ID,
+		Jsonrpc: "2.0",
+	}
+	result, err := n.handle(req)
+	if err != nil {
+		resp.Error = &rpcError{
+			Code:    -32602,
+			Message: err.Error(),
+		}
+	} else {
+		resp.Result = result
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (n *Node) handle(req request) (interface{}, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.calls[req.Method] += 1
+	switch req.Method {
+	case "get_tip_block_number":
+		if n.empty {
+			return nil, nil
+		}
+		return rpctypes.Uint64(n.tip), nil
+	case "get_block_by_number":
+		var number rpctypes.Uint64
+		if err := parseParam(req, &number); err != nil {
+			return nil, err
+		}
+		if block, found := n.canonicalBlock(uint64(number)); found {
+			return block, nil
+		}
+	case "get_header":
+		var hash rpctypes.Hash
+		if err := parseParam(req, &hash); err != nil {
+			return nil, err
+		}
+		if block, found := n.blockByHash(hash); found {
+			return block.Header, nil
+		}
+	case "get_transaction":
+		var hash rpctypes.Hash
+		if err := parseParam(req, &hash); err != nil {
+			return nil, err
+		}
+		for number := uint64(0); number <= n.tip; number++ {
+			block, found := n.canonicalBlock(number)
+			if !found {
+				continue
+			}
+			for _, tx := range block.Transactions {
+				if tx.Hash == hash {
+					blockHash := block.Header.Hash
+					return rpctypes.TransactionWithStatusView{
+						Transaction: tx,
+						TxStatus: rpctypes.TxStatus{
+							BlockHash: &blockHash,
+							Status:    "committed",
+						},
+					}, nil
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Method %s is not supported!", req.Method)
+	}
+	return nil, nil
+}
+
+func (n *Node) canonicalBlock(number uint64) (rpctypes.BlockView, bool) {
+	if n.empty || number > n.tip {
+		return rpctypes.BlockView{}, false
+	}
+	block, found := n.blocks[number]
+	return block, found
+}
+
+func (n *Node) blockByHash(hash rpctypes.Hash) (rpctypes.BlockView, bool) {
+	for number, block := range n.blocks {
+		if number <= n.tip && block.Header.Hash == hash {
+			return block, true
+		}
+	}
+	return rpctypes.BlockView{}, false
+}
+
+func parseParam(req request, value interface{}) error {
+	if len(req.Params) != 1 {
+		return fmt.Errorf("Invalid number of params for %s: %d", req.Method, len(req.Params))
+	}
+	return json.Unmarshal(req.Params[0], value)
+}
@@ -0,0 +1,115 @@
+package fakenode
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/xxuejie/animagus/pkg/rpc"
+	"github.com/xxuejie/animagus/pkg/rpctypes"
+)
+
+func TestLoadBlocks(t *testing.T) {
+	n := NewNode()
+	defer n.Close()
+	err := n.LoadBlocks(filepath.Join("..", "rpctypes", "testdata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.NewClient(n.URL())
+
+	tip, err := client.GetTipBlockNumber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *tip != 0x16166 {
+		t.Errorf("Invalid tip: %d, expected: %d", *tip, 0x16166)
+	}
+	block, err := client.GetBlockByNumber(15081)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block == nil {
+		t.Fatal("Block 15081 is missing!")
+	}
+	tx := block.Transactions[1]
+	txWithStatus, err := client.GetTransaction(&tx.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txWithStatus.Transaction.Hash != tx.Hash ||
+		*txWithStatus.TxStatus.BlockHash != block.Header.Hash {
+		t.Errorf("Invalid transaction returned: %x", txWithStatus.Transaction.Hash)
+	}
+	header, err := client.GetHeader(&block.Header.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Number != 15081 {
+		t.Errorf("Invalid header number: %d", header.Number)
+	}
+
+	err = n.SetTip(15081)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err = client.GetBlockByNumber(0x16166)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block != nil {
+		t.Errorf("Block above tip is returned!")
+	}
+}
+
+func TestMineAndFork(t *testing.T) {
+	n := NewNode()
+	defer n.Close()
+	client := rpc.NewClient(n.URL())
+
+	tx := rpctypes.Transaction{
+		RawTransaction: rpctypes.RawTransaction{
+			Outputs:     []rpctypes.CellOutput{rpctypes.CellOutput{Capacity: 100}},
+			OutputsData: []rpctypes.Bytes{rpctypes.Bytes{}},
+		},
+	}
+	genesis, err := n.Mine(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block1, err := n.Mine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block1.Header.Number != 1 || block1.Header.ParentHash != genesis.Header.Hash {
+		t.Fatalf("Invalid mined block: %d", block1.Header.Number)
+	}
+
+	err = n.Rollback(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fork1, err := n.Mine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fork1.Header.Hash == block1.Header.Hash {
+		t.Fatal("Forked block shares the same hash!")
+	}
+	block, err := client.GetBlockByNumber(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Header.Hash != fork1.Header.Hash {
+		t.Errorf("Fork is not canonical: %x", block.Header.Hash)
+	}
+	txWithStatus, err := client.GetTransaction(&genesis.Transactions[0].Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txWithStatus.Transaction.Outputs[0].Capacity != 100 {
+		t.Errorf("Invalid transaction returned!")
+	}
+	if n.Calls("get_transaction") != 1 {
+		t.Errorf("Invalid number of get_transaction calls: %d", n.Calls("get_transaction"))
+	}
+}
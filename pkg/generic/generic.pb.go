@@ -25,12 +25,53 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
+type StreamEvent_Kind int32
+
+const (
+	StreamEvent_INDEX StreamEvent_Kind = 0
+	// Emitted when the block generating the event is reverted in a reorg
+	StreamEvent_REVERT StreamEvent_Kind = 1
+)
+
+var StreamEvent_Kind_name = map[int32]string{
+	0: "INDEX",
+	1: "REVERT",
+}
+
+var StreamEvent_Kind_value = map[string]int32{
+	"INDEX":  0,
+	"REVERT": 1,
+}
+
+func (x StreamEvent_Kind) String() string {
+	return proto.EnumName(StreamEvent_Kind_name, int32(x))
+}
+
+func (StreamEvent_Kind) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_4c692b03a02b431c, []int{2, 0}
+}
+
 type GenericParams struct {
-	Name                 string       `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
-	Params               []*ast.Value `protobuf:"bytes,2,rep,name=params,proto3" json:"params,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}     `json:"-"`
-	XXX_unrecognized     []byte       `json:"-"`
-	XXX_sizecache        int32        `json:"-"`
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// For streams using params in the filter, only events matching the
+	// provided params are delivered.
+	Params []*ast.Value `protobuf:"bytes,2,rep,name=params,proto3" json:"params,omitempty"`
+	// Only used by Stream, when start is not set, only events generated after
+	// the request are streamed.
+	//
+	// Types that are valid to be assigned to Start:
+	//	*GenericParams_Cursor
+	//	*GenericParams_FromBlock
+	Start isGenericParams_Start `protobuf_oneof:"start"`
+	// Only used by Call, when set, the call is evaluated against the cells
+	// indexed as of the given block instead of the latest ones.
+	//
+	// Types that are valid to be assigned to At:
+	//	*GenericParams_BlockNumber
+	At                   isGenericParams_At `protobuf_oneof:"at"`
+	XXX_NoUnkeyedLiteral struct{}           `json:"-"`
+	XXX_unrecognized     []byte             `json:"-"`
+	XXX_sizecache        int32              `json:"-"`
 }
 
 func (m *GenericParams) Reset()         { *m = GenericParams{} }
@@ -72,27 +113,482 @@ func (m *GenericParams) GetParams() []*ast.Value {
 	return nil
 }
 
+type isGenericParams_Start interface {
+	isGenericParams_Start()
+}
+
+type GenericParams_Cursor struct {
+	Cursor uint64 `protobuf:"varint,3,opt,name=cursor,proto3,oneof"`
+}
+
+type GenericParams_FromBlock struct {
+	FromBlock uint64 `protobuf:"varint,4,opt,name=from_block,json=fromBlock,proto3,oneof"`
+}
+
+func (*GenericParams_Cursor) isGenericParams_Start() {}
+
+func (*GenericParams_FromBlock) isGenericParams_Start() {}
+
+func (m *GenericParams) GetStart() isGenericParams_Start {
+	if m != nil {
+		return m.Start
+	}
+	return nil
+}
+
+func (m *GenericParams) GetCursor() uint64 {
+	if x, ok := m.GetStart().(*GenericParams_Cursor); ok {
+		return x.Cursor
+	}
+	return 0
+}
+
+func (m *GenericParams) GetFromBlock() uint64 {
+	if x, ok := m.GetStart().(*GenericParams_FromBlock); ok {
+		return x.FromBlock
+	}
+	return 0
+}
+
+type isGenericParams_At interface {
+	isGenericParams_At()
+}
+
+type GenericParams_BlockNumber struct {
+	BlockNumber uint64 `protobuf:"varint,5,opt,name=block_number,json=blockNumber,proto3,oneof"`
+}
+
+func (*GenericParams_BlockNumber) isGenericParams_At() {}
+
+func (m *GenericParams) GetAt() isGenericParams_At {
+	if m != nil {
+		return m.At
+	}
+	return nil
+}
+
+func (m *GenericParams) GetBlockNumber() uint64 {
+	if x, ok := m.GetAt().(*GenericParams_BlockNumber); ok {
+		return x.BlockNumber
+	}
+	return 0
+}
+
+// XXX_OneofWrappers is for the internal use of the proto package.
+func (*GenericParams) XXX_OneofWrappers() []interface{} {
+	return []interface{}{
+		(*GenericParams_Cursor)(nil),
+		(*GenericParams_FromBlock)(nil),
+		(*GenericParams_BlockNumber)(nil),
+	}
+}
+
+type CallResult struct {
+	Value *ast.Value `protobuf:"bytes,1,opt,name=value,proto3" json:"value,omitempty"`
+	// Block the call is evaluated at, all queries in the call observe the
+	// same indexed state as of this block. For calls requiring confirmations
+	// it is that many blocks before the requested or last indexed block, but
+	// not before the first indexed block
+	BlockNumber uint64 `protobuf:"varint,2,opt,name=block_number,json=blockNumber,proto3" json:"block_number,omitempty"`
+	// Not set for blocks deeper than max reorg depth
+	BlockHash            []byte   `protobuf:"bytes,3,opt,name=block_hash,json=blockHash,proto3" json:"block_hash,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *CallResult) Reset()         { *m = CallResult{} }
+func (m *CallResult) String() string { return proto.CompactTextString(m) }
+func (*CallResult) ProtoMessage()    {}
+func (*CallResult) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4c692b03a02b431c, []int{1}
+}
+
+func (m *CallResult) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CallResult.Unmarshal(m, b)
+}
+func (m *CallResult) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CallResult.Marshal(b, m, deterministic)
+}
+func (m *CallResult) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CallResult.Merge(m, src)
+}
+func (m *CallResult) XXX_Size() int {
+	return xxx_messageInfo_CallResult.Size(m)
+}
+func (m *CallResult) XXX_DiscardUnknown() {
+	xxx_messageInfo_CallResult.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CallResult proto.InternalMessageInfo
+
+func (m *CallResult) GetValue() *ast.Value {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+func (m *CallResult) GetBlockNumber() uint64 {
+	if m != nil {
+		return m.BlockNumber
+	}
+	return 0
+}
+
+func (m *CallResult) GetBlockHash() []byte {
+	if m != nil {
+		return m.BlockHash
+	}
+	return nil
+}
+
+type StreamEvent struct {
+	BlockNumber uint64 `protobuf:"varint,1,opt,name=block_number,json=blockNumber,proto3" json:"block_number,omitempty"`
+	BlockHash   []byte `protobuf:"bytes,2,opt,name=block_hash,json=blockHash,proto3" json:"block_hash,omitempty"`
+	// Transaction generating the event, not set for block streams
+	TxHash []byte `protobuf:"bytes,3,opt,name=tx_hash,json=txHash,proto3" json:"tx_hash,omitempty"`
+	// For cell streams, index of the cell in outputs of the transaction when
+	// the cell is created, or in inputs of the transaction when consumed
+	CellIndex uint64           `protobuf:"varint,4,opt,name=cell_index,json=cellIndex,proto3" json:"cell_index,omitempty"`
+	Kind      StreamEvent_Kind `protobuf:"varint,5,opt,name=kind,proto3,enum=generic.StreamEvent_Kind" json:"kind,omitempty"`
+	// Passing this as cursor in GenericParams resumes the stream after
+	// current event
+	Cursor               uint64     `protobuf:"varint,6,opt,name=cursor,proto3" json:"cursor,omitempty"`
+	Value                *ast.Value `protobuf:"bytes,7,opt,name=value,proto3" json:"value,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
+	XXX_unrecognized     []byte     `json:"-"`
+	XXX_sizecache        int32      `json:"-"`
+}
+
+func (m *StreamEvent) Reset()         { *m = StreamEvent{} }
+func (m *StreamEvent) String() string { return proto.CompactTextString(m) }
+func (*StreamEvent) ProtoMessage()    {}
+func (*StreamEvent) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4c692b03a02b431c, []int{2}
+}
+
+func (m *StreamEvent) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_StreamEvent.Unmarshal(m, b)
+}
+func (m *StreamEvent) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_StreamEvent.Marshal(b, m, deterministic)
+}
+func (m *StreamEvent) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StreamEvent.Merge(m, src)
+}
+func (m *StreamEvent) XXX_Size() int {
+	return xxx_messageInfo_StreamEvent.Size(m)
+}
+func (m *StreamEvent) XXX_DiscardUnknown() {
+	xxx_messageInfo_StreamEvent.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_StreamEvent proto.InternalMessageInfo
+
+func (m *StreamEvent) GetBlockNumber() uint64 {
+	if m != nil {
+		return m.BlockNumber
+	}
+	return 0
+}
+
+func (m *StreamEvent) GetBlockHash() []byte {
+	if m != nil {
+		return m.BlockHash
+	}
+	return nil
+}
+
+func (m *StreamEvent) GetTxHash() []byte {
+	if m != nil {
+		return m.TxHash
+	}
+	return nil
+}
+
+func (m *StreamEvent) GetCellIndex() uint64 {
+	if m != nil {
+		return m.CellIndex
+	}
+	return 0
+}
+
+func (m *StreamEvent) GetKind() StreamEvent_Kind {
+	if m != nil {
+		return m.Kind
+	}
+	return StreamEvent_INDEX
+}
+
+func (m *StreamEvent) GetCursor() uint64 {
+	if m != nil {
+		return m.Cursor
+	}
+	return 0
+}
+
+func (m *StreamEvent) GetValue() *ast.Value {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+type StatusParams struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *StatusParams) Reset()         { *m = StatusParams{} }
+func (m *StatusParams) String() string { return proto.CompactTextString(m) }
+func (*StatusParams) ProtoMessage()    {}
+func (*StatusParams) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4c692b03a02b431c, []int{3}
+}
+
+func (m *StatusParams) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_StatusParams.Unmarshal(m, b)
+}
+func (m *StatusParams) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_StatusParams.Marshal(b, m, deterministic)
+}
+func (m *StatusParams) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StatusParams.Merge(m, src)
+}
+func (m *StatusParams) XXX_Size() int {
+	return xxx_messageInfo_StatusParams.Size(m)
+}
+func (m *StatusParams) XXX_DiscardUnknown() {
+	xxx_messageInfo_StatusParams.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_StatusParams proto.InternalMessageInfo
+
+type QueryStatus struct {
+	Hash []byte `protobuf:"bytes,1,opt,name=hash,proto3" json:"hash,omitempty"`
+	// Calls using the query
+	Calls []string `protobuf:"bytes,2,rep,name=calls,proto3" json:"calls,omitempty"`
+	// Calls can only use the query once it is synced, till then it is still
+	// being back-filled
+	Synced bool `protobuf:"varint,3,opt,name=synced,proto3" json:"synced,omitempty"`
+	// Last block back-filled, only meaningful when not synced
+	BackfilledBlock uint64 `protobuf:"varint,4,opt,name=backfilled_block,json=backfilledBlock,proto3" json:"backfilled_block,omitempty"`
+	// Number of live cells in the query index, always 0 for
+	// QUERY_TRANSACTIONS
+	Cells                uint64   `protobuf:"varint,5,opt,name=cells,proto3" json:"cells,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *QueryStatus) Reset()         { *m = QueryStatus{} }
+func (m *QueryStatus) String() string { return proto.CompactTextString(m) }
+func (*QueryStatus) ProtoMessage()    {}
+func (*QueryStatus) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4c692b03a02b431c, []int{4}
+}
+
+func (m *QueryStatus) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_QueryStatus.Unmarshal(m, b)
+}
+func (m *QueryStatus) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_QueryStatus.Marshal(b, m, deterministic)
+}
+func (m *QueryStatus) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_QueryStatus.Merge(m, src)
+}
+func (m *QueryStatus) XXX_Size() int {
+	return xxx_messageInfo_QueryStatus.Size(m)
+}
+func (m *QueryStatus) XXX_DiscardUnknown() {
+	xxx_messageInfo_QueryStatus.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_QueryStatus proto.InternalMessageInfo
+
+func (m *QueryStatus) GetHash() []byte {
+	if m != nil {
+		return m.Hash
+	}
+	return nil
+}
+
+func (m *QueryStatus) GetCalls() []string {
+	if m != nil {
+		return m.Calls
+	}
+	return nil
+}
+
+func (m *QueryStatus) GetSynced() bool {
+	if m != nil {
+		return m.Synced
+	}
+	return false
+}
+
+func (m *QueryStatus) GetBackfilledBlock() uint64 {
+	if m != nil {
+		return m.BackfilledBlock
+	}
+	return 0
+}
+
+func (m *QueryStatus) GetCells() uint64 {
+	if m != nil {
+		return m.Cells
+	}
+	return 0
+}
+
+type IndexerStatus struct {
+	// Last block indexed
+	BlockNumber    uint64 `protobuf:"varint,1,opt,name=block_number,json=blockNumber,proto3" json:"block_number,omitempty"`
+	BlockHash      []byte `protobuf:"bytes,2,opt,name=block_hash,json=blockHash,proto3" json:"block_hash,omitempty"`
+	TipBlockNumber uint64 `protobuf:"varint,3,opt,name=tip_block_number,json=tipBlockNumber,proto3" json:"tip_block_number,omitempty"`
+	// Number of blocks the indexer is behind CKB tip
+	Lag uint64 `protobuf:"varint,4,opt,name=lag,proto3" json:"lag,omitempty"`
+	// Hash of all loaded AST files
+	AstHash []byte `protobuf:"bytes,5,opt,name=ast_hash,json=astHash,proto3" json:"ast_hash,omitempty"`
+	// Set from the first block reverted in a reorg, till a block of the new
+	// fork gets indexed
+	Reorganizing         bool           `protobuf:"varint,6,opt,name=reorganizing,proto3" json:"reorganizing,omitempty"`
+	Queries              []*QueryStatus `protobuf:"bytes,7,rep,name=queries,proto3" json:"queries,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
+	XXX_unrecognized     []byte         `json:"-"`
+	XXX_sizecache        int32          `json:"-"`
+}
+
+func (m *IndexerStatus) Reset()         { *m = IndexerStatus{} }
+func (m *IndexerStatus) String() string { return proto.CompactTextString(m) }
+func (*IndexerStatus) ProtoMessage()    {}
+func (*IndexerStatus) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4c692b03a02b431c, []int{5}
+}
+
+func (m *IndexerStatus) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_IndexerStatus.Unmarshal(m, b)
+}
+func (m *IndexerStatus) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_IndexerStatus.Marshal(b, m, deterministic)
+}
+func (m *IndexerStatus) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_IndexerStatus.Merge(m, src)
+}
+func (m *IndexerStatus) XXX_Size() int {
+	return xxx_messageInfo_IndexerStatus.Size(m)
+}
+func (m *IndexerStatus) XXX_DiscardUnknown() {
+	xxx_messageInfo_IndexerStatus.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_IndexerStatus proto.InternalMessageInfo
+
+func (m *IndexerStatus) GetBlockNumber() uint64 {
+	if m != nil {
+		return m.BlockNumber
+	}
+	return 0
+}
+
+func (m *IndexerStatus) GetBlockHash() []byte {
+	if m != nil {
+		return m.BlockHash
+	}
+	return nil
+}
+
+func (m *IndexerStatus) GetTipBlockNumber() uint64 {
+	if m != nil {
+		return m.TipBlockNumber
+	}
+	return 0
+}
+
+func (m *IndexerStatus) GetLag() uint64 {
+	if m != nil {
+		return m.Lag
+	}
+	return 0
+}
+
+func (m *IndexerStatus) GetAstHash() []byte {
+	if m != nil {
+		return m.AstHash
+	}
+	return nil
+}
+
+func (m *IndexerStatus) GetReorganizing() bool {
+	if m != nil {
+		return m.Reorganizing
+	}
+	return false
+}
+
+func (m *IndexerStatus) GetQueries() []*QueryStatus {
+	if m != nil {
+		return m.Queries
+	}
+	return nil
+}
+
 func init() {
+	proto.RegisterEnum("generic.StreamEvent_Kind", StreamEvent_Kind_name, StreamEvent_Kind_value)
 	proto.RegisterType((*GenericParams)(nil), "generic.GenericParams")
+	proto.RegisterType((*CallResult)(nil), "generic.CallResult")
+	proto.RegisterType((*StreamEvent)(nil), "generic.StreamEvent")
+	proto.RegisterType((*StatusParams)(nil), "generic.StatusParams")
+	proto.RegisterType((*QueryStatus)(nil), "generic.QueryStatus")
+	proto.RegisterType((*IndexerStatus)(nil), "generic.IndexerStatus")
 }
 
 func init() { proto.RegisterFile("generic.proto", fileDescriptor_4c692b03a02b431c) }
 
 var fileDescriptor_4c692b03a02b431c = []byte{
-	// 197 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x4d, 0x4f, 0xcd, 0x4b,
-	0x2d, 0xca, 0x4c, 0xd6, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x87, 0x72, 0xa5, 0x38, 0x13,
-	0x8b, 0x4b, 0x20, 0x62, 0x4a, 0xee, 0x5c, 0xbc, 0xee, 0x10, 0xd1, 0x80, 0xc4, 0xa2, 0xc4, 0xdc,
-	0x62, 0x21, 0x21, 0x2e, 0x96, 0xbc, 0xc4, 0xdc, 0x54, 0x09, 0x46, 0x05, 0x46, 0x0d, 0xce, 0x20,
-	0x30, 0x5b, 0x48, 0x89, 0x8b, 0xad, 0x00, 0x2c, 0x2b, 0xc1, 0xa4, 0xc0, 0xac, 0xc1, 0x6d, 0xc4,
-	0xa5, 0x07, 0x32, 0x20, 0x2c, 0x31, 0xa7, 0x34, 0x35, 0x08, 0x2a, 0x63, 0x54, 0xc0, 0xc5, 0x07,
-	0x35, 0x28, 0x38, 0xb5, 0xa8, 0x2c, 0x33, 0x39, 0x55, 0x48, 0x87, 0x8b, 0xc5, 0x39, 0x31, 0x27,
-	0x47, 0x48, 0x4c, 0x0f, 0xe6, 0x0c, 0x14, 0x9b, 0xa4, 0x90, 0x4c, 0x51, 0x62, 0x10, 0x32, 0xe0,
-	0x62, 0x0b, 0x2e, 0x29, 0x4a, 0x4d, 0xcc, 0x25, 0x4e, 0xbd, 0x01, 0xa3, 0x93, 0x66, 0x94, 0x7a,
-	0x7a, 0x66, 0x49, 0x46, 0x69, 0x92, 0x5e, 0x72, 0x7e, 0xae, 0x7e, 0x45, 0x45, 0x69, 0x6a, 0x56,
-	0x66, 0xaa, 0x7e, 0x62, 0x5e, 0x66, 0x6e, 0x62, 0x7a, 0x69, 0xb1, 0x7e, 0x41, 0x76, 0xba, 0x3e,
-	0xd4, 0xa0, 0x24, 0x36, 0xb0, 0x67, 0x8d, 0x01, 0x01, 0x00, 0x00, 0xff, 0xff, 0x34, 0x56, 0xfa,
-	0x35, 0x11, 0x01, 0x00, 0x00,
+	// 629 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x54, 0x4d, 0x6f, 0xd3, 0x40,
+	0x10, 0x8d, 0x53, 0xc7, 0xae, 0x27, 0x69, 0x88, 0x96, 0x52, 0xdc, 0x4a, 0x15, 0xc1, 0x1c, 0x48,
+	0x0f, 0x24, 0xa8, 0x88, 0x03, 0x1c, 0x03, 0x11, 0xad, 0x90, 0x2a, 0xd8, 0xa2, 0x0a, 0x71, 0x89,
+	0x36, 0xce, 0xd6, 0x59, 0xe2, 0x8f, 0xb0, 0x5e, 0x47, 0x29, 0x7f, 0x02, 0x7e, 0x0d, 0x47, 0x7e,
+	0x19, 0x07, 0xb4, 0xb3, 0x6e, 0x3e, 0x0a, 0x15, 0x07, 0x6e, 0x9e, 0x37, 0xb3, 0x6f, 0xdf, 0xce,
+	0xbc, 0x31, 0xec, 0x44, 0x3c, 0xe5, 0x52, 0x84, 0xdd, 0x99, 0xcc, 0x54, 0x46, 0xdc, 0x32, 0x3c,
+	0xf0, 0x58, 0xae, 0x0c, 0x16, 0xfc, 0xb0, 0x60, 0xe7, 0x8d, 0x81, 0xdf, 0x31, 0xc9, 0x92, 0x9c,
+	0x10, 0xb0, 0x53, 0x96, 0x70, 0xdf, 0x6a, 0x5b, 0x1d, 0x8f, 0xe2, 0x37, 0x09, 0xc0, 0x99, 0x61,
+	0xd6, 0xaf, 0xb6, 0xb7, 0x3a, 0xf5, 0x63, 0xe8, 0x6a, 0x86, 0x0b, 0x16, 0x17, 0x9c, 0x96, 0x19,
+	0xe2, 0x83, 0x13, 0x16, 0x32, 0xcf, 0xa4, 0xbf, 0xd5, 0xb6, 0x3a, 0xf6, 0x49, 0x85, 0x96, 0x31,
+	0x79, 0x00, 0x70, 0x29, 0xb3, 0x64, 0x38, 0x8a, 0xb3, 0x70, 0xea, 0xdb, 0x65, 0xd6, 0xd3, 0x58,
+	0x5f, 0x43, 0xe4, 0x11, 0x34, 0x30, 0x37, 0x4c, 0x8b, 0x64, 0xc4, 0xa5, 0x5f, 0xc3, 0x12, 0x8b,
+	0xd6, 0x11, 0x3d, 0x43, 0xb0, 0xef, 0x42, 0x2d, 0x57, 0x4c, 0xaa, 0xbe, 0x0d, 0x55, 0xa6, 0x82,
+	0x19, 0xc0, 0x2b, 0x16, 0xc7, 0x94, 0xe7, 0x45, 0xac, 0x48, 0x1b, 0x6a, 0x73, 0xad, 0x06, 0x55,
+	0x6f, 0xea, 0x33, 0x09, 0xf2, 0xf0, 0xc6, 0x1d, 0x55, 0x7d, 0xc7, 0xc6, 0x0d, 0xe4, 0x10, 0xc0,
+	0x94, 0x4c, 0x58, 0x3e, 0xc1, 0x57, 0x34, 0xa8, 0x87, 0xc8, 0x09, 0xcb, 0x27, 0xc1, 0xb7, 0x2a,
+	0xd4, 0xcf, 0x95, 0xe4, 0x2c, 0x19, 0xcc, 0x79, 0xaa, 0xfe, 0x60, 0xb4, 0xfe, 0xc5, 0x58, 0xbd,
+	0xc1, 0x48, 0xee, 0x83, 0xab, 0x16, 0xeb, 0xb7, 0x39, 0x6a, 0x81, 0x89, 0x43, 0x80, 0x90, 0xc7,
+	0xf1, 0x50, 0xa4, 0x63, 0xbe, 0x30, 0x1d, 0xa3, 0x9e, 0x46, 0x4e, 0x35, 0x40, 0x9e, 0x80, 0x3d,
+	0x15, 0xe9, 0x18, 0xfb, 0xd4, 0x3c, 0xde, 0xef, 0x5e, 0x8f, 0x79, 0x4d, 0x5d, 0xf7, 0xad, 0x48,
+	0xc7, 0x14, 0xcb, 0xc8, 0xde, 0x72, 0x32, 0x0e, 0x32, 0x95, 0xd1, 0xaa, 0x69, 0xee, 0x2d, 0x4d,
+	0x0b, 0x0e, 0xc1, 0xd6, 0x3c, 0xc4, 0x83, 0xda, 0xe9, 0xd9, 0xeb, 0xc1, 0xc7, 0x56, 0x85, 0x00,
+	0x38, 0x74, 0x70, 0x31, 0xa0, 0x1f, 0x5a, 0x56, 0xd0, 0x84, 0xc6, 0xb9, 0x62, 0xaa, 0xc8, 0x8d,
+	0x75, 0x82, 0xef, 0x16, 0xd4, 0xdf, 0x17, 0x5c, 0x5e, 0x19, 0x54, 0x5b, 0x09, 0x1f, 0x67, 0xe1,
+	0xe3, 0xf0, 0x9b, 0xec, 0x42, 0x2d, 0x64, 0x71, 0x6c, 0x9c, 0xe4, 0x51, 0x13, 0x68, 0x89, 0xf9,
+	0x55, 0x1a, 0xf2, 0x31, 0x36, 0x62, 0x9b, 0x96, 0x11, 0x39, 0x82, 0xd6, 0x88, 0x85, 0xd3, 0x4b,
+	0x11, 0xc7, 0x7c, 0xbc, 0x6e, 0x20, 0x7a, 0x67, 0x85, 0x1b, 0x13, 0x69, 0x62, 0xae, 0x89, 0xd1,
+	0x3d, 0xd4, 0x04, 0xc1, 0x2f, 0x0b, 0x76, 0xb0, 0x69, 0x5c, 0x96, 0xa2, 0xfe, 0x7f, 0x6c, 0x1d,
+	0x68, 0x29, 0x31, 0x1b, 0x6e, 0xb0, 0xa0, 0xe7, 0x69, 0x53, 0x89, 0x59, 0x7f, 0x8d, 0xa8, 0x05,
+	0x5b, 0x31, 0x8b, 0x4a, 0xc5, 0xfa, 0x93, 0xec, 0xc3, 0x36, 0xcb, 0x95, 0x21, 0xae, 0x21, 0xb1,
+	0xcb, 0x72, 0x85, 0xb4, 0x01, 0x34, 0x24, 0xcf, 0x64, 0xc4, 0x52, 0xf1, 0x55, 0xa4, 0x11, 0x0e,
+	0x6b, 0x9b, 0x6e, 0x60, 0xa4, 0x0b, 0xee, 0x97, 0x82, 0x4b, 0xc1, 0x73, 0xdf, 0xc5, 0x4d, 0xdc,
+	0x5d, 0x0e, 0x7f, 0xad, 0xf1, 0xf4, 0xba, 0xe8, 0xf8, 0xa7, 0x05, 0xcd, 0x72, 0xbd, 0xcf, 0xb9,
+	0x9c, 0x8b, 0x90, 0x93, 0xe7, 0x60, 0xeb, 0xc5, 0x21, 0x7b, 0xcb, 0x93, 0x1b, 0xfb, 0x7f, 0x70,
+	0x77, 0x89, 0xaf, 0xf6, 0x2b, 0xa8, 0x90, 0x97, 0xe0, 0x18, 0x7b, 0xdd, 0x7a, 0x70, 0xf7, 0x6f,
+	0x3e, 0x0c, 0x2a, 0x4f, 0x2d, 0xf2, 0x02, 0x1c, 0x23, 0x8c, 0xdc, 0x5b, 0xab, 0x59, 0x19, 0xe7,
+	0x60, 0x45, 0xb9, 0x31, 0xab, 0xa0, 0xd2, 0x3f, 0xfa, 0xf4, 0x38, 0x12, 0x6a, 0x52, 0x8c, 0xba,
+	0x61, 0x96, 0xf4, 0x16, 0x8b, 0x82, 0x7f, 0x16, 0xbc, 0xc7, 0x52, 0x91, 0xb0, 0xa8, 0xc8, 0x7b,
+	0xb3, 0x69, 0xd4, 0x2b, 0x8f, 0x8e, 0x1c, 0xfc, 0xa3, 0x3d, 0xfb, 0x3d, 0x00, 0xb4, 0xc0, 0x55,
+	0x4d, 0xf6, 0x04, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -107,8 +603,9 @@ const _ = grpc.SupportPackageIsVersion4
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
 type GenericServiceClient interface {
-	Call(ctx context.Context, in *GenericParams, opts ...grpc.CallOption) (*ast.Value, error)
+	Call(ctx context.Context, in *GenericParams, opts ...grpc.CallOption) (*CallResult, error)
 	Stream(ctx context.Context, in *GenericParams, opts ...grpc.CallOption) (GenericService_StreamClient, error)
+	Status(ctx context.Context, in *StatusParams, opts ...grpc.CallOption) (*IndexerStatus, error)
 }
 
 type genericServiceClient struct {
@@ -119,8 +616,8 @@ func NewGenericServiceClient(cc *grpc.ClientConn) GenericServiceClient {
 	return &genericServiceClient{cc}
 }
 
-func (c *genericServiceClient) Call(ctx context.Context, in *GenericParams, opts ...grpc.CallOption) (*ast.Value, error) {
-	out := new(ast.Value)
+func (c *genericServiceClient) Call(ctx context.Context, in *GenericParams, opts ...grpc.CallOption) (*CallResult, error) {
+	out := new(CallResult)
 	err := c.cc.Invoke(ctx, "/generic.GenericService/Call", in, out, opts...)
 	if err != nil {
 		return nil, err
@@ -144,7 +641,7 @@ func (c *genericServiceClient) Stream(ctx context.Context, in *GenericParams, op
 }
 
 type GenericService_StreamClient interface {
-	Recv() (*ast.Value, error)
+	Recv() (*StreamEvent, error)
 	grpc.ClientStream
 }
 
@@ -152,30 +649,43 @@ type genericServiceStreamClient struct {
 	grpc.ClientStream
 }
 
-func (x *genericServiceStreamClient) Recv() (*ast.Value, error) {
-	m := new(ast.Value)
+func (x *genericServiceStreamClient) Recv() (*StreamEvent, error) {
+	m := new(StreamEvent)
 	if err := x.ClientStream.RecvMsg(m); err != nil {
 		return nil, err
 	}
 	return m, nil
 }
 
+func (c *genericServiceClient) Status(ctx context.Context, in *StatusParams, opts ...grpc.CallOption) (*IndexerStatus, error) {
+	out := new(IndexerStatus)
+	err := c.cc.Invoke(ctx, "/generic.GenericService/Status", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // GenericServiceServer is the server API for GenericService service.
 type GenericServiceServer interface {
-	Call(context.Context, *GenericParams) (*ast.Value, error)
+	Call(context.Context, *GenericParams) (*CallResult, error)
 	Stream(*GenericParams, GenericService_StreamServer) error
+	Status(context.Context, *StatusParams) (*IndexerStatus, error)
 }
 
 // UnimplementedGenericServiceServer can be embedded to have forward compatible implementations.
 type UnimplementedGenericServiceServer struct {
 }
 
-func (*UnimplementedGenericServiceServer) Call(ctx context.Context, req *GenericParams) (*ast.Value, error) {
+func (*UnimplementedGenericServiceServer) Call(ctx context.Context, req *GenericParams) (*CallResult, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Call not implemented")
 }
 func (*UnimplementedGenericServiceServer) Stream(req *GenericParams, srv GenericService_StreamServer) error {
 	return status.Errorf(codes.Unimplemented, "method Stream not implemented")
 }
+func (*UnimplementedGenericServiceServer) Status(ctx context.Context, req *StatusParams) (*IndexerStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Status not implemented")
+}
 
 func RegisterGenericServiceServer(s *grpc.Server, srv GenericServiceServer) {
 	s.RegisterService(&_GenericService_serviceDesc, srv)
@@ -208,7 +718,7 @@ func _GenericService_Stream_Handler(srv interface{}, stream grpc.ServerStream) e
 }
 
 type GenericService_StreamServer interface {
-	Send(*ast.Value) error
+	Send(*StreamEvent) error
 	grpc.ServerStream
 }
 
@@ -216,10 +726,28 @@ type genericServiceStreamServer struct {
 	grpc.ServerStream
 }
 
-func (x *genericServiceStreamServer) Send(m *ast.Value) error {
+func (x *genericServiceStreamServer) Send(m *StreamEvent) error {
 	return x.ServerStream.SendMsg(m)
 }
 
+func _GenericService_Status_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatusParams)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GenericServiceServer).Status(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/generic.GenericService/Status",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GenericServiceServer).Status(ctx, req.(*StatusParams))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _GenericService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "generic.GenericService",
 	HandlerType: (*GenericServiceServer)(nil),
@@ -228,6 +756,10 @@ var _GenericService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Call",
 			Handler:    _GenericService_Call_Handler,
 		},
+		{
+			MethodName: "Status",
+			Handler:    _GenericService_Status_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
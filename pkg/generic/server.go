@@ -1,67 +1,114 @@
 package generic
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
+	"log"
+	"math"
+	"math/big"
+	"sort"
+	"sync"
 
 	"github.com/golang/protobuf/proto"
-	"github.com/gomodule/redigo/redis"
 	"github.com/xxuejie/animagus/pkg/ast"
 	"github.com/xxuejie/animagus/pkg/coretypes"
 	"github.com/xxuejie/animagus/pkg/executor"
 	"github.com/xxuejie/animagus/pkg/indexer"
 	"github.com/xxuejie/animagus/pkg/rpc"
 	"github.com/xxuejie/animagus/pkg/rpctypes"
+	"github.com/xxuejie/animagus/pkg/store"
 	"github.com/xxuejie/animagus/pkg/verifier"
 )
 
+const streamBatchSize = 100
+
+// Calls are retried at most this many times when blocks are indexed or
+// reverted while they are running
+const maxCallAttempts = 5
+
+// Size of a serialized OutPoint
+const outPointSize = 36
+
+var maxUint64 = new(big.Int).SetUint64(math.MaxUint64)
+
 type callInfo struct {
 	expr    *ast.Value
 	context indexer.ValueContext
 }
 
 type Server struct {
+	// Guards calls, streams and astHash, which are swapped when reloading
+	mutex     sync.RWMutex
 	calls     map[string]callInfo
-	streams   []*ast.Stream
-	redisPool *redis.Pool
+	streams   map[string]indexer.StreamContext
+	astHash   []byte
+	store     store.Store
 	rpcClient *rpc.Client
 }
 
-func NewServer(astContent []byte, redisPool *redis.Pool, rpcUrl string) (*Server, error) {
-	root := &ast.Root{}
-	err := proto.Unmarshal(astContent, root)
+func NewServer(files []indexer.ASTFile, s store.Store, rpcUrl string) (*Server, error) {
+	calls, streams, err := loadFiles(files)
 	if err != nil {
 		return nil, err
 	}
+	client := rpc.NewClient(rpcUrl)
+	return &Server{
+		calls:     calls,
+		streams:   streams,
+		astHash:   indexer.ASTHash(files),
+		store:     s,
+		rpcClient: client,
+	}, nil
+}
+
+// Reload swaps in calls and streams from files, requests already running
+// are not affected. Nothing changes if any of the files fails verification.
+func (s *Server) Reload(files []indexer.ASTFile) error {
+	calls, streams, err := loadFiles(files)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls = calls
+	s.streams = streams
+	s.astHash = indexer.ASTHash(files)
+	return nil
+}
+
+func loadFiles(files []indexer.ASTFile) (map[string]callInfo, map[string]indexer.StreamContext, error) {
+	rootCalls, rootStreams, err := indexer.ParseASTFiles(files)
+	if err != nil {
+		return nil, nil, err
+	}
 	calls := make(map[string]callInfo)
-	for _, call := range root.GetCalls() {
+	for _, call := range rootCalls {
 		err = verifier.Verify(call.GetResult())
 		if err != nil {
-			return nil, fmt.Errorf("Verification failure for call %s: %s", call.GetName(), err)
+			return nil, nil, fmt.Errorf("Verification failure for call %s: %s", call.GetName(), err)
 		}
-		valueContext, err := indexer.NewValueContext(call.GetName(), call.GetResult())
+		valueContext, err := indexer.NewValueContext(call)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		calls[call.GetName()] = callInfo{
 			expr:    call.GetResult(),
 			context: valueContext,
 		}
 	}
-	for _, stream := range root.GetStreams() {
+	streams := make(map[string]indexer.StreamContext)
+	for _, stream := range rootStreams {
 		err = verifier.Verify(stream.GetFilter())
 		if err != nil {
-			return nil, fmt.Errorf("Verification failure for stream %s: %s", stream.GetName(), err)
+			return nil, nil, fmt.Errorf("Verification failure for stream %s: %s", stream.GetName(), err)
 		}
+		streams[stream.GetName()] = indexer.NewStreamContext(stream)
 	}
-	client := rpc.NewClient(rpcUrl)
-	return &Server{
-		calls:     calls,
-		streams:   root.GetStreams(),
-		redisPool: redisPool,
-		rpcClient: client,
-	}, nil
+	return calls, streams, nil
 }
 
 type executeEnvironment struct {
@@ -92,75 +139,91 @@ func (e executeEnvironment) IndexParam(i int, value *ast.Value) error {
 	return fmt.Errorf("Indexing param is not allowed when executing!")
 }
 
+// getCells loads cells from the live cell set kept by the indexer, only
+// cells no longer kept there, such as spent ones needed by historical calls,
+// are fetched from CKB.
 func (s *Server) getCells(coreOutPoints []coretypes.OutPoint) ([]*rpctypes.OutPoint, error) {
+	outPoints := make([]rpctypes.OutPoint, len(coreOutPoints))
+	for i, coreOutPoint := range coreOutPoints {
+		copy(outPoints[i].TxHash[:], []byte(coreOutPoint.TxHash()))
+		outPoints[i].Index = rpctypes.Uint32(coreOutPoint.Index())
+	}
+	result, err := indexer.LiveCells(s.store, outPoints)
+	if err != nil {
+		return nil, err
+	}
+
 	var rpcOutPoints []*rpctypes.OutPoint
 	set := make(map[rpctypes.Hash]int)
-
-	for _, coreOutPoint := range coreOutPoints {
-		txHash := []byte(coreOutPoint.TxHash())
-		var rpcTxHash rpctypes.Hash
-		copy(rpcTxHash[:], txHash)
-		rpcIndex := rpctypes.Uint32(coreOutPoint.Index())
-		rpcOutPoint := rpctypes.OutPoint{
-			TxHash: rpcTxHash,
-			Index:  rpcIndex,
+	for i, outPoint := range outPoints {
+		if result[i] == nil {
+			rpcOutPoints = append(rpcOutPoints, &outPoints[i])
+			set[outPoint.TxHash] = 1
 		}
-		rpcOutPoints = append(rpcOutPoints, &rpcOutPoint)
-		set[rpcTxHash] = 1
+	}
+	if len(rpcOutPoints) == 0 {
+		return result, nil
 	}
 
 	var txHashes []rpctypes.Hash
 	for key := range set {
 		txHashes = append(txHashes, key)
 	}
-
-	transactionWithStatusViews, err := s.rpcClient.GetAllTransactions(txHashes, 50)
+	transactions, headers, err := s.fetchTransactions(txHashes)
 	if err != nil {
 		return nil, err
 	}
+	for i, outPoint := range outPoints {
+		if result[i] != nil {
+			continue
+		}
+		cell, data, blockHash, found := rpc.CommittedCell(transactions, outPoint)
+		if !found {
+			return nil, fmt.Errorf("Cell %x:%d cannot be found!", outPoint.TxHash[:], outPoint.Index)
+		}
+		result[i] = &rpctypes.OutPoint{
+			TxHash:   outPoint.TxHash,
+			Index:    outPoint.Index,
+			Cell:     cell,
+			CellData: data,
+			Header:   headers[blockHash],
+		}
+	}
+	return result, nil
+}
 
-	txWithStatusMap := make(map[rpctypes.Hash]*rpctypes.TransactionWithStatusView)
-	blockHashSet := make(map[rpctypes.Hash]int)
-	for _, txWithStatusView := range transactionWithStatusViews {
-		txWithStatusMap[txWithStatusView.Transaction.Hash] = txWithStatusView
-		blockHashSet[*txWithStatusView.TxStatus.BlockHash] = 1
+// historicalCells returns cells in the query index as of blockNumber, taking
+// confirmations of the call into account.
+func (e executeEnvironment) historicalCells(queryIndex int, paramValues map[int]*ast.Value, blockNumber uint64) ([][]byte, error) {
+	createdKey, consumedKey, err := e.valueContext.HistoryKeys(queryIndex, paramValues)
+	if err != nil {
+		return nil, err
 	}
-	var blockHashes []rpctypes.Hash
-	for key := range blockHashSet {
-		blockHashes = append(blockHashes, key)
+	created, err := e.s.store.Members(createdKey)
+	if err != nil {
+		return nil, err
 	}
-	headers, err := s.rpcClient.GetAllHeaders(blockHashes, 50)
+	consumed, err := e.s.store.Members(consumedKey)
 	if err != nil {
 		return nil, err
 	}
-	headerMap := make(map[rpctypes.Hash]*rpctypes.Header)
-	for _, header := range headers {
-		headerMap[header.Hash] = &header.Header
+	inRange := func(record []byte) bool {
+		return len(record) == outPointSize+8 &&
+			binary.LittleEndian.Uint64(record[outPointSize:])+e.valueContext.Confirmations <= blockNumber
 	}
-
-	var result []*rpctypes.OutPoint
-	for _, outPoint := range rpcOutPoints {
-		// get transaction
-		transactionWithStatus := txWithStatusMap[outPoint.TxHash]
-		transactionView := &transactionWithStatus.Transaction
-
-		index := outPoint.Index
-		cell := transactionView.Outputs[index]
-		originData := &transactionView.OutputsData[index]
-		raw := rpctypes.Raw([]byte(*originData))
-
-		// get header
-		header := headerMap[*transactionWithStatus.TxStatus.BlockHash]
-		resultOutPoint := rpctypes.OutPoint{
-			TxHash:   outPoint.TxHash,
-			Index:    outPoint.Index,
-			Cell:     &cell,
-			CellData: &raw,
-			Header:   header,
+	consumedSet := make(map[string]bool)
+	for _, record := range consumed {
+		if inRange(record) {
+			consumedSet[string(record[:outPointSize])] = true
 		}
-		result = append(result, &resultOutPoint)
 	}
-	return result, nil
+	var slices [][]byte
+	for _, record := range created {
+		if inRange(record) && !consumedSet[string(record[:outPointSize])] {
+			slices = append(slices, record[:outPointSize])
+		}
+	}
+	return slices, nil
 }
 
 func (e executeEnvironment) QueryCell(query *ast.Value) ([]*ast.Value, error) {
@@ -176,9 +239,12 @@ func (e executeEnvironment) QueryCell(query *ast.Value) ([]*ast.Value, error) {
 	if err != nil {
 		return nil, err
 	}
-	conn := e.s.redisPool.Get()
-	defer conn.Close()
-	slices, err := redis.ByteSlices(conn.Do("SMEMBERS", indexKey))
+	var slices [][]byte
+	if blockNumber, ok := e.params.GetAt().(*GenericParams_BlockNumber); ok {
+		slices, err = e.historicalCells(queryIndex, paramValues, blockNumber.BlockNumber)
+	} else {
+		slices, err = e.s.store.Members(indexKey)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -203,60 +269,522 @@ func (e executeEnvironment) QueryCell(query *ast.Value) ([]*ast.Value, error) {
 	return results, nil
 }
 
-func (s *Server) Call(ctx context.Context, p *GenericParams) (*ast.Value, error) {
+func (e executeEnvironment) QueryAggregate(reduce *ast.Value) (*ast.Value, error) {
+	// Historical calls are evaluated from the query index instead
+	if e.params.GetAt() != nil {
+		return nil, nil
+	}
+	queryIndex := e.valueContext.QueryIndex(reduce)
+	if queryIndex == -1 {
+		return nil, nil
+	}
+	paramValues := make(map[int]*ast.Value)
+	for i, value := range e.params.GetParams() {
+		paramValues[i] = value
+	}
+	indexKey, err := e.valueContext.IndexKey(queryIndex, paramValues)
+	if err != nil {
+		return nil, err
+	}
+	data, err := e.s.store.Get(indexKey)
+	if err != nil {
+		return nil, err
+	}
+	aggregate, err := indexer.ParseAggregate(data)
+	if err != nil {
+		return nil, err
+	}
+	initial := reduce.GetChildren()[1]
+	// Errors are left for the full evaluation to report. Adding UINT64 values
+	// might also overflow before switching to BYTES, depending on the order.
+	if aggregate.Errors > 0 ||
+		(initial.GetT() == ast.Value_UINT64 && aggregate.Bytes > 0 && aggregate.Bytes < aggregate.Count) {
+		return nil, nil
+	}
+	if aggregate.Count == 0 {
+		return initial, nil
+	}
+	sum := executor.BigIntToValue(aggregate.Sum)
+	if initial.GetT() == ast.Value_UINT64 && aggregate.Bytes == 0 {
+		// UINT64 additions wrap around
+		sum = &ast.Value{
+			T: ast.Value_UINT64,
+			Primitive: &ast.Value_U{
+				U: new(big.Int).And(aggregate.Sum, maxUint64).Uint64(),
+			},
+		}
+	}
+	return executor.Execute(&ast.Value{
+		T:        ast.Value_ADD,
+		Children: []*ast.Value{initial, sum},
+	}, e)
+}
+
+func (e executeEnvironment) QueryTransactions(query *ast.Value) ([]*ast.Value, error) {
+	queryIndex := e.valueContext.QueryIndex(query)
+	if queryIndex == -1 {
+		return nil, fmt.Errorf("Invalid query transactions argument!")
+	}
+	paramValues := make(map[int]*ast.Value)
+	for i, value := range e.params.GetParams() {
+		paramValues[i] = value
+	}
+	indexKey, err := e.valueContext.IndexKey(queryIndex, paramValues)
+	if err != nil {
+		return nil, err
+	}
+	// Records are sorted, only transactions at the requested block are read
+	var below []byte
+	if blockNumber, ok := e.params.GetAt().(*GenericParams_BlockNumber); ok {
+		if blockNumber.BlockNumber < e.valueContext.Confirmations {
+			return []*ast.Value{}, nil
+		}
+		below = indexer.TransactionRecord{
+			BlockNumber: blockNumber.BlockNumber - e.valueContext.Confirmations + 1,
+		}.Serialize()
+	}
+	paging := make([]uint64, 0, 2)
+	for _, child := range query.GetChildren()[1:] {
+		value, err := executor.Execute(child, e)
+		if err != nil {
+			return nil, err
+		}
+		if value.GetT() != ast.Value_UINT64 {
+			return nil, fmt.Errorf("Invalid pagination value type: %s", value.GetT().String())
+		}
+		paging = append(paging, value.GetU())
+	}
+	start := uint64(0)
+	if len(paging) > 0 {
+		start = paging[0]
+	}
+	count := math.MaxInt32
+	if len(paging) > 1 && paging[1] < uint64(count) {
+		count = int(paging[1])
+	}
+	slices, err := e.s.store.RangeSorted(indexKey, below, start, count)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]indexer.TransactionRecord, len(slices))
+	for i, slice := range slices {
+		records[i], err = indexer.ParseTransactionRecord(slice)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(records) == 0 {
+		return []*ast.Value{}, nil
+	}
+	return e.s.getTransactions(records)
+}
+
+// fetchTransactions loads committed transactions from CKB, together with
+// headers of their blocks mapped by block hash.
+func (s *Server) fetchTransactions(txHashes []rpctypes.Hash) (map[rpctypes.Hash]*rpctypes.TransactionWithStatusView, map[rpctypes.Hash]*rpctypes.Header, error) {
+	transactionWithStatusViews, err := s.rpcClient.GetAllTransactions(txHashes, 50)
+	if err != nil {
+		return nil, nil, err
+	}
+	transactions := rpc.CommittedTransactions(transactionWithStatusViews)
+	blockHashSet := make(map[rpctypes.Hash]bool)
+	for _, txWithStatus := range transactions {
+		blockHashSet[*txWithStatus.TxStatus.BlockHash] = true
+	}
+	var blockHashes []rpctypes.Hash
+	for key := range blockHashSet {
+		blockHashes = append(blockHashes, key)
+	}
+	headerViews, err := s.rpcClient.GetAllHeaders(blockHashes, 50)
+	if err != nil {
+		return nil, nil, err
+	}
+	headers := make(map[rpctypes.Hash]*rpctypes.Header)
+	for _, header := range headerViews {
+		if header != nil {
+			headers[header.Hash] = &header.Header
+		}
+	}
+	return transactions, headers, nil
+}
+
+// getTransactions fetches transactions with headers of their blocks
+// attached, in the order of records.
+func (s *Server) getTransactions(records []indexer.TransactionRecord) ([]*ast.Value, error) {
+	txHashes := make([]rpctypes.Hash, len(records))
+	for i, record := range records {
+		txHashes[i] = record.TxHash
+	}
+	transactions, headers, err := s.fetchTransactions(txHashes)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*ast.Value, len(records))
+	for i, record := range records {
+		txWithStatus, found := transactions[record.TxHash]
+		if !found {
+			return nil, fmt.Errorf("Transaction %x cannot be found!", record.TxHash)
+		}
+		header, found := headers[*txWithStatus.TxStatus.BlockHash]
+		if !found {
+			return nil, fmt.Errorf("Header %x cannot be found!", *txWithStatus.TxStatus.BlockHash)
+		}
+		tx := ast.ConvertTransaction(txWithStatus.Transaction)
+		tx.Children = append(tx.Children, ast.ConvertHeader(*header))
+		results[i] = tx
+	}
+	return results, nil
+}
+
+func (s *Server) Call(ctx context.Context, p *GenericParams) (*CallResult, error) {
+	s.mutex.RLock()
 	callInfo, found := s.calls[p.GetName()]
+	s.mutex.RUnlock()
 	if !found {
 		return nil, fmt.Errorf("Calling non-exist function: %s", p.GetName())
 	}
+	for queryIndex := range callInfo.context.Queries {
+		synced, err := s.store.Get(callInfo.context.SyncedKey(queryIndex))
+		if err != nil {
+			return nil, err
+		}
+		if synced == nil {
+			return nil, fmt.Errorf("Function %s is not available till indexing of its queries is done!", p.GetName())
+		}
+	}
 	environment := executeEnvironment{
 		params:       p,
 		valueContext: callInfo.context,
 		s:            s,
 	}
-	return executor.Execute(callInfo.expr, environment)
+	// Indexer changes SEQUENCE with every block indexed or reverted, the call
+	// is retried if that happens while it is running.
+	for attempt := 0; attempt < maxCallAttempts; attempt++ {
+		sequence, err := s.store.Get("SEQUENCE")
+		if err != nil {
+			return nil, err
+		}
+		result, err := s.evaluatedBlock(p, callInfo.context.Confirmations)
+		if err != nil {
+			return nil, err
+		}
+		result.Value, err = executor.Execute(callInfo.expr, environment)
+		if err != nil {
+			return nil, err
+		}
+		currentSequence, err := s.store.Get("SEQUENCE")
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(sequence, currentSequence) {
+			return result, nil
+		}
+	}
+	return nil, fmt.Errorf("Indexed blocks keep changing while calling %s, please retry!", p.GetName())
 }
 
-func (s *Server) Stream(p *GenericParams, streamServer GenericService_StreamServer) error {
-	var selectedStream *ast.Stream
-	for _, aStream := range s.streams {
-		if p.GetName() == aStream.GetName() {
-			selectedStream = aStream
-			break
+// evaluatedBlock returns the block a call is evaluated at. Calls requiring
+// confirmations observe the state as of confirmations blocks earlier, but
+// never before the first indexed block.
+func (s *Server) evaluatedBlock(p *GenericParams, confirmations uint64) (*CallResult, error) {
+	lastBlock, err := s.store.Get("LAST_BLOCK")
+	if err != nil {
+		return nil, err
+	}
+	if lastBlock == nil {
+		return nil, fmt.Errorf("No block is indexed yet!")
+	}
+	blockNumber := binary.LittleEndian.Uint64(lastBlock)
+	if at, ok := p.GetAt().(*GenericParams_BlockNumber); ok {
+		err = s.checkIndexed(at.BlockNumber)
+		if err != nil {
+			return nil, err
+		}
+		blockNumber = at.BlockNumber
+	}
+	firstBlock, err := s.firstIndexedBlock()
+	if err != nil {
+		return nil, err
+	}
+	if blockNumber >= firstBlock+confirmations {
+		blockNumber -= confirmations
+	} else {
+		blockNumber = firstBlock
+	}
+	if blockNumber == binary.LittleEndian.Uint64(lastBlock) {
+		return &CallResult{
+			BlockNumber: blockNumber,
+			BlockHash:   lastBlock[8:],
+		}, nil
+	}
+	blockHash, err := s.store.Get(fmt.Sprintf("BLOCK:%d:HASH", blockNumber))
+	if err != nil {
+		return nil, err
+	}
+	return &CallResult{
+		BlockNumber: blockNumber,
+		BlockHash:   blockHash,
+	}, nil
+}
+
+// checkIndexed ensures the state at blockNumber is fully indexed.
+func (s *Server) checkIndexed(blockNumber uint64) error {
+	lastBlock, err := s.store.Get("LAST_BLOCK")
+	if err != nil {
+		return err
+	}
+	if lastBlock == nil || binary.LittleEndian.Uint64(lastBlock) < blockNumber {
+		return fmt.Errorf("Block %d is not indexed yet!", blockNumber)
+	}
+	firstBlock, err := s.firstIndexedBlock()
+	if err != nil {
+		return err
+	}
+	if blockNumber < firstBlock {
+		return fmt.Errorf("Block %d is before the first indexed block %d!", blockNumber, firstBlock)
+	}
+	return nil
+}
+
+// firstIndexedBlock returns the earliest block whose state is indexed.
+func (s *Server) firstIndexedBlock() (uint64, error) {
+	firstBlock := uint64(0)
+	startBlock, err := s.store.Get("START_BLOCK")
+	if err != nil {
+		return 0, err
+	}
+	if startBlock != nil {
+		firstBlock = binary.LittleEndian.Uint64(startBlock)
+	}
+	// State of the checkpoint block itself is seeded from the checkpoint
+	checkpointBlock, err := s.store.Get("CHECKPOINT_BLOCK")
+	if err != nil {
+		return 0, err
+	}
+	if checkpointBlock != nil {
+		firstBlock = binary.LittleEndian.Uint64(checkpointBlock)
+	}
+	return firstBlock, nil
+}
+
+func (s *Server) Status(ctx context.Context, p *StatusParams) (*IndexerStatus, error) {
+	s.mutex.RLock()
+	calls := s.calls
+	astHash := s.astHash
+	s.mutex.RUnlock()
+
+	status := &IndexerStatus{
+		AstHash: astHash,
+	}
+	lastBlock, err := s.store.Get("LAST_BLOCK")
+	if err != nil {
+		return nil, err
+	}
+	if lastBlock != nil {
+		status.BlockNumber = binary.LittleEndian.Uint64(lastBlock)
+		status.BlockHash = lastBlock[8:]
+	}
+	// Indexed state is still reported when CKB is unreachable or has no
+	// tip, only the tip and the lag are left unset.
+	tipBlockNumber, err := s.rpcClient.GetTipBlockNumber()
+	if err != nil {
+		log.Printf("Failed to fetch tip block number: %v", err)
+	} else if tipBlockNumber != nil {
+		status.TipBlockNumber = uint64(*tipBlockNumber)
+		if status.TipBlockNumber > status.BlockNumber {
+			status.Lag = status.TipBlockNumber - status.BlockNumber
 		}
 	}
-	if selectedStream == nil {
+	reorg, err := s.store.Get("REORG")
+	if err != nil {
+		return nil, err
+	}
+	status.Reorganizing = reorg != nil
+
+	names := make([]string, 0, len(calls))
+	for name := range calls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	queries := make(map[string]*QueryStatus)
+	for _, name := range names {
+		valueContext := calls[name].context
+		for queryIndex, hash := range valueContext.QueryHashes {
+			if queryStatus, found := queries[string(hash)]; found {
+				queryStatus.Calls = append(queryStatus.Calls, name)
+				continue
+			}
+			queryStatus, err := s.queryStatus(valueContext, queryIndex)
+			if err != nil {
+				return nil, err
+			}
+			queryStatus.Calls = []string{name}
+			queries[string(hash)] = queryStatus
+			status.Queries = append(status.Queries, queryStatus)
+		}
+	}
+	return status, nil
+}
+
+func (s *Server) queryStatus(valueContext indexer.ValueContext, queryIndex int) (*QueryStatus, error) {
+	synced, err := s.store.Get(valueContext.SyncedKey(queryIndex))
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := s.store.Get(valueContext.BackfillKey(queryIndex))
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.store.Get(valueContext.CellsKey(queryIndex))
+	if err != nil {
+		return nil, err
+	}
+	cells, err := indexer.ParseAggregate(data)
+	if err != nil {
+		return nil, err
+	}
+	queryStatus := &QueryStatus{
+		Hash:   valueContext.QueryHashes[queryIndex],
+		Synced: synced != nil,
+		Cells:  uint64(cells.Count),
+	}
+	if cursor != nil {
+		queryStatus.BackfilledBlock = binary.LittleEndian.Uint64(cursor)
+	}
+	return queryStatus, nil
+}
+
+func (s *Server) Stream(p *GenericParams, streamServer GenericService_StreamServer) error {
+	s.mutex.RLock()
+	streamContext, found := s.streams[p.GetName()]
+	s.mutex.RUnlock()
+	if !found {
 		return fmt.Errorf("Calling non-exist stream: %s", p.GetName())
 	}
+	paramValues := make(map[int]*ast.Value)
+	for i, value := range p.GetParams() {
+		paramValues[i] = value
+	}
+	key, err := streamContext.Key(paramValues)
+	if err != nil {
+		return err
+	}
 
-	psc := redis.PubSubConn{Conn: s.redisPool.Get()}
-	defer psc.Close()
+	// Published values only act as notifications here, events are read from
+	// the persisted log so none of them can be missed. Subscribing before
+	// locating the start cursor ensures no notification gets lost either.
+	subscription, err := s.store.Subscribe(key)
+	if err != nil {
+		return err
+	}
+	defer subscription.Close()
+	// Closing the subscription unblocks Receive once the client goes away.
+	go func() {
+		<-streamServer.Context().Done()
+		subscription.Close()
+	}()
 
-	key := fmt.Sprintf("STREAM:%s", selectedStream.GetName())
-	err := psc.Subscribe(key)
+	eventsKey := fmt.Sprintf("%s:EVENTS", key)
+	var cursor uint64
+	switch start := p.GetStart().(type) {
+	case *GenericParams_Cursor:
+		cursor = start.Cursor
+	case *GenericParams_FromBlock:
+		cursor, err = s.blockCursor(eventsKey, start.FromBlock)
+	default:
+		cursor, err = s.store.Length(eventsKey)
+	}
 	if err != nil {
 		return err
 	}
+
 	for {
-		switch v := psc.Receive().(type) {
-		case redis.Message:
-			if v.Channel == key {
-				value := &ast.Value{}
-				err = proto.Unmarshal(v.Data, value)
-				if err != nil {
-					break
-				}
-				err = streamServer.Send(value)
-				if err == io.EOF {
-					return psc.Unsubscribe()
-				}
-				if err != nil {
-					break
-				}
+		events, err := s.store.Range(eventsKey, cursor, streamBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, data := range events {
+			cursor++
+			event, err := convertEvent(data, cursor)
+			if err != nil {
+				return err
+			}
+			err = streamServer.Send(event)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if len(events) == streamBatchSize {
+			continue
+		}
+		_, err = subscription.Receive()
+		if err != nil {
+			if streamServer.Context().Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func convertEvent(data []byte, cursor uint64) (*StreamEvent, error) {
+	var event indexer.Event
+	err := json.Unmarshal(data, &event)
+	if err != nil {
+		return nil, err
+	}
+	value := &ast.Value{}
+	err = proto.Unmarshal(event.Value, value)
+	if err != nil {
+		return nil, err
+	}
+	kind := StreamEvent_INDEX
+	if event.Revert {
+		kind = StreamEvent_REVERT
+	}
+	return &StreamEvent{
+		BlockNumber: event.BlockNumber,
+		BlockHash:   event.BlockHash,
+		TxHash:      event.TxHash,
+		CellIndex:   event.CellIndex,
+		Kind:        kind,
+		Cursor:      cursor,
+		Value:       value,
+	}, nil
+}
+
+// blockCursor locates where events of a block start in the stream log, by
+// walking back from the end of the log until an event of an earlier block
+// is found. Events of reverted blocks following that point are included,
+// so clients see a consistent history including the reverts.
+func (s *Server) blockCursor(eventsKey string, blockNumber uint64) (uint64, error) {
+	cursor, err := s.store.Length(eventsKey)
+	if err != nil {
+		return 0, err
+	}
+	for cursor > 0 {
+		start := uint64(0)
+		if cursor > streamBatchSize {
+			start = cursor - streamBatchSize
+		}
+		events, err := s.store.Range(eventsKey, start, int(cursor-start))
+		if err != nil {
+			return 0, err
+		}
+		for i := len(events) - 1; i >= 0; i-- {
+			var event indexer.Event
+			err = json.Unmarshal(events[i], &event)
+			if err != nil {
+				return 0, err
+			}
+			if event.BlockNumber < blockNumber {
+				return cursor, nil
 			}
-		case error:
-			return v
+			cursor--
 		}
 	}
-	psc.Unsubscribe()
-	return err
+	return 0, nil
 }
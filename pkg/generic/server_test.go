@@ -0,0 +1,1049 @@
+package generic
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gomodule/redigo/redis"
+	"github.com/xxuejie/animagus/pkg/ast"
+	"github.com/xxuejie/animagus/pkg/coretypes"
+	"github.com/xxuejie/animagus/pkg/fakenode"
+	"github.com/xxuejie/animagus/pkg/indexer"
+	"github.com/xxuejie/animagus/pkg/rpctypes"
+	"github.com/xxuejie/animagus/pkg/store"
+	"google.golang.org/grpc"
+)
+
+func fetchField(field ast.Value_Type, value *ast.Value) *ast.Value {
+	return &ast.Value{
+		T:        field,
+		Children: []*ast.Value{value},
+	}
+}
+
+func arg(i uint64) *ast.Value {
+	return &ast.Value{
+		T: ast.Value_ARG,
+		Primitive: &ast.Value_U{
+			U: i,
+		},
+	}
+}
+
+func param(i uint64) *ast.Value {
+	return &ast.Value{
+		T: ast.Value_PARAM,
+		Primitive: &ast.Value_U{
+			U: i,
+		},
+	}
+}
+
+func uintValue(u uint64) *ast.Value {
+	return &ast.Value{
+		T: ast.Value_UINT64,
+		Primitive: &ast.Value_U{
+			U: u,
+		},
+	}
+}
+
+func bytesValue(b []byte) *ast.Value {
+	return &ast.Value{
+		T: ast.Value_BYTES,
+		Primitive: &ast.Value_Raw{
+			Raw: b,
+		},
+	}
+}
+
+// balanceRoot sums up capacities of all cells whose lock args equal param 0
+func balanceRoot() *ast.Root {
+	cells := &ast.Value{
+		T: ast.Value_QUERY_CELLS,
+		Children: []*ast.Value{
+			&ast.Value{
+				T: ast.Value_EQUAL,
+				Children: []*ast.Value{
+					fetchField(ast.Value_GET_ARGS, fetchField(ast.Value_GET_LOCK, arg(0))),
+					param(0),
+				},
+			},
+		},
+	}
+	capacities := &ast.Value{
+		T:        ast.Value_MAP,
+		Children: []*ast.Value{fetchField(ast.Value_GET_CAPACITY, arg(0)), cells},
+	}
+	return &ast.Root{
+		Calls: []*ast.Call{
+			&ast.Call{
+				Name: "balance",
+				Result: &ast.Value{
+					T: ast.Value_REDUCE,
+					Children: []*ast.Value{
+						&ast.Value{
+							T:        ast.Value_ADD,
+							Children: []*ast.Value{arg(0), arg(1)},
+						},
+						uintValue(0),
+						capacities,
+					},
+				},
+			},
+		},
+	}
+}
+
+func testCell(capacity uint64, lockArgs byte) rpctypes.CellOutput {
+	return rpctypes.CellOutput{
+		Capacity: rpctypes.Uint64(capacity),
+		Lock: rpctypes.Script{
+			HashType: rpctypes.Type,
+			Args:     rpctypes.Bytes{lockArgs},
+		},
+	}
+}
+
+func testTransaction(outputs ...rpctypes.CellOutput) rpctypes.Transaction {
+	tx := rpctypes.Transaction{}
+	for _, output := range outputs {
+		tx.Outputs = append(tx.Outputs, output)
+		tx.OutputsData = append(tx.OutputsData, rpctypes.Bytes{})
+	}
+	return tx
+}
+
+func indexChain(t *testing.T, astContent []byte, s store.Store, n *fakenode.Node, tip rpctypes.BlockView) {
+	indexFiles(t, []indexer.ASTFile{indexer.ASTFile{Content: astContent}}, s, n, tip)
+}
+
+func indexFiles(t *testing.T, files []indexer.ASTFile, s store.Store, n *fakenode.Node, tip rpctypes.BlockView) {
+	i, err := indexer.NewIndexer(files, s, n.URL(), indexer.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- i.Run()
+	}()
+	defer func() {
+		i.Stop()
+		if err := <-result; err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		lastBlock, err := s.Get("LAST_BLOCK")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lastBlock) == 40 && bytes.Equal(lastBlock[8:], tip.Header.Hash[:]) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timeout indexing block %d", tip.Header.Number)
+}
+
+func TestCallQueryCells(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	_, err := n.Mine(testTransaction(testCell(100, 1), testCell(200, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = n.Mine(testTransaction(testCell(300, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip, err := n.Mine()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	astContent, err := proto.Marshal(balanceRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.NewMemoryStore()
+	server, err := NewServer([]indexer.ASTFile{indexer.ASTFile{Content: astContent}}, s, n.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.Call(context.Background(), &GenericParams{
+		Name:   "balance",
+		Params: []*ast.Value{bytesValue([]byte{1})},
+	})
+	if err == nil {
+		t.Errorf("Calls should fail before their queries are indexed")
+	}
+
+	indexChain(t, astContent, s, n, tip)
+	for lockArgs, expected := range map[byte]uint64{1: 400, 2: 200, 3: 0} {
+		value, err := server.Call(context.Background(), &GenericParams{
+			Name:   "balance",
+			Params: []*ast.Value{bytesValue([]byte{lockArgs})},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value.GetValue().GetU() != expected {
+			t.Errorf("Invalid balance for lock args %x: %d, expected: %d", lockArgs, value.GetValue().GetU(), expected)
+		}
+		if value.GetBlockNumber() != 2 || !bytes.Equal(value.GetBlockHash(), tip.Header.Hash[:]) {
+			t.Errorf("Invalid evaluated block: %d %x", value.GetBlockNumber(), value.GetBlockHash())
+		}
+	}
+}
+
+func TestCallConfirmedBlock(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	block0, err := n.Mine(testTransaction(testCell(100, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block1, err := n.Mine(testTransaction(testCell(200, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip, err := n.Mine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := balanceRoot()
+	root.Calls[0].Confirmations = 1
+	astContent, err := proto.Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.NewMemoryStore()
+	indexChain(t, astContent, s, n, tip)
+	server, err := NewServer([]indexer.ASTFile{indexer.ASTFile{Content: astContent}}, s, n.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The call observes the state one block earlier, but never before the
+	// first indexed block
+	for _, c := range []struct {
+		at       *GenericParams_BlockNumber
+		expected uint64
+		block    rpctypes.BlockView
+	}{
+		{nil, 300, block1},
+		{&GenericParams_BlockNumber{BlockNumber: 1}, 100, block0},
+		{&GenericParams_BlockNumber{BlockNumber: 0}, 0, block0},
+	} {
+		params := &GenericParams{
+			Name:   "balance",
+			Params: []*ast.Value{bytesValue([]byte{1})},
+		}
+		if c.at != nil {
+			params.At = c.at
+		}
+		value, err := server.Call(context.Background(), params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value.GetValue().GetU() != c.expected {
+			t.Errorf("Invalid balance: %d, expected: %d", value.GetValue().GetU(), c.expected)
+		}
+		if value.GetBlockNumber() != uint64(c.block.Header.Number) || !bytes.Equal(value.GetBlockHash(), c.block.Header.Hash[:]) {
+			t.Errorf("Invalid evaluated block: %d %x, expected: %d", value.GetBlockNumber(), value.GetBlockHash(), c.block.Header.Number)
+		}
+	}
+}
+
+// changingStore emulates blocks being indexed while queries are read
+type changingStore struct {
+	store.Store
+	changes int
+}
+
+func (s *changingStore) change(key string) error {
+	if s.changes == 0 || !strings.Contains(key, ":PARAM:") {
+		return nil
+	}
+	s.changes--
+	return s.Execute([]store.Command{
+		store.Command{Name: store.CommandSet, Key: "SEQUENCE", Value: []byte{byte(s.changes)}},
+	})
+}
+
+func (s *changingStore) Get(key string) ([]byte, error) {
+	if err := s.change(key); err != nil {
+		return nil, err
+	}
+	return s.Store.Get(key)
+}
+
+func (s *changingStore) Members(key string) ([][]byte, error) {
+	if err := s.change(key); err != nil {
+		return nil, err
+	}
+	return s.Store.Members(key)
+}
+
+func TestConsistentCall(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	tip, err := n.Mine(testTransaction(testCell(100, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	astContent, err := proto.Marshal(balanceRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &changingStore{Store: store.NewMemoryStore()}
+	indexChain(t, astContent, s.Store, n, tip)
+	server, err := NewServer([]indexer.ASTFile{indexer.ASTFile{Content: astContent}}, s, n.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func() (*CallResult, error) {
+		return server.Call(context.Background(), &GenericParams{
+			Name:   "balance",
+			Params: []*ast.Value{bytesValue([]byte{1})},
+		})
+	}
+
+	s.changes = 2
+	value, err := call()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.GetValue().GetU() != 100 || s.changes != 0 {
+		t.Errorf("Call should be retried till the index stops changing")
+	}
+
+	s.changes = maxCallAttempts
+	_, err = call()
+	if err == nil {
+		t.Errorf("Call should fail when the index keeps changing")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	_, err := n.Mine(testTransaction(testCell(100, 1), testCell(200, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip, err := n.Mine(testTransaction(testCell(300, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	astContent, err := proto.Marshal(balanceRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []indexer.ASTFile{indexer.ASTFile{Content: astContent}}
+	s := store.NewMemoryStore()
+	indexChain(t, astContent, s, n, tip)
+	_, err = n.Mine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(files, s, n.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := server.Status(context.Background(), &StatusParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.GetBlockNumber() != 1 || !bytes.Equal(status.GetBlockHash(), tip.Header.Hash[:]) {
+		t.Errorf("Invalid indexed block: %d %x", status.GetBlockNumber(), status.GetBlockHash())
+	}
+	if status.GetTipBlockNumber() != 2 || status.GetLag() != 1 {
+		t.Errorf("Invalid tip: %d, lag: %d", status.GetTipBlockNumber(), status.GetLag())
+	}
+	if !bytes.Equal(status.GetAstHash(), indexer.ASTHash(files)) {
+		t.Errorf("Invalid AST hash: %x", status.GetAstHash())
+	}
+	if status.GetReorganizing() {
+		t.Errorf("Indexer should not be reorganizing")
+	}
+	// The balance is aggregated on top of the query cells, both count
+	// the same cells
+	if len(status.GetQueries()) != 2 {
+		t.Fatalf("Invalid number of queries: %d", len(status.GetQueries()))
+	}
+	for _, query := range status.GetQueries() {
+		if !query.GetSynced() || query.GetCells() != 3 || len(query.GetCalls()) != 1 || query.GetCalls()[0] != "balance" {
+			t.Errorf("Invalid query status: %v", query)
+		}
+	}
+
+	// Indexed state is reported without the tip when CKB has no tip, or
+	// cannot be reached
+	empty := fakenode.NewNode()
+	defer empty.Close()
+	unreachable := fakenode.NewNode()
+	unreachable.Close()
+	for _, url := range []string{empty.URL(), unreachable.URL()} {
+		server, err = NewServer(files, s, url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err = server.Status(context.Background(), &StatusParams{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.GetBlockNumber() != 1 || !bytes.Equal(status.GetBlockHash(), tip.Header.Hash[:]) {
+			t.Errorf("Invalid indexed block: %d %x", status.GetBlockNumber(), status.GetBlockHash())
+		}
+		if status.GetTipBlockNumber() != 0 || status.GetLag() != 0 {
+			t.Errorf("Tip should be unset: %d, lag: %d", status.GetTipBlockNumber(), status.GetLag())
+		}
+		if len(status.GetQueries()) != 2 || !status.GetQueries()[0].GetSynced() {
+			t.Errorf("Invalid query status: %v", status.GetQueries())
+		}
+	}
+}
+
+func TestHistoricalCall(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	block0, err := n.Mine(testTransaction(testCell(100, 1), testCell(200, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spend := testTransaction(testCell(60, 1))
+	spend.Inputs = []rpctypes.CellInput{
+		rpctypes.CellInput{
+			PreviousOutput: rpctypes.OutPoint{TxHash: block0.Transactions[0].Hash, Index: 0},
+		},
+	}
+	_, err = n.Mine(spend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip, err := n.Mine(testTransaction(testCell(300, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	astContent, err := proto.Marshal(balanceRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.NewMemoryStore()
+	indexChain(t, astContent, s, n, tip)
+	server, err := NewServer([]indexer.ASTFile{indexer.ASTFile{Content: astContent}}, s, n.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for blockNumber, expected := range map[uint64]uint64{0: 100, 1: 60, 2: 360} {
+		value, err := server.Call(context.Background(), &GenericParams{
+			Name:   "balance",
+			Params: []*ast.Value{bytesValue([]byte{1})},
+			At:     &GenericParams_BlockNumber{BlockNumber: blockNumber},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value.GetValue().GetU() != expected {
+			t.Errorf("Invalid balance at block %d: %d, expected: %d", blockNumber, value.GetValue().GetU(), expected)
+		}
+		if value.GetBlockNumber() != blockNumber || len(value.GetBlockHash()) != 32 {
+			t.Errorf("Invalid evaluated block: %d %x, expected: %d", value.GetBlockNumber(), value.GetBlockHash(), blockNumber)
+		}
+	}
+	_, err = server.Call(context.Background(), &GenericParams{
+		Name:   "balance",
+		Params: []*ast.Value{bytesValue([]byte{1})},
+		At:     &GenericParams_BlockNumber{BlockNumber: 3},
+	})
+	if err == nil {
+		t.Errorf("Calls at blocks not yet indexed should fail")
+	}
+
+	// Spent cells are fetched from CKB, unknown ones fail the call
+	_, err = server.getCells([]coretypes.OutPoint{coretypes.OutPoint(make([]byte, outPointSize))})
+	if err == nil || !strings.Contains(err.Error(), "cannot be found") {
+		t.Errorf("Loading unknown cells should fail, got: %v", err)
+	}
+}
+
+func TestCallWithoutNode(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	_, err := n.Mine(testTransaction(testCell(100, 1), testCell(200, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip, err := n.Mine(testTransaction(testCell(300, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells := balanceRoot().GetCalls()[0].GetResult().GetChildren()[2].GetChildren()[1]
+	astContent, err := proto.Marshal(&ast.Root{
+		Calls: []*ast.Call{
+			&ast.Call{
+				Name: "block_numbers",
+				Result: &ast.Value{
+					T: ast.Value_MAP,
+					Children: []*ast.Value{
+						fetchField(ast.Value_GET_NUMBER, fetchField(ast.Value_GET_HEADER, arg(0))),
+						cells,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.NewMemoryStore()
+	indexChain(t, astContent, s, n, tip)
+	server, err := NewServer([]indexer.ASTFile{indexer.ASTFile{Content: astContent}}, s, n.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Live cells are kept by the indexer, calls do not need CKB at all
+	n.Close()
+	value, err := server.Call(context.Background(), &GenericParams{
+		Name:   "block_numbers",
+		Params: []*ast.Value{bytesValue([]byte{1})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blockNumbers []uint64
+	for _, child := range value.GetValue().GetChildren() {
+		blockNumbers = append(blockNumbers, child.GetU())
+	}
+	sort.Slice(blockNumbers, func(i, j int) bool {
+		return blockNumbers[i] < blockNumbers[j]
+	})
+	if len(blockNumbers) != 2 || blockNumbers[0] != 0 || blockNumbers[1] != 1 {
+		t.Errorf("Invalid block numbers of cells: %v", blockNumbers)
+	}
+}
+
+func TestAggregateCall(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	tip, err := n.Mine(testTransaction(testCell(100, 1), testCell(200, 1), testCell(300, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	astContent, err := proto.Marshal(balanceRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.NewMemoryStore()
+	indexChain(t, astContent, s, n, tip)
+	server, err := NewServer([]indexer.ASTFile{indexer.ASTFile{Content: astContent}}, s, n.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func(lockArgs byte) uint64 {
+		value, err := server.Call(context.Background(), &GenericParams{
+			Name:   "balance",
+			Params: []*ast.Value{bytesValue([]byte{lockArgs})},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value.GetValue().GetU()
+	}
+
+	for lockArgs, expected := range map[byte]uint64{1: 300, 2: 300, 3: 0} {
+		if balance := call(lockArgs); balance != expected {
+			t.Errorf("Invalid balance of lock args %d: %d, expected: %d", lockArgs, balance, expected)
+		}
+	}
+
+	// Calls are served from the aggregate when it is usable, and fall back to
+	// evaluating the query cells otherwise
+	key, err := server.calls["balance"].context.IndexKey(0, map[int]*ast.Value{
+		0: bytesValue([]byte{1}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for aggregate, expected := range map[string]uint64{
+		`{"c":1,"b":0,"e":0,"s":42}`: 42,
+		`{"c":2,"b":0,"e":1,"s":42}`: 300,
+	} {
+		err = s.Execute([]store.Command{
+			store.Command{Name: store.CommandSet, Key: key, Value: []byte(aggregate)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance := call(1); balance != expected {
+			t.Errorf("Invalid balance with aggregate %s: %d, expected: %d", aggregate, balance, expected)
+		}
+	}
+}
+
+func TestQueryTransactions(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	block0, err := n.Mine(testTransaction(testCell(100, 1), testCell(200, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spend := testTransaction(testCell(60, 2))
+	spend.Inputs = []rpctypes.CellInput{
+		rpctypes.CellInput{
+			PreviousOutput: rpctypes.OutPoint{TxHash: block0.Transactions[0].Hash, Index: 0},
+		},
+	}
+	block1, err := n.Mine(spend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip, err := n.Mine(testTransaction(testCell(300, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Hashes of transactions touching cells whose lock args equal param 0,
+	// skipping param 1 transactions and returning at most param 2 of them
+	root := &ast.Root{
+		Calls: []*ast.Call{
+			&ast.Call{
+				Name: "history",
+				Result: &ast.Value{
+					T: ast.Value_MAP,
+					Children: []*ast.Value{
+						fetchField(ast.Value_HASH, arg(0)),
+						&ast.Value{
+							T: ast.Value_QUERY_TRANSACTIONS,
+							Children: []*ast.Value{
+								&ast.Value{
+									T: ast.Value_EQUAL,
+									Children: []*ast.Value{
+										fetchField(ast.Value_GET_ARGS, fetchField(ast.Value_GET_LOCK, arg(0))),
+										param(0),
+									},
+								},
+								param(1),
+								param(2),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	astContent, err := proto.Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.NewMemoryStore()
+	indexChain(t, astContent, s, n, tip)
+	server, err := NewServer([]indexer.ASTFile{indexer.ASTFile{Content: astContent}}, s, n.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history := func(lockArgs byte, skip uint64, limit uint64, at *GenericParams_BlockNumber, expected ...rpctypes.BlockView) {
+		p := &GenericParams{
+			Name:   "history",
+			Params: []*ast.Value{bytesValue([]byte{lockArgs}), uintValue(skip), uintValue(limit)},
+		}
+		if at != nil {
+			p.At = at
+		}
+		result, err := server.Call(context.Background(), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes := result.GetValue().GetChildren()
+		if len(hashes) != len(expected) {
+			t.Fatalf("Invalid number of transactions for lock args %x: %d, expected: %d", lockArgs, len(hashes), len(expected))
+		}
+		for i, block := range expected {
+			if !bytes.Equal(hashes[i].GetRaw(), block.Transactions[0].Hash[:]) {
+				t.Errorf("Invalid transaction %d for lock args %x: %x", i, lockArgs, hashes[i].GetRaw())
+			}
+		}
+	}
+	history(1, 0, 10, nil, block0, block1, tip)
+	history(2, 0, 10, nil, block0, block1)
+	history(1, 1, 1, nil, block1)
+	history(1, 3, 10, nil)
+	history(1, 0, 10, &GenericParams_BlockNumber{BlockNumber: 1}, block0, block1)
+	history(1, 1, 10, &GenericParams_BlockNumber{BlockNumber: 1}, block1)
+	history(1, 0, 10, &GenericParams_BlockNumber{BlockNumber: 0}, block0)
+	history(1, 1, 10, &GenericParams_BlockNumber{BlockNumber: 0})
+
+	// Transactions unknown to CKB fail the call
+	_, err = server.getTransactions([]indexer.TransactionRecord{
+		indexer.TransactionRecord{BlockNumber: 1, TxHash: rpctypes.Hash{9}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "cannot be found") {
+		t.Errorf("Loading unknown transactions should fail, got: %v", err)
+	}
+}
+
+func TestMultipleFiles(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	tip, err := n.Mine(testTransaction(testCell(100, 1), testCell(200, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	astContent, err := proto.Marshal(balanceRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.NewMemoryStore()
+	_, err = NewServer([]indexer.ASTFile{
+		indexer.ASTFile{Content: astContent},
+		indexer.ASTFile{Content: astContent},
+	}, s, n.URL())
+	if err == nil {
+		t.Errorf("Duplicate names should be rejected")
+	}
+
+	files := []indexer.ASTFile{
+		indexer.ASTFile{Namespace: "a", Content: astContent},
+		indexer.ASTFile{Namespace: "b", Content: astContent},
+	}
+	indexFiles(t, files, s, n, tip)
+	server, err := NewServer(files, s, n.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.balance", "b.balance"} {
+		value, err := server.Call(context.Background(), &GenericParams{
+			Name:   name,
+			Params: []*ast.Value{bytesValue([]byte{1})},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value.GetValue().GetU() != 100 {
+			t.Errorf("Invalid balance from %s: %d", name, value.GetValue().GetU())
+		}
+	}
+	_, err = server.Call(context.Background(), &GenericParams{
+		Name:   "balance",
+		Params: []*ast.Value{bytesValue([]byte{1})},
+	})
+	if err == nil {
+		t.Errorf("Names should be namespaced")
+	}
+}
+
+func TestReload(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	tip, err := n.Mine(testTransaction(testCell(100, 1), testCell(200, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	astContent, err := proto.Marshal(balanceRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.NewMemoryStore()
+	indexChain(t, astContent, s, n, tip)
+	server, err := NewServer([]indexer.ASTFile{indexer.ASTFile{Content: astContent}}, s, n.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func(name string) (*CallResult, error) {
+		return server.Call(context.Background(), &GenericParams{
+			Name:   name,
+			Params: []*ast.Value{bytesValue([]byte{1})},
+		})
+	}
+
+	invalidContent, err := proto.Marshal(&ast.Root{
+		Calls: []*ast.Call{
+			&ast.Call{
+				Name:   "invalid",
+				Result: &ast.Value{T: ast.Value_UINT64},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Reload([]indexer.ASTFile{indexer.ASTFile{Content: invalidContent}})
+	if err == nil {
+		t.Errorf("Invalid AST should be rejected")
+	}
+	value, err := call("balance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.GetValue().GetU() != 100 {
+		t.Errorf("Invalid balance: %d", value.GetValue().GetU())
+	}
+
+	// Queries are unchanged, so the renamed call is usable right away
+	root := balanceRoot()
+	root.Calls[0].Name = "total"
+	renamedContent, err := proto.Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Reload([]indexer.ASTFile{indexer.ASTFile{Content: renamedContent}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err = call("total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.GetValue().GetU() != 100 {
+		t.Errorf("Invalid balance: %d", value.GetValue().GetU())
+	}
+	_, err = call("balance")
+	if err == nil {
+		t.Errorf("Removed call should not be available")
+	}
+}
+
+type testStreamServer struct {
+	grpc.ServerStream
+	ctx    context.Context
+	events chan *StreamEvent
+}
+
+func (s *testStreamServer) Context() context.Context {
+	return s.ctx
+}
+
+func (s *testStreamServer) Send(event *StreamEvent) error {
+	s.events <- event
+	return nil
+}
+
+func streamCapacities(t *testing.T, server *Server, p *GenericParams, expected ...uint64) []*StreamEvent {
+	ctx, cancel := context.WithCancel(context.Background())
+	streamServer := &testStreamServer{
+		ctx:    ctx,
+		events: make(chan *StreamEvent, len(expected)+1),
+	}
+	var events []*StreamEvent
+	result := make(chan error, 1)
+	go func() {
+		result <- server.Stream(p, streamServer)
+	}()
+	for _, capacity := range expected {
+		select {
+		case event := <-streamServer.events:
+			if event.GetValue().GetU() != capacity {
+				t.Errorf("Invalid streamed capacity: %d, expected: %d", event.GetValue().GetU(), capacity)
+			}
+			events = append(events, event)
+		case err := <-result:
+			t.Fatalf("Stream stopped: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout waiting for capacity %d", capacity)
+		}
+	}
+	cancel()
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if len(streamServer.events) > 0 {
+		t.Errorf("Unexpected streamed event: %s", (<-streamServer.events).String())
+	}
+	return events
+}
+
+func TestStreamReplay(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	_, err := n.Mine(testTransaction(testCell(100, 1), testCell(200, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip, err := n.Mine(testTransaction(testCell(300, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := balanceRoot()
+	root.Streams = []*ast.Stream{
+		&ast.Stream{
+			Name:   "capacities",
+			Filter: fetchField(ast.Value_GET_CAPACITY, arg(0)),
+		},
+	}
+	astContent, err := proto.Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.NewMemoryStore()
+	indexChain(t, astContent, s, n, tip)
+
+	server, err := NewServer([]indexer.ASTFile{indexer.ASTFile{Content: astContent}}, s, n.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := streamCapacities(t, server, &GenericParams{
+		Name:  "capacities",
+		Start: &GenericParams_Cursor{Cursor: 0},
+	}, 100, 200, 300)
+	last := events[2]
+	if last.GetCursor() != 3 || last.GetBlockNumber() != 1 ||
+		!bytes.Equal(last.GetBlockHash(), tip.Header.Hash[:]) ||
+		!bytes.Equal(last.GetTxHash(), tip.Transactions[0].Hash[:]) ||
+		last.GetCellIndex() != 0 || last.GetKind() != StreamEvent_INDEX {
+		t.Errorf("Invalid stream event: %s", last.String())
+	}
+	if events[1].GetCellIndex() != 1 {
+		t.Errorf("Invalid cell index: %d, expected: 1", events[1].GetCellIndex())
+	}
+	streamCapacities(t, server, &GenericParams{
+		Name:  "capacities",
+		Start: &GenericParams_Cursor{Cursor: events[1].GetCursor()},
+	}, 300)
+	streamCapacities(t, server, &GenericParams{
+		Name:  "capacities",
+		Start: &GenericParams_FromBlock{FromBlock: 1},
+	}, 300)
+	streamCapacities(t, server, &GenericParams{
+		Name:  "capacities",
+		Start: &GenericParams_FromBlock{FromBlock: 5},
+	})
+}
+
+// TestStreamRedis cancels streams blocked on a Redis subscription, it needs
+// a Redis database at ANIMAGUS_TEST_REDIS_URL which is flushed.
+func TestStreamRedis(t *testing.T) {
+	url := os.Getenv("ANIMAGUS_TEST_REDIS_URL")
+	if url == "" {
+		t.Skip("ANIMAGUS_TEST_REDIS_URL is not set")
+	}
+	pool := &redis.Pool{
+		MaxIdle: 10,
+		Dial:    func() (redis.Conn, error) { return redis.DialURL(url) },
+	}
+	defer pool.Close()
+	conn := pool.Get()
+	_, err := conn.Do("FLUSHDB")
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := fakenode.NewNode()
+	defer n.Close()
+	tip, err := n.Mine(testTransaction(testCell(100, 1), testCell(200, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := balanceRoot()
+	root.Streams = []*ast.Stream{
+		&ast.Stream{
+			Name:   "capacities",
+			Filter: fetchField(ast.Value_GET_CAPACITY, arg(0)),
+		},
+	}
+	astContent, err := proto.Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.NewRedisStore(pool)
+	indexChain(t, astContent, s, n, tip)
+	server, err := NewServer([]indexer.ASTFile{indexer.ASTFile{Content: astContent}}, s, n.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j := 0; j < 10; j++ {
+		streamCapacities(t, server, &GenericParams{
+			Name:  "capacities",
+			Start: &GenericParams_Cursor{Cursor: 0},
+		}, 100, 200)
+	}
+	// Each subscription connection is returned to the pool exactly once
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.IdleCount() != pool.ActiveCount() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pool.IdleCount() != pool.ActiveCount() {
+		t.Errorf("Invalid pool state: %d idle connections, %d active ones", pool.IdleCount(), pool.ActiveCount())
+	}
+}
+
+func TestStreamParams(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	_, err := n.Mine(testTransaction(testCell(100, 1), testCell(200, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip, err := n.Mine(testTransaction(testCell(300, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Streams capacities of cells whose lock args equal param 0
+	root := balanceRoot()
+	root.Streams = []*ast.Stream{
+		&ast.Stream{
+			Name: "capacities",
+			Filter: &ast.Value{
+				T: ast.Value_COND,
+				Children: []*ast.Value{
+					&ast.Value{
+						T: ast.Value_EQUAL,
+						Children: []*ast.Value{
+							fetchField(ast.Value_GET_ARGS, fetchField(ast.Value_GET_LOCK, arg(0))),
+							param(0),
+						},
+					},
+					fetchField(ast.Value_GET_CAPACITY, arg(0)),
+					&ast.Value{T: ast.Value_NIL},
+				},
+			},
+		},
+	}
+	astContent, err := proto.Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.NewMemoryStore()
+	indexChain(t, astContent, s, n, tip)
+
+	server, err := NewServer([]indexer.ASTFile{indexer.ASTFile{Content: astContent}}, s, n.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamCapacities(t, server, &GenericParams{
+		Name:   "capacities",
+		Params: []*ast.Value{bytesValue([]byte{1})},
+		Start:  &GenericParams_Cursor{Cursor: 0},
+	}, 100, 300)
+	streamCapacities(t, server, &GenericParams{
+		Name:   "capacities",
+		Params: []*ast.Value{bytesValue([]byte{2})},
+		Start:  &GenericParams_FromBlock{FromBlock: 0},
+	}, 200)
+	streamCapacities(t, server, &GenericParams{
+		Name:   "capacities",
+		Params: []*ast.Value{bytesValue([]byte{1})},
+		Start:  &GenericParams_FromBlock{FromBlock: 1},
+	}, 300)
+	streamCapacities(t, server, &GenericParams{
+		Name:   "capacities",
+		Params: []*ast.Value{bytesValue([]byte{3})},
+		Start:  &GenericParams_Cursor{Cursor: 0},
+	})
+}
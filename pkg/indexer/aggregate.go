@@ -0,0 +1,230 @@
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/xxuejie/animagus/pkg/ast"
+	"github.com/xxuejie/animagus/pkg/executor"
+	"github.com/xxuejie/animagus/pkg/store"
+)
+
+// Aggregates are updated with deltas, which only get resolved to actual
+// values when executed, so they can be reverted and deferred the same way
+// as other commands.
+const commandAggregate = "AGGREGATE"
+
+// Aggregate is kept for REDUCE values adding up what a chain of MAP
+// functions extracts from cells of a query, see aggregatedQuery.
+type Aggregate struct {
+	Count int64 `json:"c"`
+	// Number of items evaluated to BYTES, the rest are UINT64
+	Bytes int64 `json:"b"`
+	// Number of items failing to evaluate to a number
+	Errors int64    `json:"e"`
+	Sum    *big.Int `json:"s"`
+}
+
+func ParseAggregate(data []byte) (Aggregate, error) {
+	aggregate := Aggregate{Sum: new(big.Int)}
+	if data == nil {
+		return aggregate, nil
+	}
+	err := json.Unmarshal(data, &aggregate)
+	if err != nil {
+		return Aggregate{}, err
+	}
+	if aggregate.Sum == nil {
+		aggregate.Sum = new(big.Int)
+	}
+	return aggregate, nil
+}
+
+func (a *Aggregate) add(delta Aggregate) {
+	a.Count += delta.Count
+	a.Bytes += delta.Bytes
+	a.Errors += delta.Errors
+	a.Sum.Add(a.Sum, delta.Sum)
+}
+
+// valid tells if the aggregate can result from adding up items, removing
+// items never added leaves it negative.
+func (a Aggregate) valid() bool {
+	if a.Count < 0 || a.Bytes < 0 || a.Errors < 0 || a.Sum.Sign() < 0 ||
+		a.Bytes > a.Count || a.Errors > a.Count {
+		return false
+	}
+	return a.Count > 0 || a.Sum.Sign() == 0
+}
+
+func (a Aggregate) negate() Aggregate {
+	return Aggregate{
+		Count:  -a.Count,
+		Bytes:  -a.Bytes,
+		Errors: -a.Errors,
+		Sum:    new(big.Int).Neg(a.Sum),
+	}
+}
+
+// aggregatedQuery recognizes REDUCE values in the form of
+// REDUCE(ADD(ARG 0, ARG 1), init, MAP(f_n, ... MAP(f_1, QUERY_CELLS))),
+// where init is a constant number and the functions only look at the cell.
+// Since ADD is associative, such values can be maintained incrementally as
+// cells enter and leave the query. It returns the QUERY_CELLS value and the
+// functions in order of application, or nil if the value cannot be
+// aggregated.
+func aggregatedQuery(reduce *ast.Value) (*ast.Value, []*ast.Value) {
+	if reduce.GetT() != ast.Value_REDUCE || len(reduce.GetChildren()) != 3 {
+		return nil, nil
+	}
+	f := reduce.GetChildren()[0]
+	if f.GetT() != ast.Value_ADD || len(f.GetChildren()) != 2 {
+		return nil, nil
+	}
+	a, b := f.GetChildren()[0], f.GetChildren()[1]
+	if a.GetT() != ast.Value_ARG || b.GetT() != ast.Value_ARG ||
+		!((a.GetU() == 0 && b.GetU() == 1) || (a.GetU() == 1 && b.GetU() == 0)) {
+		return nil, nil
+	}
+	initial := reduce.GetChildren()[1]
+	if initial.GetT() != ast.Value_UINT64 && initial.GetT() != ast.Value_BYTES {
+		return nil, nil
+	}
+	list := reduce.GetChildren()[2]
+	var funcs []*ast.Value
+	for list.GetT() == ast.Value_MAP && len(list.GetChildren()) == 2 {
+		if !isCellFunction(list.GetChildren()[0]) {
+			return nil, nil
+		}
+		funcs = append([]*ast.Value{list.GetChildren()[0]}, funcs...)
+		list = list.GetChildren()[1]
+	}
+	if len(funcs) == 0 || list.GetT() != ast.Value_QUERY_CELLS || len(list.GetChildren()) != 1 {
+		return nil, nil
+	}
+	return list, funcs
+}
+
+// isCellFunction tests if value only depends on the cell passed as its
+// argument, and evaluates the same in indexer and when called.
+func isCellFunction(value *ast.Value) bool {
+	switch value.GetT() {
+	case ast.Value_ARG:
+		return value.GetU() == 0
+	case ast.Value_PARAM, ast.Value_QUERY_CELLS, ast.Value_QUERY_TRANSACTIONS,
+		ast.Value_GET_HEADER, ast.Value_APPLY, ast.Value_REDUCE,
+		ast.Value_LIST, ast.Value_MAP, ast.Value_FILTER:
+		return false
+	}
+	for _, child := range value.GetChildren() {
+		if !isCellFunction(child) {
+			return false
+		}
+	}
+	return true
+}
+
+// aggregateCell evaluates functions of an aggregated query on cell, an
+// error in any of them is recorded instead of failing the block, so calls
+// can fall back to the full evaluation reporting it.
+func aggregateCell(funcs []*ast.Value, cell *ast.Value) Aggregate {
+	delta := Aggregate{Count: 1, Sum: new(big.Int)}
+	value := cell
+	for _, f := range funcs {
+		var err error
+		value, err = executor.Execute(f, &indexingEnvironment{
+			cell:          value,
+			indexedValues: make(map[int]*ast.Value),
+		})
+		if err != nil {
+			delta.Errors = 1
+			return delta
+		}
+	}
+	switch value.GetT() {
+	case ast.Value_UINT64:
+		delta.Sum.SetUint64(value.GetU())
+	case ast.Value_BYTES:
+		delta.Bytes = 1
+		sum, err := executor.ValueToBigInt(value)
+		if err != nil {
+			delta.Errors = 1
+			return delta
+		}
+		delta.Sum = sum
+	default:
+		delta.Errors = 1
+	}
+	return delta
+}
+
+// countCell updates the number of cells in all indexes of a query, kept at
+// CellsKey as an aggregate counting cells only.
+func countCell(valueContext ValueContext, queryIndex int, insert bool, commands *commandBuffer) {
+	delta := Aggregate{Count: 1, Sum: new(big.Int)}
+	if !insert {
+		delta = delta.negate()
+	}
+	commands.aggregate(valueContext.CellsKey(queryIndex), delta)
+}
+
+// aggregatingStore resolves AGGREGATE commands against current values in
+// the store before executing them.
+type aggregatingStore struct {
+	store.Store
+}
+
+func (s aggregatingStore) Execute(commands []store.Command) error {
+	aggregates := make(map[string]*Aggregate)
+	resolved := make([]store.Command, len(commands))
+	for i, command := range commands {
+		if command.Name != commandAggregate {
+			resolved[i] = command
+			continue
+		}
+		aggregate, found := aggregates[command.Key]
+		if !found {
+			data, err := s.Store.Get(command.Key)
+			if err != nil {
+				return err
+			}
+			current, err := ParseAggregate(data)
+			if err != nil {
+				return err
+			}
+			aggregate = &current
+			aggregates[command.Key] = aggregate
+		}
+		delta, err := ParseAggregate(command.Value)
+		if err != nil {
+			return err
+		}
+		aggregate.add(delta)
+		if aggregate.Count == 0 {
+			resolved[i] = store.Command{
+				Name: store.CommandDelete,
+				Key:  command.Key,
+			}
+			continue
+		}
+		data, err := json.Marshal(aggregate)
+		if err != nil {
+			return err
+		}
+		resolved[i] = store.Command{
+			Name:  store.CommandSet,
+			Key:   command.Key,
+			Value: data,
+		}
+	}
+	// Only the final values need to be valid, a batch might remove items
+	// before adding them back.
+	for key, aggregate := range aggregates {
+		if !aggregate.valid() {
+			return fmt.Errorf("Aggregate %s becomes invalid: %d items, %d bytes, %d errors, sum %s, the index is corrupted!",
+				key, aggregate.Count, aggregate.Bytes, aggregate.Errors, aggregate.Sum.String())
+		}
+	}
+	return s.Store.Execute(resolved)
+}
@@ -0,0 +1,463 @@
+package indexer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/xxuejie/animagus/pkg/ast"
+	"github.com/xxuejie/animagus/pkg/rpctypes"
+	"github.com/xxuejie/animagus/pkg/store"
+)
+
+// loadSyncedQueries checks which query indexes of values are complete, it
+// returns namespaces of those, and of the rest that are neither being
+// back-filled nor purged. Nothing is changed, so values can be checked
+// before being swapped in. It must be called with mutex held.
+func (i *Indexer) loadSyncedQueries(values []ValueContext) ([][]byte, [][]byte, error) {
+	var synced, pending [][]byte
+	seen := make(map[string]bool)
+	for _, valueContext := range values {
+		for _, hash := range valueContext.QueryHashes {
+			namespace := string(hash)
+			if _, found := i.backfilling[namespace]; found || i.synced[namespace] || i.dropping[namespace] || seen[namespace] {
+				continue
+			}
+			seen[namespace] = true
+			data, err := i.store.Get(syncedKey(hash))
+			if err != nil {
+				return nil, nil, err
+			}
+			if data != nil {
+				synced = append(synced, hash)
+			} else {
+				pending = append(pending, hash)
+			}
+		}
+	}
+	return synced, pending, nil
+}
+
+// usedQueries filters out namespaces dropped after reloading, so they are
+// not marked as back-filled while missing blocks. A namespace dropped and
+// added back is back-filled by a later run, which takes it over. It must be
+// called with mutex held.
+func (i *Indexer) usedQueries(hashes [][]byte, run uint64) [][]byte {
+	used := make(map[string]bool)
+	for _, valueContext := range i.values {
+		for _, hash := range valueContext.QueryHashes {
+			used[string(hash)] = true
+		}
+	}
+	var result [][]byte
+	for _, hash := range hashes {
+		owner, found := i.backfilling[string(hash)]
+		if !found || owner != run {
+			continue
+		}
+		if used[string(hash)] {
+			result = append(result, hash)
+		} else {
+			delete(i.backfilling, string(hash))
+		}
+	}
+	return result
+}
+
+// backfill builds indexes of queries added after indexing started, by
+// replaying blocks from the start block, or the checkpoint, up to the last
+// block indexed by Run. Queries whose back-filling is interrupted at
+// different blocks are processed separately.
+func (i *Indexer) backfill(hashes [][]byte, run uint64) error {
+	groups := make(map[string][][]byte)
+	for _, hash := range hashes {
+		cursor, err := i.store.Get(backfillKey(hash))
+		if err != nil {
+			return err
+		}
+		groups[string(cursor)] = append(groups[string(cursor)], hash)
+	}
+	cursors := make([]string, 0, len(groups))
+	for cursor := range groups {
+		cursors = append(cursors, cursor)
+	}
+	sort.Strings(cursors)
+	for _, cursor := range cursors {
+		done, err := i.backfillQueries(groups[cursor], run)
+		if err != nil || !done {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillQueries works like Run, except that all commands generated are
+// merged into the data Run keeps for each block. This way back-filled
+// queries are reverted and confirmed together with the rest, and can be
+// handed over to Run once they catch up.
+func (i *Indexer) backfillQueries(hashes [][]byte, run uint64) (bool, error) {
+	cursor, err := i.store.Get(backfillKey(hashes[0]))
+	if err != nil {
+		return false, err
+	}
+	if cursor == nil {
+		err = i.seedBackfill(hashes, run)
+		if err != nil {
+			return false, err
+		}
+	}
+	startBlock, err := i.loadStartBlock()
+	if err != nil {
+		return false, err
+	}
+
+	var pipeline []prefetchedBlock
+	var tip uint64
+	for {
+		select {
+		case <-i.stop:
+			return false, nil
+		default:
+		}
+
+		i.mutex.Lock()
+		hashes = i.usedQueries(hashes, run)
+		done := len(hashes) == 0
+		if !done {
+			done, err = i.finishBackfill(hashes, startBlock)
+		}
+		i.mutex.Unlock()
+		if err != nil || done {
+			return done, err
+		}
+
+		cursor, err := i.store.Get(backfillKey(hashes[0]))
+		if err != nil {
+			return false, err
+		}
+		blockToFetch := startBlock
+		if len(cursor) == 40 {
+			blockToFetch = binary.LittleEndian.Uint64(cursor) + 1
+		}
+		if len(pipeline) > 0 && pipeline[0].number != blockToFetch {
+			pipeline = nil
+		}
+		pipeline = i.fillPipeline(pipeline, blockToFetch, &tip)
+		result := <-pipeline[0].result
+		pipeline = pipeline[1:]
+		if result.err != nil {
+			return false, result.err
+		}
+		applied := false
+		if result.block != nil {
+			err = i.resolveInputs(result.block)
+			if err != nil {
+				return false, err
+			}
+			i.mutex.Lock()
+			applied, err = i.backfillBlock(*result.block, cursor, i.usedQueries(hashes, run))
+			i.mutex.Unlock()
+			if err != nil {
+				return false, err
+			}
+		}
+		if !applied {
+			// Either a reorg is happening, or the block is not indexed yet
+			pipeline = nil
+			select {
+			case <-i.stop:
+				return false, nil
+			case <-time.After(i.pollInterval):
+			}
+		}
+	}
+}
+
+// seedBackfill indexes cells in the checkpoint for new queries when
+// indexing started from a checkpoint.
+func (i *Indexer) seedBackfill(hashes [][]byte, run uint64) error {
+	checkpointBlockData, err := i.store.Get("CHECKPOINT_BLOCK")
+	if err != nil {
+		return err
+	}
+	if checkpointBlockData == nil {
+		return nil
+	}
+	checkpoint := i.options.Checkpoint
+	if checkpoint == nil || !bytes.Equal(checkpointBlock(*checkpoint), checkpointBlockData) {
+		return fmt.Errorf("Checkpoint at block %d used to start indexing is required to back-fill new queries!",
+			binary.LittleEndian.Uint64(checkpointBlockData))
+	}
+	headers := make(map[rpctypes.Hash]*rpctypes.Header)
+	for _, cell := range checkpoint.Cells {
+		headers[cell.BlockHash] = nil
+	}
+	err = i.loadHeaders(headers)
+	if err != nil {
+		return err
+	}
+	// Queries might be dropped, or taken over by a later run, in the
+	// meantime.
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	namespaces := make(map[string]bool)
+	for _, hash := range i.usedQueries(hashes, run) {
+		namespaces[string(hash)] = true
+	}
+	if len(namespaces) == 0 {
+		return nil
+	}
+	commands := &commandBuffer{}
+	err = i.indexCheckpoint(*checkpoint, headers, namespaces, commands)
+	if err != nil {
+		return err
+	}
+	for namespace := range namespaces {
+		commands.do(store.CommandSet, backfillKey([]byte(namespace)), checkpointBlockData)
+	}
+	flattened, err := flattenCommands(commands)
+	if err != nil {
+		return err
+	}
+	return i.store.Execute(flattened)
+}
+
+// finishBackfill hands queries over to Run once they catch up with the last
+// block indexed. It must be called with mutex held.
+func (i *Indexer) finishBackfill(hashes [][]byte, startBlock uint64) (bool, error) {
+	lastBlock, err := i.store.Get("LAST_BLOCK")
+	if err != nil {
+		return false, err
+	}
+	cursor, err := i.store.Get(backfillKey(hashes[0]))
+	if err != nil {
+		return false, err
+	}
+	done := bytes.Equal(cursor, lastBlock)
+	if cursor == nil && len(lastBlock) == 40 {
+		// Blocks are all reverted by Run
+		done = binary.LittleEndian.Uint64(lastBlock) < startBlock
+	}
+	if !done {
+		return false, nil
+	}
+	var commands []store.Command
+	for _, hash := range hashes {
+		commands = append(commands, store.Command{
+			Name:  store.CommandSet,
+			Key:   syncedKey(hash),
+			Value: []byte{1},
+		}, store.Command{
+			Name: store.CommandDelete,
+			Key:  backfillKey(hash),
+		})
+	}
+	err = i.store.Execute(commands)
+	if err != nil {
+		return false, err
+	}
+	for _, hash := range hashes {
+		i.synced[string(hash)] = true
+		delete(i.backfilling, string(hash))
+	}
+	log.Printf("Back-filled %d queries", len(hashes))
+	return true, nil
+}
+
+// backfillBlock indexes a block for queries being back-filled. It returns
+// false when the block is not the one indexed by Run at the same height.
+// It must be called with mutex held.
+func (i *Indexer) backfillBlock(block rpctypes.BlockView, cursor []byte, hashes [][]byte) (bool, error) {
+	if len(hashes) == 0 {
+		return false, nil
+	}
+	blockNumber := uint64(block.Header.Number)
+	namespaces := make(map[string]bool)
+	for _, hash := range hashes {
+		namespaces[string(hash)] = true
+	}
+	// Cursor might be reverted by Run in the meantime
+	currentCursor, err := i.store.Get(backfillKey(hashes[0]))
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(currentCursor, cursor) {
+		return false, nil
+	}
+	if len(cursor) == 40 && !bytes.Equal(cursor[8:], block.Header.ParentHash[:]) {
+		return false, nil
+	}
+	lastBlock, err := i.store.Get("LAST_BLOCK")
+	if err != nil {
+		return false, err
+	}
+	if len(lastBlock) != 40 || blockNumber > binary.LittleEndian.Uint64(lastBlock) {
+		return false, nil
+	}
+	lastBlockNumber := binary.LittleEndian.Uint64(lastBlock)
+	// Hashes of blocks deeper than max reorg depth are pruned, those blocks
+	// are considered final.
+	blockHash, err := i.store.Get(fmt.Sprintf("BLOCK:%d:HASH", blockNumber))
+	if err != nil {
+		return false, err
+	}
+	if blockHash != nil && !bytes.Equal(blockHash, block.Header.Hash[:]) {
+		return false, nil
+	}
+
+	commands := &commandBuffer{}
+	for txIndex, tx := range block.Transactions {
+		err = i.indexTransaction(tx, txIndex, &block.Header.Header, namespaces, commands)
+		if err != nil {
+			return false, err
+		}
+		for _, input := range tx.RawTransaction.Inputs {
+			previousOutput := input.PreviousOutput
+			if previousOutput.Cell == nil || previousOutput.CellData == nil ||
+				!i.cellIndexed(previousOutput.Header) {
+				continue
+			}
+			astCell := ast.ConvertCell(*previousOutput.Cell, *previousOutput.CellData,
+				previousOutput, previousOutput.Header)
+			err = i.indexCell(astCell, previousOutput, false, blockNumber, namespaces, commands)
+			if err != nil {
+				return false, err
+			}
+		}
+		for outputIndex, output := range tx.RawTransaction.Outputs {
+			outPoint := rpctypes.OutPoint{
+				TxHash: tx.Hash,
+				Index:  rpctypes.Uint32(outputIndex),
+			}
+			astCell := ast.ConvertCell(output,
+				rpctypes.Raw([]byte(tx.RawTransaction.OutputsData[outputIndex])),
+				outPoint, &block.Header.Header)
+			err = i.indexCell(astCell, outPoint, true, blockNumber, namespaces, commands)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	newCursor := make([]byte, 40)
+	binary.LittleEndian.PutUint64(newCursor, blockNumber)
+	copy(newCursor[8:], block.Header.Hash[:])
+	for _, hash := range hashes {
+		commands.do(store.CommandSet, backfillKey(hash), newCursor)
+		if cursor != nil {
+			commands.revertDo(store.CommandSet, backfillKey(hash), cursor)
+		} else {
+			commands.revertDo(store.CommandDelete, backfillKey(hash), nil)
+		}
+	}
+	err = i.mergeBlockCommands(blockNumber, lastBlockNumber, commands)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// mergeBlockCommands applies commands of an indexed block, as if they were
+// generated when Run indexed the block: revert commands are appended to
+// the revert journal of the block, deferred commands are either applied
+// with their revert commands kept in the same way applyConfirmedCommands
+// does, or merged into those still deferred.
+func (i *Indexer) mergeBlockCommands(blockNumber uint64, lastBlockNumber uint64, commands *commandBuffer) error {
+	if commands.err != nil {
+		return commands.err
+	}
+	revertKey := fmt.Sprintf("BLOCK:%d:REVERT_COMMANDS", blockNumber)
+	revertData, err := i.store.Get(revertKey)
+	if err != nil {
+		return err
+	}
+	// Revert journal is missing when the block is deeper than max reorg
+	// depth, nothing needs to be kept for reverting then.
+	revertible := revertData != nil
+
+	result := commands.commands
+	// Backfilled commands are applied after the ones already recorded, so
+	// their revert commands are replayed first.
+	revertCommands := commands.revertible().RevertCommands
+	for _, depth := range commands.deferredDepths() {
+		deferred := commands.deferred[depth]
+		if deferred.err != nil {
+			return deferred.err
+		}
+		if blockNumber+depth <= lastBlockNumber {
+			result = append(result, deferred.commands...)
+			if !revertible || (i.options.MaxReorgDepth > 0 && depth >= i.options.MaxReorgDepth) {
+				continue
+			}
+			confirmedKey := fmt.Sprintf("BLOCK:%d:CONFIRMED:%d", blockNumber, depth)
+			var confirmedCommands []store.Command
+			err = i.loadCommands(confirmedKey, &confirmedCommands)
+			if err != nil {
+				return err
+			}
+			data, err := encodeCommands(append(deferred.revertible().RevertCommands, confirmedCommands...))
+			if err != nil {
+				return err
+			}
+			result = append(result, store.Command{
+				Name:  store.CommandSet,
+				Key:   confirmedKey,
+				Value: data,
+			})
+			continue
+		}
+		deferredKey := fmt.Sprintf("BLOCK:%d:DEFERRED:%d", blockNumber, depth)
+		var deferredCommands revertibleCommands
+		err = i.loadCommands(deferredKey, &deferredCommands)
+		if err != nil {
+			return err
+		}
+		deferredCommands.Commands = append(deferredCommands.Commands, deferred.commands...)
+		deferredCommands.RevertCommands = append(deferred.revertible().RevertCommands, deferredCommands.RevertCommands...)
+		data, err := encodeCommands(deferredCommands)
+		if err != nil {
+			return err
+		}
+		result = append(result, store.Command{
+			Name:  store.CommandSet,
+			Key:   deferredKey,
+			Value: data,
+		})
+		revertCommands = append(revertCommands, store.Command{
+			Name: store.CommandDelete,
+			Key:  deferredKey,
+		})
+	}
+	if revertible {
+		var blockRevertCommands []store.Command
+		err = decodeCommands(revertData, &blockRevertCommands)
+		if err != nil {
+			return err
+		}
+		data, err := encodeCommands(append(revertCommands, blockRevertCommands...))
+		if err != nil {
+			return err
+		}
+		result = append(result, store.Command{
+			Name:  store.CommandSet,
+			Key:   revertKey,
+			Value: data,
+		})
+	}
+	return i.store.Execute(result)
+}
+
+// loadCommands decodes commands stored at key, leaving v untouched when key
+// does not exist.
+func (i *Indexer) loadCommands(key string, v interface{}) error {
+	data, err := i.store.Get(key)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return nil
+	}
+	return decodeCommands(data, v)
+}
@@ -0,0 +1,285 @@
+package indexer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/xxuejie/animagus/pkg/ast"
+	"github.com/xxuejie/animagus/pkg/rpctypes"
+	"github.com/xxuejie/animagus/pkg/store"
+)
+
+// Checkpoint is a snapshot of the live cell set taken at a block, it must be
+// obtained from a trusted source since it is not verified against CKB.
+type Checkpoint struct {
+	// Header of the block the snapshot is taken at
+	Header rpctypes.HeaderView `json:"header"`
+	Cells  []CheckpointCell    `json:"cells"`
+	// Headers of blocks creating the cells, those missing here are fetched
+	// from CKB.
+	Headers []rpctypes.HeaderView `json:"headers,omitempty"`
+}
+
+type CheckpointCell struct {
+	OutPoint rpctypes.OutPoint   `json:"out_point"`
+	Cell     rpctypes.CellOutput `json:"cell"`
+	Data     rpctypes.Raw        `json:"data"`
+	// Block creating the cell
+	BlockHash rpctypes.Hash `json:"block_hash"`
+}
+
+// initializeStart prepares an empty store for indexing, seeding it from the
+// checkpoint if there is one. It returns the first block to index when
+// LAST_BLOCK is absent.
+func (i *Indexer) initializeStart() (uint64, error) {
+	lastBlock, err := i.store.Get("LAST_BLOCK")
+	if err != nil {
+		return 0, err
+	}
+	if lastBlock != nil {
+		return i.loadStartBlock()
+	}
+	startBlock := i.options.StartBlock
+	var commands []store.Command
+	if i.options.Checkpoint != nil {
+		startBlock = uint64(i.options.Checkpoint.Header.Number) + 1
+		commands, err = i.seedCheckpoint(*i.options.Checkpoint)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		commands = i.syncAll()
+	}
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, startBlock)
+	commands = append(commands, store.Command{
+		Name:  store.CommandSet,
+		Key:   "START_BLOCK",
+		Value: data,
+	})
+	err = i.store.Execute(commands)
+	if err != nil {
+		return 0, err
+	}
+	if i.options.Checkpoint != nil {
+		log.Printf("Seeded %d cells from checkpoint at block %d",
+			len(i.options.Checkpoint.Cells), i.options.Checkpoint.Header.Number)
+	}
+	return startBlock, nil
+}
+
+// syncAll marks all queries complete, as they are in an empty store.
+func (i *Indexer) syncAll() []store.Command {
+	var commands []store.Command
+	for _, valueContext := range i.values {
+		for _, hash := range valueContext.QueryHashes {
+			i.synced[string(hash)] = true
+			commands = append(commands, store.Command{
+				Name:  store.CommandSet,
+				Key:   syncedKey(hash),
+				Value: []byte{1},
+			})
+		}
+	}
+	return commands
+}
+
+// loadStartBlock returns the first block indexed in current store, a missing
+// START_BLOCK means indexing started from block 0.
+func (i *Indexer) loadStartBlock() (uint64, error) {
+	data, err := i.store.Get("START_BLOCK")
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 8 {
+		return 0, nil
+	}
+	return binary.LittleEndian.Uint64(data), nil
+}
+
+// seedCheckpoint indexes all cells in the checkpoint as if the checkpoint
+// block is the last block indexed. Cells are indexed regardless of
+// confirmations, and no stream events are generated for them. Cells are
+// written in batches, with the checkpoint block and the number of cells
+// written kept at CHECKPOINT_SEEDING, so an interrupted seed resumes where
+// it stops. It returns commands finishing the seed, blocks up to the
+// checkpoint cannot be reverted afterwards.
+func (i *Indexer) seedCheckpoint(checkpoint Checkpoint) ([]store.Command, error) {
+	block := checkpointBlock(checkpoint)
+	progress, err := i.store.Get("CHECKPOINT_SEEDING")
+	if err != nil {
+		return nil, err
+	}
+	if progress != nil && (len(progress) != 48 || !bytes.Equal(progress[:40], block)) {
+		return nil, fmt.Errorf("Seeding of another checkpoint is interrupted, the same checkpoint is required to resume it!")
+	}
+
+	headers := make(map[rpctypes.Hash]*rpctypes.Header)
+	for _, cell := range checkpoint.Cells {
+		headers[cell.BlockHash] = nil
+	}
+	for k := range checkpoint.Headers {
+		headers[checkpoint.Headers[k].Hash] = &checkpoint.Headers[k].Header
+	}
+	headers[checkpoint.Header.Hash] = &checkpoint.Header.Header
+	err = i.loadHeaders(headers)
+	if err != nil {
+		return nil, err
+	}
+
+	seeded := 0
+	if progress == nil {
+		// Headers are written before any cell, writing them again when
+		// interrupted is harmless.
+		var commands []store.Command
+		for blockHash, header := range headers {
+			data, err := json.Marshal(header)
+			if err != nil {
+				return nil, err
+			}
+			commands = append(commands, store.Command{
+				Name:  store.CommandSet,
+				Key:   headerKey(blockHash),
+				Value: data,
+			})
+			if len(commands) >= i.seedBatchSize {
+				err = i.store.Execute(commands)
+				if err != nil {
+					return nil, err
+				}
+				commands = nil
+			}
+		}
+		progress = make([]byte, 48)
+		copy(progress, block)
+		commands = append(commands, i.syncAll()...)
+		commands = append(commands, store.Command{
+			Name:  store.CommandSet,
+			Key:   "CHECKPOINT_SEEDING",
+			Value: progress,
+		})
+		err = i.store.Execute(commands)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		seeded = int(binary.LittleEndian.Uint64(progress[40:]))
+		log.Printf("Resuming seeding from checkpoint at block %d after %d cells",
+			checkpoint.Header.Number, seeded)
+		// Only queries present when seeding started are seeded, the rest are
+		// back-filled afterwards.
+		for _, valueContext := range i.values {
+			for _, hash := range valueContext.QueryHashes {
+				data, err := i.store.Get(syncedKey(hash))
+				if err != nil {
+					return nil, err
+				}
+				if data != nil {
+					i.synced[string(hash)] = true
+				}
+			}
+		}
+	}
+
+	for seeded < len(checkpoint.Cells) {
+		end := seeded + i.seedBatchSize
+		if end > len(checkpoint.Cells) {
+			end = len(checkpoint.Cells)
+		}
+		batch := checkpoint
+		batch.Cells = checkpoint.Cells[seeded:end]
+		commands := &commandBuffer{}
+		for _, cell := range batch.Cells {
+			outPoint := rpctypes.OutPoint{
+				TxHash: cell.OutPoint.TxHash,
+				Index:  cell.OutPoint.Index,
+			}
+			data, err := json.Marshal(liveCell{
+				Cell:      cell.Cell,
+				Data:      cell.Data,
+				BlockHash: cell.BlockHash,
+			})
+			if err != nil {
+				return nil, err
+			}
+			commands.do(store.CommandSet, cellKey(outPoint), data)
+		}
+		err = i.indexCheckpoint(batch, headers, i.synced, commands)
+		if err != nil {
+			return nil, err
+		}
+		progress = make([]byte, 48)
+		copy(progress, block)
+		binary.LittleEndian.PutUint64(progress[40:], uint64(end))
+		commands.do(store.CommandSet, "CHECKPOINT_SEEDING", progress)
+		flattened, err := flattenCommands(commands)
+		if err != nil {
+			return nil, err
+		}
+		err = i.store.Execute(flattened)
+		if err != nil {
+			return nil, err
+		}
+		seeded = end
+	}
+	return []store.Command{
+		store.Command{
+			Name:  store.CommandSet,
+			Key:   "LAST_BLOCK",
+			Value: block,
+		},
+		store.Command{
+			Name:  store.CommandSet,
+			Key:   "CHECKPOINT_BLOCK",
+			Value: block,
+		},
+		store.Command{
+			Name: store.CommandDelete,
+			Key:  "CHECKPOINT_SEEDING",
+		},
+	}, nil
+}
+
+func checkpointBlock(checkpoint Checkpoint) []byte {
+	block := make([]byte, 40)
+	binary.LittleEndian.PutUint64(block, uint64(checkpoint.Header.Number))
+	copy(block[8:], checkpoint.Header.Hash[:])
+	return block
+}
+
+// indexCheckpoint indexes all cells in the checkpoint for queries whose
+// namespaces are included.
+func (i *Indexer) indexCheckpoint(checkpoint Checkpoint, headers map[rpctypes.Hash]*rpctypes.Header, namespaces map[string]bool, commands *commandBuffer) error {
+	for _, cell := range checkpoint.Cells {
+		outPoint := rpctypes.OutPoint{
+			TxHash: cell.OutPoint.TxHash,
+			Index:  cell.OutPoint.Index,
+		}
+		astCell := ast.ConvertCell(cell.Cell, cell.Data, outPoint, headers[cell.BlockHash])
+		err := i.indexCell(astCell, outPoint, true, uint64(checkpoint.Header.Number), namespaces, commands)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flattenCommands applies deferred commands right away, for blocks that can
+// no longer be reverted.
+func flattenCommands(commands *commandBuffer) ([]store.Command, error) {
+	if commands.err != nil {
+		return nil, commands.err
+	}
+	result := commands.commands
+	for _, depth := range commands.deferredDepths() {
+		deferred := commands.deferred[depth]
+		if deferred.err != nil {
+			return nil, deferred.err
+		}
+		result = append(result, deferred.commands...)
+	}
+	return result, nil
+}
@@ -0,0 +1,436 @@
+package indexer
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/xxuejie/animagus/pkg/store"
+)
+
+// Number of keys of a dropped query deleted at a time
+const dropBatchSize = 1000
+
+// dropUnused records queries and confirmation depths no longer used by
+// values and streams, their data is then removed in the background by
+// purgeDropped. Otherwise a query added back later would be considered
+// synced while missing the blocks indexed in between, and revert journals
+// would revert its data twice once it is back-filled again.
+//
+// Queries and depths in use are recorded in the QUERIES and
+// CONFIRMATION_DEPTHS sets, so those dropped while animagus is not running
+// are found as well. Dropped ones are moved to DROPPED_QUERIES and
+// DROPPED_DEPTHS, an interrupted removal is then finished next time, before
+// the same query can be used again. In-memory state is only changed once
+// the store is updated. It must be called with mutex held.
+func (i *Indexer) dropUnused(values []ValueContext, streams []StreamContext) error {
+	queries := make(map[string]bool)
+	for _, valueContext := range values {
+		for _, hash := range valueContext.QueryHashes {
+			queries[string(hash)] = true
+		}
+	}
+	depths := make(map[string]bool)
+	for _, depth := range confirmationDepthsOf(values, streams) {
+		depths[string(depthMember(depth))] = true
+	}
+
+	var commands []store.Command
+	droppedQueries := make(map[string]bool)
+	droppedDepths := make(map[string]bool)
+	for _, registry := range []struct {
+		key     string
+		dropped string
+		used    map[string]bool
+		result  map[string]bool
+	}{
+		{"QUERIES", "DROPPED_QUERIES", queries, droppedQueries},
+		{"CONFIRMATION_DEPTHS", "DROPPED_DEPTHS", depths, droppedDepths},
+	} {
+		members, err := i.store.Members(registry.key)
+		if err != nil {
+			return err
+		}
+		dropped, err := i.store.Members(registry.dropped)
+		if err != nil {
+			return err
+		}
+		for _, member := range dropped {
+			if registry.key == "CONFIRMATION_DEPTHS" && registry.used[string(member)] {
+				// Data of queries dropped at this depth is still purged
+				// by namespace, only data of the depth itself is kept.
+				commands = append(commands, store.Command{
+					Name:  store.CommandSetRemove,
+					Key:   registry.dropped,
+					Value: member,
+				})
+				continue
+			}
+			registry.result[string(member)] = true
+		}
+		registered := make(map[string]bool)
+		for _, member := range members {
+			registered[string(member)] = true
+			if registry.used[string(member)] {
+				continue
+			}
+			commands = append(commands, store.Command{
+				Name:  store.CommandSetRemove,
+				Key:   registry.key,
+				Value: member,
+			}, store.Command{
+				Name:  store.CommandSetAdd,
+				Key:   registry.dropped,
+				Value: member,
+			})
+			if registry.key == "QUERIES" {
+				commands = append(commands, store.Command{
+					Name: store.CommandDelete,
+					Key:  syncedKey(member),
+				})
+			}
+			registry.result[string(member)] = true
+		}
+		for member := range registry.used {
+			if !registered[member] {
+				commands = append(commands, store.Command{
+					Name:  store.CommandSetAdd,
+					Key:   registry.key,
+					Value: []byte(member),
+				})
+			}
+		}
+	}
+	dropping := make(map[uint64]bool)
+	for member := range droppedDepths {
+		if len(member) != 8 {
+			return fmt.Errorf("Invalid confirmation depth: %x", member)
+		}
+		dropping[binary.LittleEndian.Uint64([]byte(member))] = true
+	}
+	if len(commands) > 0 {
+		err := i.store.Execute(commands)
+		if err != nil {
+			return err
+		}
+	}
+
+	for namespace := range droppedQueries {
+		delete(i.synced, namespace)
+		delete(i.backfilling, namespace)
+	}
+	i.dropping = droppedQueries
+	i.droppingDepths = dropping
+	if len(i.dropping) > 0 || len(i.droppingDepths) > 0 {
+		select {
+		case i.purgeSignal <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// purgeDropped removes data of dropped queries and confirmation depths in
+// the background while Run indexes blocks, whenever dropUnused records
+// some. Errors are reported to Run.
+func (i *Indexer) purgeDropped() {
+	for {
+		select {
+		case <-i.stop:
+			return
+		case <-i.purgeSignal:
+		}
+		err := i.purge()
+		if err != nil {
+			select {
+			case i.errors <- err:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// purge removes commands of dropped queries from data kept for each block,
+// then all keys in their namespaces, in batches so indexing is not blocked
+// for long. Back-filling of dropped queries added back starts once they
+// are removed.
+func (i *Indexer) purge() error {
+	i.mutex.Lock()
+	var queries [][]byte
+	for namespace := range i.dropping {
+		queries = append(queries, []byte(namespace))
+	}
+	var depths []uint64
+	for depth := range i.droppingDepths {
+		depths = append(depths, depth)
+	}
+	lastBlock, err := i.store.Get("LAST_BLOCK")
+	i.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if len(queries) == 0 && len(depths) == 0 {
+		return nil
+	}
+
+	if len(lastBlock) == 40 {
+		lastBlockNumber := binary.LittleEndian.Uint64(lastBlock)
+		blockNumber := lastBlockNumber
+		for {
+			select {
+			case <-i.stop:
+				return nil
+			default:
+			}
+			i.mutex.Lock()
+			next, done, err := i.purgeBlocks(blockNumber, lastBlockNumber)
+			i.mutex.Unlock()
+			if err != nil {
+				return err
+			}
+			if done {
+				break
+			}
+			blockNumber = next
+		}
+	}
+
+	for _, hash := range queries {
+		prefix := fmt.Sprintf("QUERY:%x:", hash)
+		cursor := ""
+		for {
+			select {
+			case <-i.stop:
+				return nil
+			default:
+			}
+			keys, next, err := i.store.ScanKeys(prefix, cursor, dropBatchSize)
+			if err != nil {
+				return err
+			}
+			if len(keys) > 0 {
+				commands := make([]store.Command, len(keys))
+				for j, key := range keys {
+					commands[j] = store.Command{
+						Name: store.CommandDelete,
+						Key:  key,
+					}
+				}
+				err = i.store.Execute(commands)
+				if err != nil {
+					return err
+				}
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if len(i.purgeSignal) > 0 {
+		// Reloaded meanwhile, the next run purges everything dropped
+		// till then, including blocks visited before the reload.
+		return nil
+	}
+	var commands []store.Command
+	for _, hash := range queries {
+		commands = append(commands, store.Command{
+			Name:  store.CommandSetRemove,
+			Key:   "DROPPED_QUERIES",
+			Value: hash,
+		})
+	}
+	for _, depth := range depths {
+		// Depths used again are already removed by dropUnused
+		if i.droppingDepths[depth] {
+			commands = append(commands, store.Command{
+				Name:  store.CommandSetRemove,
+				Key:   "DROPPED_DEPTHS",
+				Value: depthMember(depth),
+			})
+		}
+	}
+	if len(commands) > 0 {
+		err = i.store.Execute(commands)
+		if err != nil {
+			return err
+		}
+	}
+	for _, hash := range queries {
+		delete(i.dropping, string(hash))
+	}
+	for _, depth := range depths {
+		delete(i.droppingDepths, depth)
+	}
+	log.Printf("Removed %d queries and %d confirmation depths no longer used", len(queries), len(depths))
+	synced, pending, err := i.loadSyncedQueries(i.values)
+	if err != nil {
+		return err
+	}
+	i.startBackfill(synced, pending)
+	return nil
+}
+
+// purgeBlocks removes commands of dropped queries from data kept for up to
+// purgeBatchSize blocks, starting from blockNumber downwards, and deletes
+// data of dropped confirmation depths. Revert journals are only kept for
+// blocks that can still be reverted, so blocks are visited till neither
+// revert journals nor deferred commands are found. It returns the next
+// block to visit, or whether all are done. It must be called with mutex
+// held.
+func (i *Indexer) purgeBlocks(blockNumber uint64, lastBlockNumber uint64) (uint64, bool, error) {
+	depthSet := make(map[uint64]bool)
+	for _, depth := range i.confirmationDepths() {
+		depthSet[depth] = true
+	}
+	for depth := range i.droppingDepths {
+		depthSet[depth] = true
+	}
+	depths := sortedDepths(depthSet)
+	maxDepth := uint64(0)
+	if len(depths) > 0 {
+		maxDepth = depths[len(depths)-1]
+	}
+	for n := 0; n < i.purgeBatchSize; n++ {
+		if blockNumber < i.startBlock {
+			return 0, true, nil
+		}
+		var commands []store.Command
+		revertKey := fmt.Sprintf("BLOCK:%d:REVERT_COMMANDS", blockNumber)
+		var revertCommands []store.Command
+		err := i.loadCommands(revertKey, &revertCommands)
+		if err != nil {
+			return 0, false, err
+		}
+		if revertCommands == nil && blockNumber+maxDepth <= lastBlockNumber {
+			return 0, true, nil
+		}
+		if filtered, changed := filterCommands(revertCommands, i.droppedCommand); changed {
+			command, err := encodeCommand(revertKey, filtered)
+			if err != nil {
+				return 0, false, err
+			}
+			commands = append(commands, command)
+		}
+		for _, depth := range depths {
+			deferredKey := fmt.Sprintf("BLOCK:%d:DEFERRED:%d", blockNumber, depth)
+			confirmedKey := fmt.Sprintf("BLOCK:%d:CONFIRMED:%d", blockNumber, depth)
+			if i.droppingDepths[depth] {
+				commands = append(commands, store.Command{
+					Name: store.CommandDelete,
+					Key:  deferredKey,
+				}, store.Command{
+					Name: store.CommandDelete,
+					Key:  confirmedKey,
+				})
+				continue
+			}
+			var deferred revertibleCommands
+			err = i.loadCommands(deferredKey, &deferred)
+			if err != nil {
+				return 0, false, err
+			}
+			filtered, changed := filterCommands(deferred.Commands, i.droppedCommand)
+			filteredRevert, revertChanged := filterCommands(deferred.RevertCommands, i.droppedCommand)
+			if changed || revertChanged {
+				command, err := encodeCommand(deferredKey, revertibleCommands{
+					Commands:       filtered,
+					RevertCommands: filteredRevert,
+				})
+				if err != nil {
+					return 0, false, err
+				}
+				commands = append(commands, command)
+			}
+			var confirmed []store.Command
+			err = i.loadCommands(confirmedKey, &confirmed)
+			if err != nil {
+				return 0, false, err
+			}
+			if filtered, changed := filterCommands(confirmed, i.droppedCommand); changed {
+				command, err := encodeCommand(confirmedKey, filtered)
+				if err != nil {
+					return 0, false, err
+				}
+				commands = append(commands, command)
+			}
+		}
+		if len(commands) > 0 {
+			err = i.store.Execute(commands)
+			if err != nil {
+				return 0, false, err
+			}
+		}
+		if blockNumber == 0 {
+			return 0, true, nil
+		}
+		blockNumber--
+	}
+	return blockNumber, false, nil
+}
+
+// liveCommands filters out commands of dropped queries not purged yet, so
+// their data is never replayed when reverting or confirming blocks. It
+// must be called with mutex held.
+func (i *Indexer) liveCommands(commands []store.Command) []store.Command {
+	if len(i.dropping) == 0 {
+		return commands
+	}
+	filtered, _ := filterCommands(commands, i.droppedCommand)
+	return filtered
+}
+
+// droppedCommand tells whether command writes to the namespace of a
+// dropped query.
+func (i *Indexer) droppedCommand(command store.Command) bool {
+	if !strings.HasPrefix(command.Key, "QUERY:") {
+		return false
+	}
+	rest := command.Key[len("QUERY:"):]
+	end := strings.IndexByte(rest, ':')
+	if end < 0 {
+		return false
+	}
+	hash, err := hex.DecodeString(rest[:end])
+	if err != nil {
+		return false
+	}
+	return i.dropping[string(hash)]
+}
+
+// filterCommands drops commands matched, it tells whether any is dropped.
+func filterCommands(commands []store.Command, matches func(store.Command) bool) ([]store.Command, bool) {
+	result := make([]store.Command, 0, len(commands))
+	for _, command := range commands {
+		if !matches(command) {
+			result = append(result, command)
+		}
+	}
+	return result, len(result) != len(commands)
+}
+
+func encodeCommand(key string, v interface{}) (store.Command, error) {
+	data, err := encodeCommands(v)
+	if err != nil {
+		return store.Command{}, err
+	}
+	return store.Command{
+		Name:  store.CommandSet,
+		Key:   key,
+		Value: data,
+	}, nil
+}
+
+// depthMember encodes a confirmation depth as a member of
+// CONFIRMATION_DEPTHS.
+func depthMember(depth uint64) []byte {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, depth)
+	return data
+}
@@ -2,10 +2,12 @@ package indexer
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"sort"
 
 	"github.com/golang/protobuf/proto"
+	blake2b "github.com/minio/blake2b-simd"
 	"github.com/xxuejie/animagus/pkg/ast"
 )
 
@@ -14,20 +16,63 @@ type ValueContext struct {
 	Value       *ast.Value
 	Queries     []*ast.Value
 	QueryParams [][]int
+	// Each query is indexed in its own namespace identified by the hash, so
+	// unchanged queries keep their indexes when the AST changes.
+	QueryHashes [][]byte
+	// Confirmations required before changes of a block are indexed
+	Confirmations uint64
 }
 
-func NewValueContext(name string, value *ast.Value) (ValueContext, error) {
+func NewValueContext(call *ast.Call) (ValueContext, error) {
 	context := ValueContext{
-		Name:    name,
-		Value:   value,
-		Queries: make([]*ast.Value, 0),
+		Name:          call.GetName(),
+		Value:         call.GetResult(),
+		Queries:       make([]*ast.Value, 0),
+		Confirmations: call.GetConfirmations(),
 	}
-	if err := visitValue(value, &context); err != nil {
+	if err := visitValue(call.GetResult(), &context); err != nil {
 		return ValueContext{}, err
 	}
+	for _, query := range context.Queries {
+		hash, err := queryHash(query, context.Confirmations)
+		if err != nil {
+			return ValueContext{}, err
+		}
+		context.QueryHashes = append(context.QueryHashes, hash)
+	}
 	return context, nil
 }
 
+// queryHash covers everything affecting the content of a query index.
+func queryHash(query *ast.Value, confirmations uint64) ([]byte, error) {
+	indexed := query
+	if query.GetT() == ast.Value_QUERY_TRANSACTIONS {
+		// Pagination of QUERY_TRANSACTIONS does not affect the index
+		indexed = &ast.Value{
+			T:        query.GetT(),
+			Children: query.GetChildren()[:1],
+		}
+	}
+	content, err := proto.Marshal(indexed)
+	if err != nil {
+		return nil, err
+	}
+	blake2bHash := blake2b.New256()
+	_, err = blake2bHash.Write(content)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Write(blake2bHash, binary.LittleEndian, confirmations)
+	if err != nil {
+		return nil, err
+	}
+	_, err = blake2bHash.Write([]byte(Version))
+	if err != nil {
+		return nil, err
+	}
+	return blake2bHash.Sum(nil), nil
+}
+
 func (c ValueContext) QueryIndex(query *ast.Value) int {
 	for i, q := range c.Queries {
 		if proto.Equal(query, q) {
@@ -38,13 +83,94 @@ func (c ValueContext) QueryIndex(query *ast.Value) int {
 }
 
 func (c ValueContext) IndexKey(queryIndex int, paramValues map[int]*ast.Value) (string, error) {
-	params := c.QueryParams[queryIndex]
+	paramKey, err := formatParams(c.QueryParams[queryIndex], paramValues)
+	if err != nil {
+		return "", err
+	}
+	suffix := "CELLS"
+	switch c.Queries[queryIndex].GetT() {
+	case ast.Value_QUERY_TRANSACTIONS:
+		suffix = "TRANSACTIONS"
+	case ast.Value_REDUCE:
+		suffix = "AGGREGATE"
+	}
+	return fmt.Sprintf("QUERY:%x:PARAM:%s:%s", c.QueryHashes[queryIndex], paramKey, suffix), nil
+}
+
+// HistoryKeys returns keys of the sets recording when cells are added to or
+// removed from the index at IndexKey. Members are serialized OutPoints
+// followed by little endian block numbers, cells in the index at block N are
+// those added but not removed at or before N.
+func (c ValueContext) HistoryKeys(queryIndex int, paramValues map[int]*ast.Value) (string, string, error) {
+	paramKey, err := formatParams(c.QueryParams[queryIndex], paramValues)
+	if err != nil {
+		return "", "", err
+	}
+	prefix := fmt.Sprintf("QUERY:%x:PARAM:%s", c.QueryHashes[queryIndex], paramKey)
+	return fmt.Sprintf("%s:CREATED", prefix), fmt.Sprintf("%s:CONSUMED", prefix), nil
+}
+
+// CellsKey keeps the number of cells in the query index regardless of
+// params, as an Aggregate whose Count is the number of cells.
+func (c ValueContext) CellsKey(queryIndex int) string {
+	return fmt.Sprintf("QUERY:%x:CELLS", c.QueryHashes[queryIndex])
+}
+
+// BackfillKey keeps the last block back-filled for the query.
+func (c ValueContext) BackfillKey(queryIndex int) string {
+	return backfillKey(c.QueryHashes[queryIndex])
+}
+
+// SyncedKey is set once the query index is complete, till then the query is
+// still being back-filled and cannot be used.
+func (c ValueContext) SyncedKey(queryIndex int) string {
+	return syncedKey(c.QueryHashes[queryIndex])
+}
+
+func syncedKey(hash []byte) string {
+	return fmt.Sprintf("QUERY:%x:SYNCED", hash)
+}
+
+// backfillKey keeps the last block back-filled for a query, in the same
+// format as LAST_BLOCK.
+func backfillKey(hash []byte) string {
+	return fmt.Sprintf("QUERY:%x:BACKFILL", hash)
+}
+
+// StreamContext partitions events of a stream by the params its filter
+// uses, so subscribers only get events matching their own params.
+type StreamContext struct {
+	Stream *ast.Stream
+	Params []int
+}
+
+func NewStreamContext(stream *ast.Stream) StreamContext {
+	return StreamContext{
+		Stream: stream,
+		Params: sortedParams(stream.GetFilter()),
+	}
+}
+
+// Key returns the channel events are published to, the persisted log of
+// the events lives at Key + ":EVENTS".
+func (c StreamContext) Key(paramValues map[int]*ast.Value) (string, error) {
+	if len(c.Params) == 0 {
+		return fmt.Sprintf("STREAM:%s", c.Stream.GetName()), nil
+	}
+	paramKey, err := formatParams(c.Params, paramValues)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("STREAM:%s:PARAM:%s", c.Stream.GetName(), paramKey), nil
+}
+
+func formatParams(params []int, paramValues map[int]*ast.Value) (string, error) {
 	var buffer bytes.Buffer
 	_, err := buffer.WriteString(fmt.Sprintf("%d", len(params)))
 	if err != nil {
 		return "", err
 	}
-	for i := range params {
+	for _, i := range params {
 		value, found := paramValues[i]
 		if !found {
 			return "", fmt.Errorf("Requested param index %d is not provided!", i)
@@ -63,26 +189,26 @@ func (c ValueContext) IndexKey(queryIndex int, paramValues map[int]*ast.Value) (
 			return "", err
 		}
 	}
-	paramKey := string(buffer.Bytes())
-	return fmt.Sprintf("CALL:%s:QUERY:%d:PARAM:%s:CELLS", c.Name, queryIndex, paramKey), nil
+	return string(buffer.Bytes()), nil
 }
 
 func visitValue(value *ast.Value, context *ValueContext) error {
-	if value.GetT() == ast.Value_QUERY_CELLS {
-		for _, q := range context.Queries {
-			if proto.Equal(q, value) {
-				return nil
-			}
+	// Aggregated REDUCE values are indexed as queries on their own, the
+	// QUERY_CELLS inside is still indexed for historical calls.
+	if query, _ := aggregatedQuery(value); query != nil && context.QueryIndex(value) == -1 {
+		context.Queries = append(context.Queries, value)
+		context.QueryParams = append(context.QueryParams, sortedParams(query.GetChildren()[0]))
+	}
+	if value.GetT() == ast.Value_QUERY_CELLS || value.GetT() == ast.Value_QUERY_TRANSACTIONS {
+		if context.QueryIndex(value) != -1 {
+			return nil
 		}
-		paramSet := make(map[int]bool)
-		gatherQueryParams(value, &paramSet)
-		params := make([]int, 0, len(paramSet))
-		for k := range paramSet {
-			params = append(params, k)
+		if len(value.GetChildren()) == 0 {
+			return fmt.Errorf("Query function is missing!")
 		}
-		sort.Ints(params)
 		context.Queries = append(context.Queries, value)
-		context.QueryParams = append(context.QueryParams, params)
+		// Params used in pagination are only provided when calling
+		context.QueryParams = append(context.QueryParams, sortedParams(value.GetChildren()[0]))
 		return nil
 	}
 	for _, child := range value.GetChildren() {
@@ -94,6 +220,17 @@ func visitValue(value *ast.Value, context *ValueContext) error {
 	return nil
 }
 
+func sortedParams(value *ast.Value) []int {
+	paramSet := make(map[int]bool)
+	gatherQueryParams(value, &paramSet)
+	params := make([]int, 0, len(paramSet))
+	for k := range paramSet {
+		params = append(params, k)
+	}
+	sort.Ints(params)
+	return params
+}
+
 func gatherQueryParams(value *ast.Value, paramSet *map[int]bool) {
 	if value.GetT() == ast.Value_PARAM {
 		(*paramSet)[int(value.GetU())] = true
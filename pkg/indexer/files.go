@@ -0,0 +1,96 @@
+package indexer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	blake2b "github.com/minio/blake2b-simd"
+	"github.com/xxuejie/animagus/pkg/ast"
+)
+
+// ASTFile is a serialized ast.Root, names of its calls and streams are
+// prefixed with Namespace and a dot, unless Namespace is empty.
+type ASTFile struct {
+	Namespace string
+	Content   []byte
+}
+
+// ReadASTDir loads all files in dir, each file is namespaced by its base
+// name without extension.
+func ReadASTDir(dir string) ([]ASTFile, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []ASTFile
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, ASTFile{
+			Namespace: strings.TrimSuffix(info.Name(), filepath.Ext(info.Name())),
+			Content:   content,
+		})
+	}
+	return files, nil
+}
+
+// ParseASTFiles returns calls and streams of all files, with namespaced
+// names.
+func ParseASTFiles(files []ASTFile) ([]*ast.Call, []*ast.Stream, error) {
+	var calls []*ast.Call
+	var streams []*ast.Stream
+	callNames := make(map[string]bool)
+	streamNames := make(map[string]bool)
+	for _, file := range files {
+		root := &ast.Root{}
+		err := proto.Unmarshal(file.Content, root)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, call := range root.GetCalls() {
+			call.Name = namespacedName(file.Namespace, call.GetName())
+			if callNames[call.GetName()] {
+				return nil, nil, fmt.Errorf("Duplicate call name: %s", call.GetName())
+			}
+			callNames[call.GetName()] = true
+			calls = append(calls, call)
+		}
+		for _, stream := range root.GetStreams() {
+			stream.Name = namespacedName(file.Namespace, stream.GetName())
+			if streamNames[stream.GetName()] {
+				return nil, nil, fmt.Errorf("Duplicate stream name: %s", stream.GetName())
+			}
+			streamNames[stream.GetName()] = true
+			streams = append(streams, stream)
+		}
+	}
+	return calls, streams, nil
+}
+
+// ASTHash identifies the content of all files, including their namespaces.
+func ASTHash(files []ASTFile) []byte {
+	blake2bHash := blake2b.New256()
+	for _, file := range files {
+		binary.Write(blake2bHash, binary.LittleEndian, uint64(len(file.Namespace)))
+		blake2bHash.Write([]byte(file.Namespace))
+		binary.Write(blake2bHash, binary.LittleEndian, uint64(len(file.Content)))
+		blake2bHash.Write(file.Content)
+	}
+	return blake2bHash.Sum(nil)
+}
+
+func namespacedName(namespace string, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return fmt.Sprintf("%s.%s", namespace, name)
+}
@@ -7,103 +7,260 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/golang/protobuf/proto"
-	"github.com/gomodule/redigo/redis"
-	blake2b "github.com/minio/blake2b-simd"
 	"github.com/xxuejie/animagus/pkg/ast"
 	"github.com/xxuejie/animagus/pkg/executor"
 	"github.com/xxuejie/animagus/pkg/rpc"
 	"github.com/xxuejie/animagus/pkg/rpctypes"
+	"github.com/xxuejie/animagus/pkg/store"
 	"github.com/xxuejie/animagus/pkg/verifier"
 )
 
-const Version string = "0.0.1"
+const Version string = "0.0.4"
+
+// StoreVersion is kept at STORE_VERSION, it changes whenever data kept in
+// the store is laid out differently, e.g. the order of revert journals.
+const StoreVersion uint64 = 1
+
+// Options tunes how the indexer runs, zero values keep the original
+// behavior.
+type Options struct {
+	// MaxReorgDepth is the deepest reorg the indexer can recover from, revert
+	// journals of blocks deeper than this are pruned. 0 keeps all of them.
+	MaxReorgDepth uint64
+	// StartBlock is the first block indexed when the store is empty, blocks
+	// before it are skipped.
+	StartBlock uint64
+	// Checkpoint, when set, seeds an empty store with the live cell set of a
+	// trusted snapshot, indexing then continues from the block following
+	// the snapshot. StartBlock is ignored in this case.
+	Checkpoint *Checkpoint
+	// PrefetchWindow is the number of blocks fetched concurrently ahead of
+	// the block being indexed. 0 is treated as 1, meaning blocks are fetched
+	// one at a time. It also bounds concurrent requests for transactions
+	// creating input cells not kept locally.
+	PrefetchWindow int
+}
 
 type Indexer struct {
-	hash      []byte
-	values    []ValueContext
-	streams   []*ast.Stream
-	redisPool *redis.Pool
-	rpcClient *rpc.Client
+	options Options
+	values  []ValueContext
+	// Namespaces of queries whose indexes are complete, the rest are being
+	// back-filled. Guarded by mutex, together with indexing of each block.
+	synced map[string]bool
+	// Namespaces being back-filled, mapped to the back-filling run they
+	// belong to, guarded by mutex as well.
+	backfilling map[string]uint64
+	backfillRun uint64
+	// First block indexed, and whether cells live before it are seeded
+	// from a checkpoint, see cellIndexed.
+	startBlock     uint64
+	fromCheckpoint bool
+	running        bool
+	mutex          sync.Mutex
+	errors         chan error
+	streams        []StreamContext
+	store          store.Store
+	rpcClient      *rpc.Client
+	pollInterval   time.Duration
+	stop           chan struct{}
+	// Namespaces and confirmation depths dropped but not purged yet, see
+	// dropUnused. Guarded by mutex as well.
+	dropping       map[string]bool
+	droppingDepths map[uint64]bool
+	purgeSignal    chan struct{}
+	// Number of checkpoint cells written at a time when seeding
+	seedBatchSize int
+	// Number of blocks purged at a time while holding mutex
+	purgeBatchSize int
 }
 
-func NewIndexer(astContent []byte, redisPool *redis.Pool, rpcUrl string) (*Indexer, error) {
-	root := &ast.Root{}
-	err := proto.Unmarshal(astContent, root)
+// NewIndexer indexes all files in a single pass over the chain, while
+// keeping indexes of each call and stream independent.
+func NewIndexer(files []ASTFile, s store.Store, rpcUrl string, options Options) (*Indexer, error) {
+	values, streams, err := loadFiles(files)
 	if err != nil {
 		return nil, err
 	}
-	blake2bHash := blake2b.New256()
-	_, err = blake2bHash.Write(astContent)
+
+	// Test rpc
+	client := rpc.NewClient(rpcUrl)
+
+	_, err = client.GetTipBlockNumber()
 	if err != nil {
 		return nil, err
 	}
-	_, err = blake2bHash.Write([]byte(Version))
+
+	return &Indexer{
+		options:        options,
+		values:         values,
+		synced:         make(map[string]bool),
+		store:          aggregatingStore{s},
+		rpcClient:      client,
+		streams:        streams,
+		pollInterval:   time.Second,
+		seedBatchSize:  10000,
+		purgeBatchSize: 100,
+		backfilling:    make(map[string]uint64),
+		purgeSignal:    make(chan struct{}, 1),
+		errors:         make(chan error, 1),
+		stop:           make(chan struct{}),
+	}, nil
+}
+
+func loadFiles(files []ASTFile) ([]ValueContext, []StreamContext, error) {
+	calls, rootStreams, err := ParseASTFiles(files)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	hash := blake2bHash.Sum(nil)
-	values := make([]ValueContext, len(root.GetCalls()))
-	for i, call := range root.GetCalls() {
+	values := make([]ValueContext, len(calls))
+	for i, call := range calls {
 		err = verifier.Verify(call.GetResult())
 		if err != nil {
-			return nil, fmt.Errorf("Verification failure for call %s: %s", call.GetName(), err)
+			return nil, nil, fmt.Errorf("Verification failure for call %s: %s", call.GetName(), err)
 		}
-		valueContext, err := NewValueContext(call.GetName(), call.GetResult())
+		valueContext, err := NewValueContext(call)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		values[i] = valueContext
 	}
-	for _, stream := range root.GetStreams() {
+	streams := make([]StreamContext, len(rootStreams))
+	for i, stream := range rootStreams {
+		switch stream.GetKind() {
+		case ast.Stream_CELL:
+		case ast.Stream_TRANSACTION:
+		case ast.Stream_BLOCK:
+		default:
+			return nil, nil, fmt.Errorf("Invalid kind for stream %s: %s", stream.GetName(), stream.GetKind().String())
+		}
 		err = verifier.Verify(stream.GetFilter())
 		if err != nil {
-			return nil, fmt.Errorf("Verification failure for stream %s: %s", stream.GetName(), err)
+			return nil, nil, fmt.Errorf("Verification failure for stream %s: %s", stream.GetName(), err)
 		}
+		streams[i] = NewStreamContext(stream)
 	}
+	return values, streams, nil
+}
 
-	// Test rpc
-	client := rpc.NewClient(rpcUrl)
+// Reload swaps in calls and streams from files, taking effect from the next
+// block indexed. Nothing changes if any of the files fails verification, or
+// the store cannot be updated. New queries are back-filled in the
+// background.
+func (i *Indexer) Reload(files []ASTFile) error {
+	values, streams, err := loadFiles(files)
+	if err != nil {
+		return err
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if !i.running {
+		i.values = values
+		i.streams = streams
+		return nil
+	}
+	return i.switchValues(values, streams)
+}
 
-	_, err = client.GetTipBlockNumber()
+// switchValues swaps in values and streams once queries they no longer use
+// are recorded as dropped, back-filling of new queries is then started. All
+// fallible work is done before the swap, so nothing changes on errors. It
+// must be called with mutex held.
+func (i *Indexer) switchValues(values []ValueContext, streams []StreamContext) error {
+	synced, pending, err := i.loadSyncedQueries(values)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	err = i.dropUnused(values, streams)
+	if err != nil {
+		return err
 	}
+	i.values = values
+	i.streams = streams
+	i.startBackfill(synced, pending)
+	return nil
+}
 
-	return &Indexer{
-		values:    values,
-		hash:      hash,
-		redisPool: redisPool,
-		rpcClient: client,
-		streams:   root.GetStreams(),
-	}, nil
+// startBackfill marks queries synced, and starts back-filling pending ones
+// in the background. It must be called with mutex held.
+func (i *Indexer) startBackfill(synced [][]byte, pending [][]byte) {
+	for _, hash := range synced {
+		i.synced[string(hash)] = true
+	}
+	if len(pending) == 0 {
+		return
+	}
+	i.backfillRun++
+	run := i.backfillRun
+	for _, hash := range pending {
+		i.backfilling[string(hash)] = run
+	}
+	log.Printf("Back-filling %d queries", len(pending))
+	go func() {
+		err := i.backfill(pending, run)
+		if err != nil {
+			select {
+			case i.errors <- err:
+			default:
+			}
+		}
+	}()
 }
 
-func (i *Indexer) Run() error {
-	redisConn := i.redisPool.Get()
-	defer redisConn.Close()
+// Stop makes Run return once the block currently being processed is done.
+func (i *Indexer) Stop() {
+	close(i.stop)
+}
 
-	dbHash, err := redis.Bytes(redisConn.Do("GET", "AST_HASH"))
-	if err != nil && err != redis.ErrNil {
+func (i *Indexer) Run() error {
+	err := i.checkStoreVersion()
+	if err != nil {
 		return err
 	}
-	if len(dbHash) == 0 {
-		dbHash = i.hash
-		_, err = redisConn.Do("SET", "AST_HASH", dbHash)
-		if err != nil {
-			return err
-		}
+	startBlock, err := i.initializeStart()
+	if err != nil {
+		return err
 	}
-	if !bytes.Equal(dbHash, i.hash) {
-		return fmt.Errorf("Invalid AST Hash: %x, expected: %x", dbHash, i.hash)
+	checkpointBlock, err := i.store.Get("CHECKPOINT_BLOCK")
+	if err != nil {
+		return err
+	}
+	i.mutex.Lock()
+	i.startBlock = startBlock
+	i.fromCheckpoint = checkpointBlock != nil
+	i.running = true
+	synced, pending, err := i.loadSyncedQueries(i.values)
+	if err == nil {
+		err = i.dropUnused(i.values, i.streams)
+	}
+	if err == nil {
+		i.startBackfill(synced, pending)
+	}
+	i.mutex.Unlock()
+	if err != nil {
+		return err
 	}
+	go i.purgeDropped()
+	var pipeline []prefetchedBlock
+	var tip uint64
+	refetched := false
 	for {
-		var blockToFetch uint64
+		select {
+		case <-i.stop:
+			return nil
+		case err = <-i.errors:
+			return err
+		default:
+		}
+
+		blockToFetch := startBlock
 		var lastBlockHash []byte
-		lastBlock, err := redis.Bytes(redisConn.Do("GET", "LAST_BLOCK"))
-		if err != nil && err != redis.ErrNil {
+		lastBlock, err := i.store.Get("LAST_BLOCK")
+		if err != nil {
 			return err
 		}
 		if len(lastBlock) == 40 {
@@ -112,21 +269,50 @@ func (i *Indexer) Run() error {
 			lastBlockHash = lastBlock[8:]
 		}
 
-		block, err := i.queryBlock(blockToFetch)
-		if err != nil {
-			return err
+		if len(pipeline) > 0 && pipeline[0].number != blockToFetch {
+			// A revert just happened, prefetched blocks are of no use
+			pipeline = nil
 		}
+		pipeline = i.fillPipeline(pipeline, blockToFetch, &tip)
+		result := <-pipeline[0].result
+		pipeline = pipeline[1:]
+		if result.err != nil {
+			return result.err
+		}
+		block := result.block
 		if block == nil {
-			time.Sleep(time.Second)
+			// Tip is reached, later blocks will be fetched again
+			pipeline = nil
+			select {
+			case <-i.stop:
+				return nil
+			case <-time.After(i.pollInterval):
+			}
 			continue
 		}
 
 		revert := lastBlockHash != nil && (!bytes.Equal(block.Header.ParentHash[:], lastBlockHash))
+		if revert && !refetched {
+			// The block might be prefetched before a reorg, fetch it again
+			// before reverting anything.
+			pipeline = nil
+			refetched = true
+			continue
+		}
+		refetched = false
+		if !revert {
+			err = i.resolveInputs(block)
+			if err != nil {
+				return err
+			}
+		}
 		if revert {
 			if blockToFetch == 0 {
 				return fmt.Errorf("Nowhere to revert!")
 			}
+			i.mutex.Lock()
 			err = i.revertBlock(blockToFetch - 1)
+			i.mutex.Unlock()
 			if err != nil {
 				return err
 			}
@@ -134,13 +320,13 @@ func (i *Indexer) Run() error {
 			continue
 		}
 
-		// In the optimal path, we keep only one Redis connection
 		commands := &commandBuffer{}
+		i.mutex.Lock()
 		err = i.indexBlock(*block, commands)
-		if err != nil {
-			return err
+		if err == nil {
+			err = commands.execute(i.store)
 		}
-		err = commands.execute(redisConn)
+		i.mutex.Unlock()
 		if err != nil {
 			return err
 		}
@@ -148,83 +334,354 @@ func (i *Indexer) Run() error {
 	}
 }
 
-func (i *Indexer) queryBlock(blockNumber uint64) (*rpctypes.BlockView, error) {
-	blockView, err := i.rpcClient.GetBlockByNumber(rpctypes.Uint64(blockNumber))
-	if err != nil {
-		return nil, err
-	}
+type prefetchedBlock struct {
+	number uint64
+	result chan prefetchResult
+}
 
-	if blockView == nil {
-		return nil, nil
+type prefetchResult struct {
+	block *rpctypes.BlockView
+	err   error
+}
+
+// fillPipeline starts fetching blocks following the ones already in
+// pipeline, until the prefetch window is full. tip is the last known tip of
+// CKB, blocks past it are not fetched. It is refreshed once pipeline runs
+// empty, if the tip is reached still, or CKB reports no tip, a nil block is
+// returned without asking for it.
+func (i *Indexer) fillPipeline(pipeline []prefetchedBlock, blockToFetch uint64, tip *uint64) []prefetchedBlock {
+	window := i.options.PrefetchWindow
+	if window < 1 {
+		window = 1
 	}
+	if len(pipeline) == 0 {
+		tipBlockNumber, err := i.rpcClient.GetTipBlockNumber()
+		if err != nil || tipBlockNumber == nil || uint64(*tipBlockNumber) < blockToFetch {
+			prefetched := prefetchedBlock{
+				number: blockToFetch,
+				result: make(chan prefetchResult, 1),
+			}
+			prefetched.result <- prefetchResult{err: err}
+			return []prefetchedBlock{prefetched}
+		}
+		*tip = uint64(*tipBlockNumber)
+	}
+	for len(pipeline) < window && blockToFetch+uint64(len(pipeline)) <= *tip {
+		prefetched := prefetchedBlock{
+			number: blockToFetch + uint64(len(pipeline)),
+			result: make(chan prefetchResult, 1),
+		}
+		go func() {
+			block, err := i.queryBlock(prefetched.number)
+			prefetched.result <- prefetchResult{
+				block: block,
+				err:   err,
+			}
+		}()
+		pipeline = append(pipeline, prefetched)
+	}
+	return pipeline
+}
 
-	var emptyHash rpctypes.Hash
+func (i *Indexer) queryBlock(blockNumber uint64) (*rpctypes.BlockView, error) {
+	return i.rpcClient.GetBlockByNumber(rpctypes.Uint64(blockNumber))
+}
+
+func cellKey(outPoint rpctypes.OutPoint) string {
+	return fmt.Sprintf("CELL:%x:%d", outPoint.TxHash[:], outPoint.Index)
+}
 
-	type previousOutputInfo struct {
-		PreviousOutput *rpctypes.OutPoint
-		TxIndex        int
-		InputIndex     int
+func headerKey(blockHash rpctypes.Hash) string {
+	return fmt.Sprintf("HEADER:%x", blockHash[:])
+}
+
+// liveCell is what is kept in the live cell set for each unspent cell.
+type liveCell struct {
+	Cell rpctypes.CellOutput `json:"cell"`
+	Data rpctypes.Raw        `json:"data"`
+	// Block creating the cell, its header is kept at headerKey
+	BlockHash rpctypes.Hash `json:"block_hash"`
+}
+
+// LiveCells looks up outPoints in the live cell set kept in s, filling in
+// cell, data and header of each one found. Cells not kept, such as spent
+// ones, are returned as nil.
+func LiveCells(s store.Store, outPoints []rpctypes.OutPoint) ([]*rpctypes.OutPoint, error) {
+	headers := make(map[rpctypes.Hash]*rpctypes.Header)
+	results := make([]*rpctypes.OutPoint, len(outPoints))
+	for i, outPoint := range outPoints {
+		data, err := s.Get(cellKey(outPoint))
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			continue
+		}
+		var cell liveCell
+		err = json.Unmarshal(data, &cell)
+		if err != nil {
+			return nil, err
+		}
+		header, found := headers[cell.BlockHash]
+		if !found {
+			headerData, err := s.Get(headerKey(cell.BlockHash))
+			if err != nil {
+				return nil, err
+			}
+			if headerData != nil {
+				header = &rpctypes.Header{}
+				err = json.Unmarshal(headerData, header)
+				if err != nil {
+					return nil, err
+				}
+			}
+			headers[cell.BlockHash] = header
+		}
+		if header == nil {
+			continue
+		}
+		results[i] = &rpctypes.OutPoint{
+			TxHash:   outPoint.TxHash,
+			Index:    outPoint.Index,
+			Cell:     &cell.Cell,
+			CellData: &cell.Data,
+			Header:   header,
+		}
+	}
+	return results, nil
+}
+
+// resolveInputs fills in cells consumed by the block, together with headers
+// of blocks creating them. Since every indexed output is kept in the live
+// cell set until it is spent, and every indexed header is kept as well, only
+// cells created before indexing started need to be fetched from CKB. This
+// must run after all previous blocks are indexed.
+func (i *Indexer) resolveInputs(block *rpctypes.BlockView) error {
+	type resolvedOutput struct {
+		previousOutput *rpctypes.OutPoint
+		blockHash      rpctypes.Hash
 	}
 
+	var emptyHash rpctypes.Hash
+	// Cells created by earlier transactions in the same block
+	created := make(map[string]rpctypes.OutPoint)
+	var resolved []resolvedOutput
+	var missing []*rpctypes.OutPoint
 	set := make(map[rpctypes.Hash]int)
-	var previousOutputs []previousOutputInfo
-	for txIndex, tx := range blockView.Transactions {
+	for txIndex, tx := range block.Transactions {
 		for inputIndex, input := range tx.RawTransaction.Inputs {
-			if input.PreviousOutput.TxHash != emptyHash {
-				previous := previousOutputInfo{
-					PreviousOutput: &input.PreviousOutput,
-					TxIndex:        txIndex,
-					InputIndex:     inputIndex,
-				}
-				previousOutputs = append(previousOutputs, previous)
+			previousOutput := &block.Transactions[txIndex].Inputs[inputIndex].PreviousOutput
+			if input.PreviousOutput.TxHash == emptyHash || previousOutput.Cell != nil {
+				continue
+			}
+			key := cellKey(input.PreviousOutput)
+			if cell, found := created[key]; found {
+				previousOutput.Cell = cell.Cell
+				previousOutput.CellData = cell.CellData
+				previousOutput.Header = cell.Header
+				continue
+			}
+			data, err := i.store.Get(key)
+			if err != nil {
+				return err
+			}
+			if data == nil {
+				missing = append(missing, previousOutput)
 				set[input.PreviousOutput.TxHash] = 1
+				continue
 			}
+			var cell liveCell
+			err = json.Unmarshal(data, &cell)
+			if err != nil {
+				return err
+			}
+			previousOutput.Cell = &cell.Cell
+			previousOutput.CellData = &cell.Data
+			resolved = append(resolved, resolvedOutput{
+				previousOutput: previousOutput,
+				blockHash:      cell.BlockHash,
+			})
+		}
+		for outputIndex := range tx.RawTransaction.Outputs {
+			rawData := rpctypes.Raw([]byte(tx.RawTransaction.OutputsData[outputIndex]))
+			outPoint := rpctypes.OutPoint{
+				TxHash:   tx.Hash,
+				Index:    rpctypes.Uint32(outputIndex),
+				Cell:     &tx.RawTransaction.Outputs[outputIndex],
+				CellData: &rawData,
+				Header:   &block.Header.Header,
+			}
+			created[cellKey(outPoint)] = outPoint
 		}
 	}
 
-	var previousTxHashes []rpctypes.Hash
-	for key := range set {
-		previousTxHashes = append(previousTxHashes, key)
+	if len(missing) > 0 {
+		var previousTxHashes []rpctypes.Hash
+		for key := range set {
+			previousTxHashes = append(previousTxHashes, key)
+		}
+		transactionWithStatusViews, err := i.fetchTransactions(previousTxHashes)
+		if err != nil {
+			return err
+		}
+		transactions := rpc.CommittedTransactions(transactionWithStatusViews)
+		for _, previousOutput := range missing {
+			cell, data, blockHash, found := rpc.CommittedCell(transactions, *previousOutput)
+			if !found {
+				return fmt.Errorf("Input cell %x:%d cannot be found!", previousOutput.TxHash[:], previousOutput.Index)
+			}
+			previousOutput.Cell = cell
+			previousOutput.CellData = data
+			resolved = append(resolved, resolvedOutput{
+				previousOutput: previousOutput,
+				blockHash:      blockHash,
+			})
+		}
 	}
 
-	if len(previousOutputs) > 0 {
-		transactionWithStatusViews, err := i.rpcClient.GetAllTransactions(previousTxHashes, 50)
+	headers := make(map[rpctypes.Hash]*rpctypes.Header)
+	for _, output := range resolved {
+		headers[output.blockHash] = nil
+	}
+	err := i.loadHeaders(headers)
+	if err != nil {
+		return err
+	}
+	for _, output := range resolved {
+		output.previousOutput.Header = headers[output.blockHash]
+	}
+	return nil
+}
 
-		if err != nil {
-			return nil, err
+// fetchTransactions loads transactions from CKB in batches, with as many
+// batches requested concurrently as blocks prefetched.
+func (i *Indexer) fetchTransactions(txHashes []rpctypes.Hash) ([]*rpctypes.TransactionWithStatusView, error) {
+	const batchSize = 50
+	concurrency := i.options.PrefetchWindow
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	batches := (len(txHashes) + batchSize - 1) / batchSize
+	results := make([][]*rpctypes.TransactionWithStatusView, batches)
+	errs := make([]error, batches)
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for batch := 0; batch < batches; batch++ {
+		end := (batch + 1) * batchSize
+		if end > len(txHashes) {
+			end = len(txHashes)
 		}
-
-		txMap := make(map[rpctypes.Hash]rpctypes.TransactionView)
-		for _, txWithStatusView := range transactionWithStatusViews {
-			txView := &txWithStatusView.Transaction
-			txMap[txView.Hash] = *txView
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(batch int, hashes []rpctypes.Hash) {
+			defer wg.Done()
+			results[batch], errs[batch] = i.rpcClient.GetAllTransactions(hashes, batchSize)
+			<-semaphore
+		}(batch, txHashes[batch*batchSize:end])
+	}
+	wg.Wait()
+	var transactions []*rpctypes.TransactionWithStatusView
+	for batch, result := range results {
+		if errs[batch] != nil {
+			return nil, errs[batch]
 		}
+		transactions = append(transactions, result...)
+	}
+	return transactions, nil
+}
 
-		for _, su := range previousOutputs {
-			txView := txMap[su.PreviousOutput.TxHash]
-			idx := su.PreviousOutput.Index
-			cell := txView.Outputs[idx]
-			data := txView.OutputsData[idx]
-			blockView.Transactions[su.TxIndex].Inputs[su.InputIndex].PreviousOutput.Cell = &cell
-			rawData := rpctypes.Raw([]byte(data))
-			blockView.Transactions[su.TxIndex].Inputs[su.InputIndex].PreviousOutput.CellData = &rawData
+// loadHeaders fills in all headers missing in the map, either from headers
+// kept locally or from CKB.
+func (i *Indexer) loadHeaders(headers map[rpctypes.Hash]*rpctypes.Header) error {
+	var missingHeaders []rpctypes.Hash
+	for blockHash, header := range headers {
+		if header != nil {
+			continue
+		}
+		data, err := i.store.Get(headerKey(blockHash))
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			missingHeaders = append(missingHeaders, blockHash)
+			continue
+		}
+		header = &rpctypes.Header{}
+		err = json.Unmarshal(data, header)
+		if err != nil {
+			return err
 		}
+		headers[blockHash] = header
 	}
-
-	return blockView, err
+	if len(missingHeaders) > 0 {
+		headerViews, err := i.rpcClient.GetAllHeaders(missingHeaders, 50)
+		if err != nil {
+			return err
+		}
+		for _, headerView := range headerViews {
+			if headerView != nil {
+				headers[headerView.Hash] = &headerView.Header
+			}
+		}
+	}
+	for blockHash, header := range headers {
+		if header == nil {
+			return fmt.Errorf("Header %x cannot be found!", blockHash[:])
+		}
+	}
+	return nil
 }
 
 func (i *Indexer) indexBlock(block rpctypes.BlockView, commands *commandBuffer) error {
-	var err error
-	for _, tx := range block.Transactions {
-		for _, input := range tx.RawTransaction.Inputs {
+	err := i.applyConfirmedCommands(uint64(block.Header.Number), commands)
+	if err != nil {
+		return err
+	}
+	header := ast.ConvertHeader(block.Header.Header)
+	blockEvent := Event{
+		BlockNumber: uint64(block.Header.Number),
+		BlockHash:   block.Header.Hash[:],
+	}
+	blockHeaderKey := headerKey(block.Header.Hash)
+	headerData, err := json.Marshal(block.Header.Header)
+	if err != nil {
+		return err
+	}
+	commands.do(store.CommandSet, blockHeaderKey, headerData)
+	commands.revertDo(store.CommandDelete, blockHeaderKey, nil)
+	// Cells created in current block, spending them needs no revert command
+	// since reverting the creation deletes them already.
+	created := make(map[string]bool)
+	for txIndex, tx := range block.Transactions {
+		txEvent := blockEvent
+		txEvent.TxHash = tx.Hash[:]
+		for inputIndex, input := range tx.RawTransaction.Inputs {
 			if input.PreviousOutput.Cell != nil &&
 				input.PreviousOutput.CellData != nil {
+				key := cellKey(input.PreviousOutput)
+				if created[key] {
+					commands.do(store.CommandDelete, key, nil)
+				} else {
+					// Cells created before indexing started are not kept, they
+					// can be fetched from CKB again once the block is reverted.
+					data, err := i.store.Get(key)
+					if err != nil {
+						return err
+					}
+					if data != nil {
+						commands.do(store.CommandDelete, key, nil)
+						commands.revertDo(store.CommandSet, key, data)
+					}
+				}
+				cellEvent := txEvent
+				cellEvent.CellIndex = uint64(inputIndex)
 				err = i.processCell(
 					*input.PreviousOutput.Cell,
 					*input.PreviousOutput.CellData,
 					input.PreviousOutput,
+					input.PreviousOutput.Header,
 					false,
+					cellEvent,
 					commands,
 				)
 				if err != nil {
@@ -235,85 +692,338 @@ func (i *Indexer) indexBlock(block rpctypes.BlockView, commands *commandBuffer)
 
 		for outputIndex, output := range tx.RawTransaction.Outputs {
 			rawData := rpctypes.Raw([]byte(tx.RawTransaction.OutputsData[outputIndex]))
+			outPoint := rpctypes.OutPoint{
+				TxHash: tx.Hash,
+				Index:  rpctypes.Uint32(outputIndex),
+			}
+			key := cellKey(outPoint)
+			data, err := json.Marshal(liveCell{
+				Cell:      output,
+				Data:      rawData,
+				BlockHash: block.Header.Hash,
+			})
+			if err != nil {
+				return err
+			}
+			commands.do(store.CommandSet, key, data)
+			commands.revertDo(store.CommandDelete, key, nil)
+			created[key] = true
+			cellEvent := txEvent
+			cellEvent.CellIndex = uint64(outputIndex)
 			err = i.processCell(
 				output,
 				rawData,
-				rpctypes.OutPoint{
-					TxHash: tx.Hash,
-					Index:  rpctypes.Uint32(outputIndex),
-				},
+				outPoint,
+				&block.Header.Header,
 				true,
+				cellEvent,
 				commands,
 			)
 			if err != nil {
 				return err
 			}
 		}
+
+		err = i.indexTransaction(tx, txIndex, &block.Header.Header, i.synced, commands)
+		if err != nil {
+			return err
+		}
+		err = i.processTransaction(tx, header, txEvent, commands)
+		if err != nil {
+			return err
+		}
+	}
+	err = i.processBlock(block, header, blockEvent, commands)
+	if err != nil {
+		return err
 	}
 	blockNumber := uint64(block.Header.Number)
 	blockHashKey := fmt.Sprintf("BLOCK:%d:HASH", blockNumber)
-	commands.do("SET", blockHashKey, block.Header.Hash[:])
+	commands.do(store.CommandSet, blockHashKey, block.Header.Hash[:])
+	if i.options.MaxReorgDepth > 0 && blockNumber >= i.options.MaxReorgDepth {
+		i.pruneBlock(blockNumber-i.options.MaxReorgDepth, commands)
+	}
+	for _, depth := range commands.deferredDepths() {
+		data, err := encodeCommands(commands.deferred[depth].revertible())
+		if err != nil {
+			return err
+		}
+		deferredKey := fmt.Sprintf("BLOCK:%d:DEFERRED:%d", blockNumber, depth)
+		commands.do(store.CommandSet, deferredKey, data)
+		commands.revertDo(store.CommandDelete, deferredKey, nil)
+	}
 	lastBlock := make([]byte, 40)
 	binary.LittleEndian.PutUint64(lastBlock, blockNumber)
 	copy(lastBlock[8:], block.Header.Hash[:])
-	commands.do("SET", "LAST_BLOCK", lastBlock)
+	commands.do(store.CommandSet, "LAST_BLOCK", lastBlock)
+	// A block of the new fork is indexed, the reorg is over
+	commands.do(store.CommandDelete, "REORG", nil)
+	sequence, err := i.nextSequence()
+	if err != nil {
+		return err
+	}
+	commands.do(store.CommandSet, "SEQUENCE", sequence)
 
 	revertKey := fmt.Sprintf("BLOCK:%d:REVERT_COMMANDS", blockNumber)
 	commands.setRevertKey(revertKey)
-	commands.revertDo("DEL", blockHashKey)
+	commands.revertDo(store.CommandDelete, blockHashKey, nil)
 	if blockNumber > 0 {
 		previousBlock := make([]byte, 40)
 		binary.LittleEndian.PutUint64(previousBlock, blockNumber-1)
 		copy(previousBlock[8:], block.Header.ParentHash[:])
-		commands.revertDo("SET", "LAST_BLOCK", previousBlock)
+		commands.revertDo(store.CommandSet, "LAST_BLOCK", previousBlock)
 	} else {
-		commands.revertDo("DEL", "LAST_BLOCK")
+		commands.revertDo(store.CommandDelete, "LAST_BLOCK", nil)
 	}
-	commands.revertDo("DEL", revertKey)
+	commands.revertDo(store.CommandDelete, revertKey, nil)
 
 	return nil
 }
 
-func (i *Indexer) revertBlock(blockNumber uint64) error {
-	conn := i.redisPool.Get()
-	defer conn.Close()
+// applyConfirmedCommands picks up commands deferred by earlier blocks that
+// reach their confirmation depth at current block. Their revert commands are
+// kept with the original block, so they are only reverted when the original
+// block itself gets reverted.
+func (i *Indexer) applyConfirmedCommands(blockNumber uint64, commands *commandBuffer) error {
+	for _, depth := range i.confirmationDepths() {
+		if blockNumber < depth {
+			continue
+		}
+		deferredKey := fmt.Sprintf("BLOCK:%d:DEFERRED:%d", blockNumber-depth, depth)
+		data, err := i.store.Get(deferredKey)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			continue
+		}
+		var deferred revertibleCommands
+		err = decodeCommands(data, &deferred)
+		if err != nil {
+			return err
+		}
+		commands.commands = append(commands.commands, i.liveCommands(deferred.Commands)...)
+		commands.do(store.CommandDelete, deferredKey, nil)
+		if i.options.MaxReorgDepth > 0 && depth >= i.options.MaxReorgDepth {
+			// Original block can no longer be reverted
+			continue
+		}
+		revertData, err := encodeCommands(i.liveCommands(deferred.RevertCommands))
+		if err != nil {
+			return err
+		}
+		commands.do(store.CommandSet,
+			fmt.Sprintf("BLOCK:%d:CONFIRMED:%d", blockNumber-depth, depth), revertData)
+	}
+	return nil
+}
+
+// pruneBlock drops all data kept only for reverting a block, the deletion is
+// not reverted even if current block is.
+func (i *Indexer) pruneBlock(blockNumber uint64, commands *commandBuffer) {
+	commands.do(store.CommandDelete, fmt.Sprintf("BLOCK:%d:REVERT_COMMANDS", blockNumber), nil)
+	commands.do(store.CommandDelete, fmt.Sprintf("BLOCK:%d:HASH", blockNumber), nil)
+	for _, depth := range i.confirmationDepths() {
+		commands.do(store.CommandDelete, fmt.Sprintf("BLOCK:%d:CONFIRMED:%d", blockNumber, depth), nil)
+	}
+}
+
+func (i *Indexer) confirmationDepths() []uint64 {
+	return confirmationDepthsOf(i.values, i.streams)
+}
 
+func confirmationDepthsOf(values []ValueContext, streams []StreamContext) []uint64 {
+	depthSet := make(map[uint64]bool)
+	for _, valueContext := range values {
+		if valueContext.Confirmations > 0 {
+			depthSet[valueContext.Confirmations] = true
+		}
+	}
+	for _, stream := range streams {
+		if stream.Stream.GetConfirmations() > 0 {
+			depthSet[stream.Stream.GetConfirmations()] = true
+		}
+	}
+	return sortedDepths(depthSet)
+}
+
+// checkStoreVersion refuses to index a store written with a different
+// layout, an empty store is marked with the current one.
+func (i *Indexer) checkStoreVersion() error {
+	data, err := i.store.Get("STORE_VERSION")
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		for _, key := range []string{"LAST_BLOCK", "START_BLOCK"} {
+			value, err := i.store.Get(key)
+			if err != nil {
+				return err
+			}
+			if value != nil {
+				return fmt.Errorf("Store is written by an older version of animagus, re-indexing from scratch is required!")
+			}
+		}
+		data = make([]byte, 8)
+		binary.LittleEndian.PutUint64(data, StoreVersion)
+		return i.store.Execute([]store.Command{
+			store.Command{
+				Name:  store.CommandSet,
+				Key:   "STORE_VERSION",
+				Value: data,
+			},
+		})
+	}
+	if len(data) != 8 || binary.LittleEndian.Uint64(data) != StoreVersion {
+		return fmt.Errorf("Store version %x does not match version %d of animagus, re-indexing from scratch is required!", data, StoreVersion)
+	}
+	return nil
+}
+
+func (i *Indexer) revertBlock(blockNumber uint64) error {
+	// Cells live before the start block are not indexed, and those in the
+	// checkpoint are seeded without revert commands, reverting the start
+	// block or the checkpoint would leave the index inconsistent.
+	if i.fromCheckpoint && blockNumber < i.startBlock {
+		return fmt.Errorf("Block %d is not after checkpoint block %d and cannot be reverted, re-indexing from an earlier checkpoint is required!", blockNumber, i.startBlock-1)
+	}
+	if !i.fromCheckpoint && i.startBlock > 0 && blockNumber <= i.startBlock {
+		return fmt.Errorf("Block %d is not after start block %d and cannot be reverted, re-indexing from an earlier block is required!", blockNumber, i.startBlock)
+	}
 	revertKey := fmt.Sprintf("BLOCK:%d:REVERT_COMMANDS", blockNumber)
-	revertData, err := redis.Bytes(conn.Do("GET", revertKey))
+	revertData, err := i.store.Get(revertKey)
 	if err != nil {
 		return err
 	}
+	if revertData == nil {
+		if i.options.MaxReorgDepth > 0 {
+			return fmt.Errorf("Revert commands for block %d are missing, the reorg is likely deeper than max reorg depth %d, re-indexing from scratch is required!", blockNumber, i.options.MaxReorgDepth)
+		}
+		return fmt.Errorf("Revert commands for block %d are missing!", blockNumber)
+	}
 
-	var revertCommands []command
-	gzipReader, err := gzip.NewReader(bytes.NewReader(revertData))
+	var revertCommands []store.Command
+	// Deferred commands already applied are reverted first, latest applied
+	// ones go first.
+	depths := i.confirmationDepths()
+	for d := len(depths) - 1; d >= 0; d-- {
+		depth := depths[d]
+		confirmedKey := fmt.Sprintf("BLOCK:%d:CONFIRMED:%d", blockNumber, depth)
+		confirmedData, err := i.store.Get(confirmedKey)
+		if err != nil {
+			return err
+		}
+		if confirmedData == nil {
+			continue
+		}
+		var confirmedCommands []store.Command
+		err = decodeCommands(confirmedData, &confirmedCommands)
+		if err != nil {
+			return err
+		}
+		revertCommands = append(revertCommands, i.liveCommands(confirmedCommands)...)
+		revertCommands = append(revertCommands, store.Command{
+			Name: store.CommandDelete,
+			Key:  confirmedKey,
+		})
+	}
+	var blockRevertCommands []store.Command
+	err = decodeCommands(revertData, &blockRevertCommands)
 	if err != nil {
 		return err
 	}
-	decoder := json.NewDecoder(gzipReader)
-	err = decoder.Decode(&revertCommands)
+	revertCommands = append(revertCommands, i.liveCommands(blockRevertCommands)...)
+	reorgBlock := make([]byte, 8)
+	binary.LittleEndian.PutUint64(reorgBlock, blockNumber)
+	sequence, err := i.nextSequence()
 	if err != nil {
 		return err
 	}
+	revertCommands = append(revertCommands, store.Command{
+		Name:  store.CommandSet,
+		Key:   "REORG",
+		Value: reorgBlock,
+	}, store.Command{
+		Name:  store.CommandSet,
+		Key:   "SEQUENCE",
+		Value: sequence,
+	})
+
+	return i.store.Execute(revertCommands)
+}
+
+// nextSequence returns the next value of SEQUENCE, which changes whenever
+// a block is indexed or reverted. Readers compare it before and after their
+// reads to ensure all of them see the same state.
+func (i *Indexer) nextSequence() ([]byte, error) {
+	data, err := i.store.Get("SEQUENCE")
+	if err != nil {
+		return nil, err
+	}
+	sequence := uint64(0)
+	if len(data) == 8 {
+		sequence = binary.LittleEndian.Uint64(data)
+	}
+	result := make([]byte, 8)
+	binary.LittleEndian.PutUint64(result, sequence+1)
+	return result, nil
+}
+
+// processCell indexes a cell created or consumed, header is the header of
+// the block creating the cell, it can be nil when not available.
+func (i *Indexer) processCell(cell rpctypes.CellOutput, cellData rpctypes.Raw, outPoint rpctypes.OutPoint, header *rpctypes.Header, insert bool, event Event, commands *commandBuffer) error {
+	astCell := ast.ConvertCell(cell, cellData, outPoint, header)
+	if insert || i.cellIndexed(header) {
+		err := i.indexCell(astCell, outPoint, insert, event.BlockNumber, i.synced, commands)
+		if err != nil {
+			return err
+		}
+	}
+	for _, stream := range i.streams {
+		if stream.Stream.GetKind() != ast.Stream_CELL {
+			continue
+		}
+		err := emitStreamEvent(stream,
+			[]*ast.Value{astCell, streamingArg(insertArg(insert)), streamingArg("index")},
+			[]*ast.Value{astCell, streamingArg(insertArg(!insert)), streamingArg("revert")},
+			event, commands)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	conn.Send("MULTI")
-	for _, command := range revertCommands {
-		conn.Send(command.Name, command.Args...)
+// cellIndexed tells if creation of a cell in the block of header has been
+// indexed. Cells created before the start block never entered any index,
+// so consuming them must not be recorded either.
+func (i *Indexer) cellIndexed(header *rpctypes.Header) bool {
+	if i.fromCheckpoint || i.startBlock == 0 {
+		return true
 	}
-	_, err = conn.Do("EXEC")
-	return err
+	return header != nil && uint64(header.Number) >= i.startBlock
 }
 
-func (i *Indexer) processCell(cell rpctypes.CellOutput, cellData rpctypes.Raw, outPoint rpctypes.OutPoint, insert bool, commands *commandBuffer) error {
-	// TODO: To maintain reasonable cell set in CKB, it might not be possible to grab
-	// meta-data of very old spent cells. Hence for now, we are excluding all cell
-	// headers in indexer mode, and only include headers when executing an AST
-	// (since executor only uses live cells). A different solution might be that
-	// animagus can do its own indexing to cache all header info, but that will
-	// be a quite big change so we will leave it till a future time when it is
-	// really needed.
-	astCell := ast.ConvertCell(cell, cellData, outPoint, nil)
+// indexCell updates indexes of the queries whose namespaces are included,
+// blockNumber is the block creating or consuming the cell.
+func (i *Indexer) indexCell(astCell *ast.Value, outPoint rpctypes.OutPoint, insert bool, blockNumber uint64, namespaces map[string]bool, commands *commandBuffer) error {
+	// Multiple calls might share the same query
+	indexed := make(map[string]bool)
 	for _, valueContext := range i.values {
 		for queryIndex, query := range valueContext.Queries {
+			namespace := string(valueContext.QueryHashes[queryIndex])
+			if (query.GetT() != ast.Value_QUERY_CELLS && query.GetT() != ast.Value_REDUCE) ||
+				!namespaces[namespace] || indexed[namespace] {
+				continue
+			}
+			indexed[namespace] = true
+			if query.GetT() == ast.Value_REDUCE {
+				err := indexAggregate(valueContext, queryIndex, astCell, insert, commands)
+				if err != nil {
+					return err
+				}
+				continue
+			}
 			indexedValues, err := executeIndexingQuery(query, astCell)
 			if err != nil {
 				return err
@@ -323,75 +1033,320 @@ func (i *Indexer) processCell(cell rpctypes.CellOutput, cellData rpctypes.Raw, o
 				if err != nil {
 					return err
 				}
+				createdKey, consumedKey, err := valueContext.HistoryKeys(queryIndex, indexedValues)
+				if err != nil {
+					return err
+				}
+				confirmedCommands := commands.confirmed(valueContext.Confirmations)
+				countCell(valueContext, queryIndex, insert, confirmedCommands)
 				if insert {
-					commands.insert(key, outPoint)
+					confirmedCommands.insert(key, outPoint)
+					confirmedCommands.record(createdKey, outPoint, blockNumber)
 				} else {
-					commands.remove(key, outPoint)
+					confirmedCommands.remove(key, outPoint)
+					confirmedCommands.record(consumedKey, outPoint, blockNumber)
 				}
 			}
 		}
 	}
+	return nil
+}
+
+func indexAggregate(valueContext ValueContext, queryIndex int, astCell *ast.Value, insert bool, commands *commandBuffer) error {
+	query, funcs := aggregatedQuery(valueContext.Queries[queryIndex])
+	indexedValues, err := executeIndexingQuery(query, astCell)
+	if err != nil {
+		return err
+	}
+	if indexedValues == nil {
+		return nil
+	}
+	key, err := valueContext.IndexKey(queryIndex, indexedValues)
+	if err != nil {
+		return err
+	}
+	delta := aggregateCell(funcs, astCell)
+	if !insert {
+		delta = delta.negate()
+	}
+	confirmedCommands := commands.confirmed(valueContext.Confirmations)
+	countCell(valueContext, queryIndex, insert, confirmedCommands)
+	confirmedCommands.aggregate(key, delta)
+	return nil
+}
+
+// TransactionRecord is a member of QUERY_TRANSACTIONS indexes, which are
+// sorted sets, serialized records sort in the same order as transactions in
+// the chain.
+type TransactionRecord struct {
+	BlockNumber uint64
+	TxIndex     uint32
+	TxHash      rpctypes.Hash
+}
+
+func (r TransactionRecord) Serialize() []byte {
+	data := make([]byte, 44)
+	binary.BigEndian.PutUint64(data, r.BlockNumber)
+	binary.BigEndian.PutUint32(data[8:], r.TxIndex)
+	copy(data[12:], r.TxHash[:])
+	return data
+}
+
+func ParseTransactionRecord(data []byte) (TransactionRecord, error) {
+	if len(data) != 44 {
+		return TransactionRecord{}, fmt.Errorf("Invalid transaction record length: %d", len(data))
+	}
+	record := TransactionRecord{
+		BlockNumber: binary.BigEndian.Uint64(data),
+		TxIndex:     binary.BigEndian.Uint32(data[8:]),
+	}
+	copy(record.TxHash[:], data[12:])
+	return record, nil
+}
+
+// indexTransaction adds the transaction to indexes of QUERY_TRANSACTIONS
+// queries whose namespaces are included, under the keys of all its input and
+// output cells matching the query. Inputs must be resolved.
+func (i *Indexer) indexTransaction(tx rpctypes.TransactionView, txIndex int, header *rpctypes.Header, namespaces map[string]bool, commands *commandBuffer) error {
+	var astCells []*ast.Value
+	indexed := make(map[string]bool)
+	for _, valueContext := range i.values {
+		for queryIndex, query := range valueContext.Queries {
+			namespace := string(valueContext.QueryHashes[queryIndex])
+			if query.GetT() != ast.Value_QUERY_TRANSACTIONS || !namespaces[namespace] || indexed[namespace] {
+				continue
+			}
+			indexed[namespace] = true
+			if astCells == nil {
+				astCells = transactionCells(tx, header)
+			}
+			keys := make(map[string]bool)
+			for _, astCell := range astCells {
+				indexedValues, err := executeIndexingQuery(query, astCell)
+				if err != nil {
+					return err
+				}
+				if indexedValues == nil {
+					continue
+				}
+				key, err := valueContext.IndexKey(queryIndex, indexedValues)
+				if err != nil {
+					return err
+				}
+				keys[key] = true
+			}
+			record := TransactionRecord{
+				BlockNumber: uint64(header.Number),
+				TxIndex:     uint32(txIndex),
+				TxHash:      tx.Hash,
+			}.Serialize()
+			for key := range keys {
+				commands.confirmed(valueContext.Confirmations).do(store.CommandSortedAdd, key, record)
+				commands.confirmed(valueContext.Confirmations).revertDo(store.CommandSortedRemove, key, record)
+			}
+		}
+	}
+	return nil
+}
+
+// transactionCells converts resolved input cells and output cells of tx,
+// header is the header of the block including tx.
+func transactionCells(tx rpctypes.TransactionView, header *rpctypes.Header) []*ast.Value {
+	astCells := []*ast.Value{}
+	for _, input := range tx.Inputs {
+		previousOutput := input.PreviousOutput
+		if previousOutput.Cell == nil || previousOutput.CellData == nil {
+			continue
+		}
+		astCells = append(astCells, ast.ConvertCell(*previousOutput.Cell,
+			*previousOutput.CellData, previousOutput, previousOutput.Header))
+	}
+	for outputIndex, output := range tx.Outputs {
+		astCells = append(astCells, ast.ConvertCell(output,
+			rpctypes.Raw([]byte(tx.OutputsData[outputIndex])),
+			rpctypes.OutPoint{
+				TxHash: tx.Hash,
+				Index:  rpctypes.Uint32(outputIndex),
+			}, header))
+	}
+	return astCells
+}
+
+func (i *Indexer) processTransaction(tx rpctypes.TransactionView, header *ast.Value, event Event, commands *commandBuffer) error {
+	var astTransaction *ast.Value
 	for _, stream := range i.streams {
-		value, err := executeStreamingFilter(stream.GetFilter(), astCell, insert, true)
+		if stream.Stream.GetKind() != ast.Stream_TRANSACTION {
+			continue
+		}
+		if astTransaction == nil {
+			astTransaction = ast.ConvertTransaction(tx)
+		}
+		err := emitStreamEvent(stream,
+			[]*ast.Value{astTransaction, header, streamingArg("index")},
+			[]*ast.Value{astTransaction, header, streamingArg("revert")},
+			event, commands)
 		if err != nil {
 			return err
 		}
-		if value != nil {
-			commands.streamValue(stream.GetName(), value)
+	}
+	return nil
+}
+
+func (i *Indexer) processBlock(block rpctypes.BlockView, header *ast.Value, event Event, commands *commandBuffer) error {
+	var astTransactions *ast.Value
+	for _, stream := range i.streams {
+		if stream.Stream.GetKind() != ast.Stream_BLOCK {
+			continue
 		}
-		// Prepare revert value
-		value, err = executeStreamingFilter(stream.GetFilter(), astCell, !insert, false)
+		if astTransactions == nil {
+			astTransactions = &ast.Value{
+				T:        ast.Value_LIST,
+				Children: make([]*ast.Value, len(block.Transactions)),
+			}
+			for txIndex, tx := range block.Transactions {
+				astTransactions.Children[txIndex] = ast.ConvertTransaction(tx)
+			}
+		}
+		err := emitStreamEvent(stream,
+			[]*ast.Value{header, astTransactions, streamingArg("index")},
+			[]*ast.Value{header, astTransactions, streamingArg("revert")},
+			event, commands)
 		if err != nil {
 			return err
 		}
-		if value != nil {
-			commands.revertStreamValue(stream.GetName(), value)
+	}
+	return nil
+}
+
+// emitStreamEvent runs the stream filter with args to generate the event
+// for current block, then with revertArgs to prepare the event emitted in
+// case the block gets reverted.
+func emitStreamEvent(stream StreamContext, args []*ast.Value, revertArgs []*ast.Value, event Event, commands *commandBuffer) error {
+	commands = commands.confirmed(stream.Stream.GetConfirmations())
+	value, indexedValues, err := executeStreamingFilter(stream.Stream.GetFilter(), args)
+	if err != nil {
+		return err
+	}
+	if value != nil {
+		key, err := stream.Key(indexedValues)
+		if err != nil {
+			return fmt.Errorf("Stream %s: %s", stream.Stream.GetName(), err)
+		}
+		commands.streamValue(key, event, value)
+	}
+	value, indexedValues, err = executeStreamingFilter(stream.Stream.GetFilter(), revertArgs)
+	if err != nil {
+		return err
+	}
+	if value != nil {
+		key, err := stream.Key(indexedValues)
+		if err != nil {
+			return fmt.Errorf("Stream %s: %s", stream.Stream.GetName(), err)
 		}
+		commands.revertStreamValue(key, event, value)
 	}
 	return nil
 }
 
-type command struct {
-	Name string        `json:"n"`
-	Args []interface{} `json:"a"`
+// Event is an entry kept in the persisted log of a stream, TxHash is empty
+// for block streams, CellIndex is the index of the cell in the outputs or
+// inputs of the transaction for cell streams.
+type Event struct {
+	BlockNumber uint64 `json:"block_number"`
+	BlockHash   []byte `json:"block_hash"`
+	TxHash      []byte `json:"tx_hash,omitempty"`
+	CellIndex   uint64 `json:"cell_index"`
+	Revert      bool   `json:"revert,omitempty"`
+	// Value is the serialized ast.Value returned by the stream filter
+	Value []byte `json:"value"`
 }
 
 type commandBuffer struct {
-	commands       []command
-	revertCommands []command
+	commands       []store.Command
+	revertCommands []store.Command
 	// Those are kept separated since they will be reversed.
-	streamRevertCommands []command
-	revertKey            string
-	err                  error
+	streamRevertCommands []store.Command
+	// Commands only applied once current block reaches the confirmation
+	// depth used as key.
+	deferred  map[uint64]*commandBuffer
+	revertKey string
+	err       error
+}
+
+// revertibleCommands is what gets persisted for deferred commands.
+type revertibleCommands struct {
+	Commands       []store.Command `json:"c"`
+	RevertCommands []store.Command `json:"r"`
 }
 
-func (c *commandBuffer) do(commandName string, args ...interface{}) {
+func (c *commandBuffer) confirmed(depth uint64) *commandBuffer {
+	if depth == 0 {
+		return c
+	}
+	if c.deferred == nil {
+		c.deferred = make(map[uint64]*commandBuffer)
+	}
+	if c.deferred[depth] == nil {
+		c.deferred[depth] = &commandBuffer{}
+	}
+	return c.deferred[depth]
+}
+
+func (c *commandBuffer) deferredDepths() []uint64 {
+	depthSet := make(map[uint64]bool)
+	for depth := range c.deferred {
+		depthSet[depth] = true
+	}
+	return sortedDepths(depthSet)
+}
+
+// revertible keeps revert commands in the order they are replayed, which is
+// the reverse of the order commands are applied in, so a cell created and
+// consumed in the same block ends up removed.
+func (c *commandBuffer) revertible() revertibleCommands {
+	revertCommands := make([]store.Command, 0, len(c.revertCommands)+len(c.streamRevertCommands))
+	for i := len(c.revertCommands) - 1; i >= 0; i-- {
+		revertCommands = append(revertCommands, c.revertCommands[i])
+	}
+	for i := len(c.streamRevertCommands) - 1; i >= 0; i-- {
+		revertCommands = append(revertCommands, c.streamRevertCommands[i])
+	}
+	return revertibleCommands{
+		Commands:       c.commands,
+		RevertCommands: revertCommands,
+	}
+}
+
+func (c *commandBuffer) do(commandName string, key string, value []byte) {
 	if c.err != nil {
 		return
 	}
-	c.commands = append(c.commands, command{
-		Name: commandName,
-		Args: args,
+	c.commands = append(c.commands, store.Command{
+		Name:  commandName,
+		Key:   key,
+		Value: value,
 	})
 }
 
-func (c *commandBuffer) revertDo(commandName string, args ...interface{}) {
+func (c *commandBuffer) revertDo(commandName string, key string, value []byte) {
 	if c.err != nil {
 		return
 	}
-	c.revertCommands = append(c.revertCommands, command{
-		Name: commandName,
-		Args: args,
+	c.revertCommands = append(c.revertCommands, store.Command{
+		Name:  commandName,
+		Key:   key,
+		Value: value,
 	})
 }
 
-func (c *commandBuffer) streamRevertDo(commandName string, args ...interface{}) {
+func (c *commandBuffer) streamRevertDo(commandName string, key string, value []byte) {
 	if c.err != nil {
 		return
 	}
-	c.streamRevertCommands = append(c.streamRevertCommands, command{
-		Name: commandName,
-		Args: args,
+	c.streamRevertCommands = append(c.streamRevertCommands, store.Command{
+		Name:  commandName,
+		Key:   key,
+		Value: value,
 	})
 }
 
@@ -408,8 +1363,8 @@ func (c *commandBuffer) insert(key string, outPoint rpctypes.OutPoint) {
 	}
 	var buffer bytes.Buffer
 	c.err = outPoint.SerializeToCore(&buffer)
-	c.do("SADD", key, buffer.Bytes())
-	c.revertDo("SREM", key, buffer.Bytes())
+	c.do(store.CommandSetAdd, key, buffer.Bytes())
+	c.revertDo(store.CommandSetRemove, key, buffer.Bytes())
 }
 
 func (c *commandBuffer) remove(key string, outPoint rpctypes.OutPoint) {
@@ -418,58 +1373,126 @@ func (c *commandBuffer) remove(key string, outPoint rpctypes.OutPoint) {
 	}
 	var buffer bytes.Buffer
 	c.err = outPoint.SerializeToCore(&buffer)
-	c.do("SREM", key, buffer.Bytes())
-	c.revertDo("SADD", key, buffer.Bytes())
+	c.do(store.CommandSetRemove, key, buffer.Bytes())
+	c.revertDo(store.CommandSetAdd, key, buffer.Bytes())
+}
+
+// record adds a history entry of outPoint at blockNumber to key, see
+// ValueContext.HistoryKeys.
+func (c *commandBuffer) record(key string, outPoint rpctypes.OutPoint, blockNumber uint64) {
+	if c.err != nil {
+		return
+	}
+	var buffer bytes.Buffer
+	c.err = outPoint.SerializeToCore(&buffer)
+	if c.err != nil {
+		return
+	}
+	c.err = binary.Write(&buffer, binary.LittleEndian, blockNumber)
+	c.do(store.CommandSetAdd, key, buffer.Bytes())
+	c.revertDo(store.CommandSetRemove, key, buffer.Bytes())
+}
+
+func (c *commandBuffer) aggregate(key string, delta Aggregate) {
+	if c.err != nil {
+		return
+	}
+	var data, revertData []byte
+	data, c.err = json.Marshal(delta)
+	if c.err != nil {
+		return
+	}
+	revertData, c.err = json.Marshal(delta.negate())
+	c.do(commandAggregate, key, data)
+	c.revertDo(commandAggregate, key, revertData)
 }
 
-func (c *commandBuffer) streamValue(name string, value []byte) {
+func (c *commandBuffer) streamValue(key string, event Event, value []byte) {
 	if c.err != nil {
 		return
 	}
-	key := fmt.Sprintf("STREAM:%s", name)
-	c.do("PUBLISH", key, value)
+	event.Revert = false
+	event.Value = value
+	var data []byte
+	data, c.err = json.Marshal(event)
+	c.do(store.CommandPush, fmt.Sprintf("%s:EVENTS", key), data)
+	c.do(store.CommandPublish, key, value)
 }
 
-func (c *commandBuffer) revertStreamValue(name string, value []byte) {
+func (c *commandBuffer) revertStreamValue(key string, event Event, value []byte) {
 	if c.err != nil {
 		return
 	}
-	key := fmt.Sprintf("STREAM:%s", name)
-	c.streamRevertDo("PUBLISH", key, value)
+	event.Revert = true
+	event.Value = value
+	var data []byte
+	data, c.err = json.Marshal(event)
+	// Stream revert commands are reversed as a whole, hence the order
+	c.streamRevertDo(store.CommandPublish, key, value)
+	c.streamRevertDo(store.CommandPush, fmt.Sprintf("%s:EVENTS", key), data)
 }
 
-func (c *commandBuffer) execute(conn redis.Conn) error {
+func (c *commandBuffer) execute(s store.Store) error {
 	if c.err != nil {
 		return c.err
 	}
+	for _, deferred := range c.deferred {
+		if deferred.err != nil {
+			return deferred.err
+		}
+	}
 
 	if len(c.revertKey) == 0 {
 		return fmt.Errorf("Revert key is missing!")
 	}
+	data, err := encodeCommands(c.revertible().RevertCommands)
+	if err != nil {
+		return err
+	}
+
+	commands := make([]store.Command, len(c.commands), len(c.commands)+1)
+	copy(commands, c.commands)
+	commands = append(commands, store.Command{
+		Name:  store.CommandSet,
+		Key:   c.revertKey,
+		Value: data,
+	})
+	return s.Execute(commands)
+}
+
+func encodeCommands(v interface{}) ([]byte, error) {
 	var buf bytes.Buffer
 	gzipWriter := gzip.NewWriter(&buf)
 	encoder := json.NewEncoder(gzipWriter)
-	revertCommands := make([]command, len(c.revertCommands)+len(c.streamRevertCommands))
-	copy(revertCommands, c.revertCommands)
-	for i, c := range c.streamRevertCommands {
-		revertCommands[len(revertCommands)-1-i] = c
-	}
-	err := encoder.Encode(c.revertCommands)
+	err := encoder.Encode(v)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = gzipWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeCommands(data []byte, v interface{}) error {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
+	decoder := json.NewDecoder(gzipReader)
+	return decoder.Decode(v)
+}
 
-	conn.Send("MULTI")
-	for _, command := range c.commands {
-		conn.Send(command.Name, command.Args...)
+func sortedDepths(depthSet map[uint64]bool) []uint64 {
+	depths := make([]uint64, 0, len(depthSet))
+	for depth := range depthSet {
+		depths = append(depths, depth)
 	}
-	conn.Send("SET", c.revertKey, buf.Bytes())
-	_, err = conn.Do("EXEC")
-	return err
+	sort.Slice(depths, func(i, j int) bool {
+		return depths[i] < depths[j]
+	})
+	return depths
 }
 
 type indexingEnvironment struct {
@@ -517,9 +1540,17 @@ func (e *indexingEnvironment) QueryCell(query *ast.Value) ([]*ast.Value, error)
 	return nil, fmt.Errorf("QueryCell is not allowed in indexer!")
 }
 
+func (e *indexingEnvironment) QueryTransactions(query *ast.Value) ([]*ast.Value, error) {
+	return nil, fmt.Errorf("QueryTransactions is not allowed in indexer!")
+}
+
+func (e *indexingEnvironment) QueryAggregate(reduce *ast.Value) (*ast.Value, error) {
+	return nil, nil
+}
+
 func executeIndexingQuery(query *ast.Value, cell *ast.Value) (map[int]*ast.Value, error) {
-	if len(query.GetChildren()) != 1 {
-		return nil, fmt.Errorf("Invalid number of values to query cell: %d", len(query.GetChildren()))
+	if len(query.GetChildren()) == 0 {
+		return nil, fmt.Errorf("Query function is missing!")
 	}
 	environment := &indexingEnvironment{
 		cell:          cell,
@@ -539,7 +1570,8 @@ func executeIndexingQuery(query *ast.Value, cell *ast.Value) (map[int]*ast.Value
 }
 
 type streamExecutingEnvironment struct {
-	args []*ast.Value
+	args          []*ast.Value
+	indexedValues map[int]*ast.Value
 }
 
 func (e *streamExecutingEnvironment) ReplaceArgs(args []*ast.Value) error {
@@ -563,54 +1595,69 @@ func (e *streamExecutingEnvironment) Arg(i int) *ast.Value {
 	return e.args[i]
 }
 
+// Params used in stream filters are indexed the same way as in QUERY_CELLS,
+// the indexed values decide which subscribers receive the event.
 func (e *streamExecutingEnvironment) Param(i int) *ast.Value {
-	return nil
+	return &ast.Value{
+		T: ast.Value_PARAM,
+		Primitive: &ast.Value_U{
+			U: uint64(i),
+		},
+	}
 }
 
 func (e *streamExecutingEnvironment) IndexParam(i int, value *ast.Value) error {
-	return fmt.Errorf("Indexing param is not allowed!")
+	_, found := e.indexedValues[i]
+	if found {
+		return fmt.Errorf("Param %d is already indexed!", i)
+	}
+	e.indexedValues[i] = value
+	return nil
 }
 
 func (e *streamExecutingEnvironment) QueryCell(query *ast.Value) ([]*ast.Value, error) {
 	return nil, fmt.Errorf("Querying cell is not allowed!")
 }
 
-func executeStreamingFilter(filter *ast.Value, cell *ast.Value, insert bool, index bool) ([]byte, error) {
-	var t string
+func (e *streamExecutingEnvironment) QueryTransactions(query *ast.Value) ([]*ast.Value, error) {
+	return nil, fmt.Errorf("Querying transactions is not allowed!")
+}
+
+func (e *streamExecutingEnvironment) QueryAggregate(reduce *ast.Value) (*ast.Value, error) {
+	return nil, nil
+}
+
+func insertArg(insert bool) string {
 	if insert {
-		t = "insert"
-	} else {
-		t = "remove"
+		return "insert"
 	}
-	var i string
-	if index {
-		i = "index"
-	} else {
-		i = "revert"
+	return "remove"
+}
+
+func streamingArg(s string) *ast.Value {
+	return &ast.Value{
+		T: ast.Value_BYTES,
+		Primitive: &ast.Value_Raw{
+			Raw: []byte(s),
+		},
 	}
+}
+
+func executeStreamingFilter(filter *ast.Value, args []*ast.Value) ([]byte, map[int]*ast.Value, error) {
 	e := &streamExecutingEnvironment{
-		args: []*ast.Value{
-			cell,
-			&ast.Value{
-				T: ast.Value_BYTES,
-				Primitive: &ast.Value_Raw{
-					Raw: []byte(t),
-				},
-			},
-			&ast.Value{
-				T: ast.Value_BYTES,
-				Primitive: &ast.Value_Raw{
-					Raw: []byte(i),
-				},
-			},
-		},
+		args:          args,
+		indexedValues: make(map[int]*ast.Value),
 	}
 	value, err := executor.Execute(filter, e)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if value.GetT() == ast.Value_NIL {
-		return nil, nil
+		return nil, nil, nil
+	}
+	data, err := proto.Marshal(value)
+	if err != nil {
+		return nil, nil, err
 	}
-	return proto.Marshal(value)
+	return data, e.indexedValues, nil
 }
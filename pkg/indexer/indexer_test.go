@@ -0,0 +1,1840 @@
+package indexer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/xxuejie/animagus/pkg/ast"
+	"github.com/xxuejie/animagus/pkg/fakenode"
+	"github.com/xxuejie/animagus/pkg/rpctypes"
+	"github.com/xxuejie/animagus/pkg/store"
+	"github.com/xxuejie/animagus/pkg/verifier"
+)
+
+func fetchField(field ast.Value_Type, value *ast.Value) *ast.Value {
+	return &ast.Value{
+		T:        field,
+		Children: []*ast.Value{value},
+	}
+}
+
+func arg(i uint64) *ast.Value {
+	return &ast.Value{
+		T: ast.Value_ARG,
+		Primitive: &ast.Value_U{
+			U: i,
+		},
+	}
+}
+
+func param(i uint64) *ast.Value {
+	return &ast.Value{
+		T: ast.Value_PARAM,
+		Primitive: &ast.Value_U{
+			U: i,
+		},
+	}
+}
+
+func bytesValue(b []byte) *ast.Value {
+	return &ast.Value{
+		T: ast.Value_BYTES,
+		Primitive: &ast.Value_Raw{
+			Raw: b,
+		},
+	}
+}
+
+func equal(a *ast.Value, b *ast.Value) *ast.Value {
+	return &ast.Value{
+		T:        ast.Value_EQUAL,
+		Children: []*ast.Value{a, b},
+	}
+}
+
+// cellsByLockArgs queries all cells whose lock args equal param 0
+func cellsByLockArgs() *ast.Value {
+	return &ast.Value{
+		T: ast.Value_QUERY_CELLS,
+		Children: []*ast.Value{
+			equal(fetchField(ast.Value_GET_ARGS, fetchField(ast.Value_GET_LOCK, arg(0))), param(0)),
+		},
+	}
+}
+
+// cellCapacities streams capacities of all cells touched
+func cellCapacities() *ast.Value {
+	return fetchField(ast.Value_GET_CAPACITY, arg(0))
+}
+
+func testHash(seed byte, number uint64) (h rpctypes.Hash) {
+	h[0] = seed
+	h[1] = byte(number)
+	h[2] = byte(number >> 8)
+	return
+}
+
+func testCell(capacity uint64, lockArgs byte) rpctypes.CellOutput {
+	return rpctypes.CellOutput{
+		Capacity: rpctypes.Uint64(capacity),
+		Lock: rpctypes.Script{
+			HashType: rpctypes.Type,
+			Args:     rpctypes.Bytes{lockArgs},
+		},
+	}
+}
+
+type testInput struct {
+	outPoint rpctypes.OutPoint
+	cell     rpctypes.CellOutput
+}
+
+// testBlock builds a block containing a single transaction spending inputs
+// (already resolved) and creating outputs.
+func testBlock(number uint64, parentHash rpctypes.Hash, seed byte, inputs []testInput, outputs []rpctypes.CellOutput) rpctypes.BlockView {
+	tx := rpctypes.TransactionView{
+		Hash: testHash(seed+0x80, number),
+	}
+	for _, input := range inputs {
+		cell := input.cell
+		data := rpctypes.Raw{}
+		outPoint := input.outPoint
+		outPoint.Cell = &cell
+		outPoint.CellData = &data
+		tx.Inputs = append(tx.Inputs, rpctypes.CellInput{
+			PreviousOutput: outPoint,
+		})
+	}
+	for _, output := range outputs {
+		tx.Outputs = append(tx.Outputs, output)
+		tx.OutputsData = append(tx.OutputsData, rpctypes.Bytes{})
+	}
+	var block rpctypes.BlockView
+	block.Header.Number = rpctypes.Uint64(number)
+	block.Header.Hash = testHash(seed, number)
+	block.Header.ParentHash = parentHash
+	block.Header.Nonce = rpctypes.Uint128{V: big.NewInt(0)}
+	block.Transactions = []rpctypes.TransactionView{tx}
+	return block
+}
+
+func newTestIndexer(t *testing.T, s store.Store) *Indexer {
+	return newTestIndexerWithConfirmations(t, s, 0)
+}
+
+func newTestIndexerWithConfirmations(t *testing.T, s store.Store, confirmations uint64) *Indexer {
+	context, err := NewValueContext(&ast.Call{
+		Name:          "cells",
+		Result:        cellsByLockArgs(),
+		Confirmations: confirmations,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Indexer{
+		values: []ValueContext{context},
+		synced: map[string]bool{
+			string(context.QueryHashes[0]): true,
+		},
+		streams: []StreamContext{
+			NewStreamContext(&ast.Stream{
+				Name:   "capacities",
+				Filter: cellCapacities(),
+			}),
+		},
+		store: aggregatingStore{s},
+	}
+}
+
+func assertIndexedCells(t *testing.T, s store.Store, i *Indexer, lockArgs byte, expected ...rpctypes.OutPoint) {
+	assertValueCells(t, s, i.values[0], lockArgs, expected...)
+}
+
+func assertValueCells(t *testing.T, s store.Store, valueContext ValueContext, lockArgs byte, expected ...rpctypes.OutPoint) {
+	key, err := valueContext.IndexKey(0, map[int]*ast.Value{
+		0: bytesValue([]byte{lockArgs}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, err := s.Members(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != len(expected) {
+		t.Fatalf("Invalid number of cells for lock args %x: %d, expected: %d", lockArgs, len(members), len(expected))
+	}
+	for _, outPoint := range expected {
+		var buffer bytes.Buffer
+		err = outPoint.SerializeToCore(&buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, member := range members {
+			if bytes.Equal(member, buffer.Bytes()) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Out point %x:%d is not indexed!", outPoint.TxHash, outPoint.Index)
+		}
+	}
+}
+
+func assertStreamedCapacity(t *testing.T, subscription store.Subscription, expected uint64) {
+	data, err := subscription.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := &ast.Value{}
+	err = proto.Unmarshal(data, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.GetU() != expected {
+		t.Errorf("Invalid streamed capacity: %d, expected: %d", value.GetU(), expected)
+	}
+}
+
+func assertCellCount(t *testing.T, s store.Store, valueContext ValueContext, expected int64) {
+	data, err := s.Get(valueContext.CellsKey(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells, err := ParseAggregate(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cells.Count != expected {
+		t.Errorf("Invalid number of cells: %d, expected: %d", cells.Count, expected)
+	}
+}
+
+func indexTestBlock(t *testing.T, i *Indexer, block rpctypes.BlockView) {
+	commands := &commandBuffer{}
+	err := i.indexBlock(block, commands)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = commands.execute(i.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexAndRevertBlocks(t *testing.T) {
+	s := store.NewMemoryStore()
+	i := newTestIndexer(t, s)
+	subscription, err := s.Subscribe("STREAM:capacities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+
+	block0 := testBlock(0, rpctypes.Hash{}, 1, nil, []rpctypes.CellOutput{
+		testCell(100, 1),
+		testCell(200, 2),
+	})
+	indexTestBlock(t, i, block0)
+	cellA := rpctypes.OutPoint{TxHash: block0.Transactions[0].Hash, Index: 0}
+	cellB := rpctypes.OutPoint{TxHash: block0.Transactions[0].Hash, Index: 1}
+	assertIndexedCells(t, s, i, 1, cellA)
+	assertIndexedCells(t, s, i, 2, cellB)
+	assertStreamedCapacity(t, subscription, 100)
+	assertStreamedCapacity(t, subscription, 200)
+
+	block1 := testBlock(1, block0.Header.Hash, 1, []testInput{
+		testInput{outPoint: cellA, cell: testCell(100, 1)},
+	}, []rpctypes.CellOutput{
+		testCell(60, 1),
+		testCell(40, 2),
+	})
+	indexTestBlock(t, i, block1)
+	cellC := rpctypes.OutPoint{TxHash: block1.Transactions[0].Hash, Index: 0}
+	cellD := rpctypes.OutPoint{TxHash: block1.Transactions[0].Hash, Index: 1}
+	assertIndexedCells(t, s, i, 1, cellC)
+	assertIndexedCells(t, s, i, 2, cellB, cellD)
+	assertCellCount(t, s, i.values[0], 3)
+	assertStreamedCapacity(t, subscription, 100)
+	assertStreamedCapacity(t, subscription, 60)
+	assertStreamedCapacity(t, subscription, 40)
+
+	err = i.revertBlock(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIndexedCells(t, s, i, 1, cellA)
+	assertIndexedCells(t, s, i, 2, cellB)
+	assertCellCount(t, s, i.values[0], 2)
+	// Reverted values are streamed again so clients can undo them
+	assertStreamedCapacity(t, subscription, 40)
+	assertStreamedCapacity(t, subscription, 60)
+	assertStreamedCapacity(t, subscription, 100)
+
+	lastBlock, err := s.Get("LAST_BLOCK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(lastBlock[8:], block0.Header.Hash[:]) {
+		t.Errorf("Invalid last block after revert: %x", lastBlock)
+	}
+	for _, outPoint := range []rpctypes.OutPoint{cellA, cellB} {
+		cell, err := s.Get(cellKey(outPoint))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cell == nil {
+			t.Errorf("Live cell %x:%d is missing after revert", outPoint.TxHash, outPoint.Index)
+		}
+	}
+	revertCommands, err := s.Get("BLOCK:1:REVERT_COMMANDS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revertCommands != nil {
+		t.Errorf("Revert commands of block 1 are not cleared!")
+	}
+	reorg, err := s.Get("REORG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reorg == nil {
+		t.Errorf("Reorg should be marked after reverting a block")
+	}
+	createdKey, consumedKey, err := i.values[0].HistoryKeys(0, map[int]*ast.Value{
+		0: bytesValue([]byte{1}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]int{createdKey: 1, consumedKey: 0} {
+		count, err := s.Count(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != uint64(expected) {
+			t.Errorf("Invalid history records in %s: %d, expected: %d", key, count, expected)
+		}
+	}
+
+	indexTestBlock(t, i, block1)
+	reorg, err = s.Get("REORG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reorg != nil {
+		t.Errorf("Reorg should be cleared once a block is indexed")
+	}
+}
+
+func testTransaction(inputs []rpctypes.OutPoint, outputs ...rpctypes.CellOutput) rpctypes.Transaction {
+	tx := rpctypes.Transaction{}
+	for _, input := range inputs {
+		tx.Inputs = append(tx.Inputs, rpctypes.CellInput{
+			PreviousOutput: input,
+		})
+	}
+	for _, output := range outputs {
+		tx.Outputs = append(tx.Outputs, output)
+		tx.OutputsData = append(tx.OutputsData, rpctypes.Bytes{})
+	}
+	return tx
+}
+
+func mine(t *testing.T, n *fakenode.Node, transactions ...rpctypes.Transaction) rpctypes.BlockView {
+	block, err := n.Mine(transactions...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func startTestIndexer(t *testing.T, s store.Store, n *fakenode.Node, options Options, streams ...*ast.Stream) (*Indexer, chan error) {
+	root := &ast.Root{
+		Calls: []*ast.Call{
+			&ast.Call{
+				Name:   "cells",
+				Result: cellsByLockArgs(),
+			},
+		},
+		Streams: streams,
+	}
+	content, err := proto.Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startTestIndexerFiles(t, s, n, options, []ASTFile{ASTFile{Content: content}})
+}
+
+func startTestIndexerFiles(t *testing.T, s store.Store, n *fakenode.Node, options Options, files []ASTFile) (*Indexer, chan error) {
+	i, err := NewIndexer(files, s, n.URL(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.pollInterval = 10 * time.Millisecond
+	result := make(chan error, 1)
+	go func() {
+		result <- i.Run()
+	}()
+	return i, result
+}
+
+func waitForBlock(t *testing.T, s store.Store, block rpctypes.BlockView, result chan error) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-result:
+			t.Fatalf("Indexer stopped: %v", err)
+		default:
+		}
+		lastBlock, err := s.Get("LAST_BLOCK")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lastBlock) == 40 && bytes.Equal(lastBlock[8:], block.Header.Hash[:]) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timeout waiting for block %d", block.Header.Number)
+}
+
+func assertTransactionRecords(t *testing.T, s store.Store, valueContext ValueContext, lockArgs byte, expected ...rpctypes.BlockView) {
+	key, err := valueContext.IndexKey(0, map[int]*ast.Value{
+		0: bytesValue([]byte{lockArgs}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, err := s.RangeSorted(key, nil, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != len(expected) {
+		t.Fatalf("Invalid number of transactions for lock args %x: %d, expected: %d", lockArgs, len(members), len(expected))
+	}
+	// Records are kept in chain order
+	for i, block := range expected {
+		record := TransactionRecord{
+			BlockNumber: uint64(block.Header.Number),
+			TxHash:      block.Transactions[0].Hash,
+		}
+		if !bytes.Equal(members[i], record.Serialize()) {
+			t.Errorf("Transaction %x is missing for lock args %x", record.TxHash, lockArgs)
+		}
+	}
+}
+
+func TestIndexTransactions(t *testing.T) {
+	s := store.NewMemoryStore()
+	context, err := NewValueContext(&ast.Call{
+		Name: "transactions",
+		Result: &ast.Value{
+			T:        ast.Value_QUERY_TRANSACTIONS,
+			Children: cellsByLockArgs().GetChildren(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &Indexer{
+		values: []ValueContext{context},
+		synced: map[string]bool{
+			string(context.QueryHashes[0]): true,
+		},
+		store: s,
+	}
+
+	block0 := testBlock(0, rpctypes.Hash{}, 1, nil, []rpctypes.CellOutput{
+		testCell(100, 1),
+		testCell(200, 2),
+	})
+	indexTestBlock(t, i, block0)
+	cellA := rpctypes.OutPoint{TxHash: block0.Transactions[0].Hash, Index: 0}
+	block1 := testBlock(1, block0.Header.Hash, 1, []testInput{
+		testInput{outPoint: cellA, cell: testCell(100, 1)},
+	}, []rpctypes.CellOutput{
+		testCell(100, 3),
+	})
+	indexTestBlock(t, i, block1)
+	assertTransactionRecords(t, s, context, 1, block0, block1)
+	assertTransactionRecords(t, s, context, 2, block0)
+	assertTransactionRecords(t, s, context, 3, block1)
+
+	err = i.revertBlock(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTransactionRecords(t, s, context, 1, block0)
+	assertTransactionRecords(t, s, context, 2, block0)
+	assertTransactionRecords(t, s, context, 3)
+}
+
+// balanceByLockArgs sums up capacities of cells in cellsByLockArgs
+func balanceByLockArgs() *ast.Value {
+	return &ast.Value{
+		T: ast.Value_REDUCE,
+		Children: []*ast.Value{
+			&ast.Value{
+				T:        ast.Value_ADD,
+				Children: []*ast.Value{arg(0), arg(1)},
+			},
+			&ast.Value{
+				T:         ast.Value_UINT64,
+				Primitive: &ast.Value_U{U: 0},
+			},
+			&ast.Value{
+				T:        ast.Value_MAP,
+				Children: []*ast.Value{cellCapacities(), cellsByLockArgs()},
+			},
+		},
+	}
+}
+
+func assertAggregate(t *testing.T, s store.Store, valueContext ValueContext, lockArgs byte, count int64, sum int64) {
+	key, err := valueContext.IndexKey(0, map[int]*ast.Value{
+		0: bytesValue([]byte{lockArgs}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := s.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aggregate, err := ParseAggregate(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aggregate.Count != count || aggregate.Sum.Int64() != sum || aggregate.Errors != 0 || aggregate.Bytes != 0 {
+		t.Errorf("Invalid aggregate of lock args %d: %v, expected count: %d, sum: %d", lockArgs, aggregate, count, sum)
+	}
+}
+
+func TestIndexAggregates(t *testing.T) {
+	s := store.NewMemoryStore()
+	context, err := NewValueContext(&ast.Call{
+		Name:   "balance",
+		Result: balanceByLockArgs(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cells are still queried for historical calls
+	if len(context.Queries) != 2 || context.Queries[0].GetT() != ast.Value_REDUCE ||
+		context.Queries[1].GetT() != ast.Value_QUERY_CELLS {
+		t.Fatalf("Invalid queries: %v", context.Queries)
+	}
+	i := &Indexer{
+		values: []ValueContext{context},
+		synced: map[string]bool{
+			string(context.QueryHashes[0]): true,
+			string(context.QueryHashes[1]): true,
+		},
+		store: aggregatingStore{s},
+	}
+
+	block0 := testBlock(0, rpctypes.Hash{}, 1, nil, []rpctypes.CellOutput{
+		testCell(100, 1),
+		testCell(200, 1),
+		testCell(300, 2),
+	})
+	indexTestBlock(t, i, block0)
+	assertAggregate(t, s, context, 1, 2, 300)
+	assertAggregate(t, s, context, 2, 1, 300)
+
+	cellA := rpctypes.OutPoint{TxHash: block0.Transactions[0].Hash, Index: 0}
+	cellC := rpctypes.OutPoint{TxHash: block0.Transactions[0].Hash, Index: 2}
+	block1 := testBlock(1, block0.Header.Hash, 1, []testInput{
+		testInput{outPoint: cellA, cell: testCell(100, 1)},
+		testInput{outPoint: cellC, cell: testCell(300, 2)},
+	}, []rpctypes.CellOutput{
+		testCell(400, 1),
+	})
+	indexTestBlock(t, i, block1)
+	assertAggregate(t, s, context, 1, 2, 600)
+	assertAggregate(t, s, context, 2, 0, 0)
+
+	err = i.revertBlock(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAggregate(t, s, context, 1, 2, 300)
+	assertAggregate(t, s, context, 2, 1, 300)
+
+	// Functions depending on params cannot be aggregated
+	context, err = NewValueContext(&ast.Call{
+		Name: "balance",
+		Result: &ast.Value{
+			T: ast.Value_REDUCE,
+			Children: []*ast.Value{
+				balanceByLockArgs().GetChildren()[0],
+				balanceByLockArgs().GetChildren()[1],
+				&ast.Value{
+					T:        ast.Value_MAP,
+					Children: []*ast.Value{equal(cellCapacities(), param(1)), cellsByLockArgs()},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(context.Queries) != 1 || context.Queries[0].GetT() != ast.Value_QUERY_CELLS {
+		t.Errorf("Invalid queries: %v", context.Queries)
+	}
+}
+
+func TestStoreVersion(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	genesis := mine(t, n, testTransaction(nil, testCell(100, 1)))
+
+	s := store.NewMemoryStore()
+	i, result := startTestIndexer(t, s, n, Options{})
+	waitForBlock(t, s, genesis, result)
+	i.Stop()
+	err := <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := s.Get("STORE_VERSION")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 8 || binary.LittleEndian.Uint64(data) != StoreVersion {
+		t.Fatalf("Invalid store version: %x", data)
+	}
+
+	// Stores laid out differently are refused
+	for _, command := range []store.Command{
+		store.Command{Name: store.CommandSet, Key: "STORE_VERSION", Value: []byte{0, 0, 0, 0, 0, 0, 0, 0}},
+		store.Command{Name: store.CommandDelete, Key: "STORE_VERSION"},
+	} {
+		err = s.Execute([]store.Command{command})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, result = startTestIndexer(t, s, n, Options{})
+		err = <-result
+		if err == nil || !strings.Contains(err.Error(), "re-indexing from scratch is required") {
+			t.Errorf("Store with invalid version is indexed, got: %v", err)
+		}
+	}
+}
+
+func TestRunWithReorg(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	genesis := mine(t, n, testTransaction(nil, testCell(100, 1), testCell(200, 2)))
+	cellA := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 0}
+	cellB := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 1}
+	block1 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellA}, testCell(60, 1)))
+	cellC := rpctypes.OutPoint{TxHash: block1.Transactions[0].Hash, Index: 0}
+	// Cell E is created and consumed in the same block
+	tx1 := testTransaction(nil, testCell(70, 1))
+	hash, err := rpctypes.CalculateHash(tx1.RawTransaction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cellE := rpctypes.OutPoint{Index: 0}
+	copy(cellE.TxHash[:], hash)
+	block2 := mine(t, n, tx1, testTransaction([]rpctypes.OutPoint{cellE}, testCell(70, 2)))
+	cellF := rpctypes.OutPoint{TxHash: block2.Transactions[1].Hash, Index: 0}
+
+	s := store.NewMemoryStore()
+	i, result := startTestIndexer(t, s, n, Options{})
+	waitForBlock(t, s, block2, result)
+	assertIndexedCells(t, s, i, 1, cellC)
+	assertIndexedCells(t, s, i, 2, cellB, cellF)
+
+	err = n.Rollback(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fork1 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellB}, testCell(150, 1)))
+	cellD := rpctypes.OutPoint{TxHash: fork1.Transactions[0].Hash, Index: 0}
+	mine(t, n)
+	fork3 := mine(t, n)
+	waitForBlock(t, s, fork3, result)
+	assertIndexedCells(t, s, i, 1, cellA, cellD)
+	assertIndexedCells(t, s, i, 2)
+	for _, outPoint := range []rpctypes.OutPoint{cellC, cellE, cellF} {
+		cell, err := s.Get(cellKey(outPoint))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cell != nil {
+			t.Errorf("Reverted cell %x:%d is still kept!", outPoint.TxHash, outPoint.Index)
+		}
+	}
+
+	i.Stop()
+	err = <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveInputsLocally(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	genesis := mine(t, n, testTransaction(nil, testCell(100, 1), testCell(200, 2)))
+	cellA := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 0}
+	cellB := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 1}
+	block1 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellA}, testCell(60, 1)))
+	cellC := rpctypes.OutPoint{TxHash: block1.Transactions[0].Hash, Index: 0}
+
+	s := store.NewMemoryStore()
+	i, result := startTestIndexer(t, s, n, Options{})
+	waitForBlock(t, s, block1, result)
+	assertIndexedCells(t, s, i, 1, cellC)
+	if calls := n.Calls("get_transaction"); calls != 0 {
+		t.Errorf("Cells are resolved with %d RPC calls", calls)
+	}
+	cell, err := s.Get(cellKey(cellA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cell != nil {
+		t.Errorf("Spent cell is still kept!")
+	}
+
+	// Cells missing locally, e.g. created before indexing started, are
+	// fetched from CKB
+	err = s.Execute([]store.Command{
+		store.Command{Name: store.CommandDelete, Key: cellKey(cellB)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	block2 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellB, cellC}, testCell(260, 2)))
+	cellD := rpctypes.OutPoint{TxHash: block2.Transactions[0].Hash, Index: 0}
+	waitForBlock(t, s, block2, result)
+	assertIndexedCells(t, s, i, 1)
+	assertIndexedCells(t, s, i, 2, cellD)
+	if calls := n.Calls("get_transaction"); calls != 1 {
+		t.Errorf("Expected 1 RPC call to resolve cells, got %d", calls)
+	}
+
+	i.Stop()
+	err = <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Inputs unknown to CKB fail indexing the block
+	unknown := rpctypes.OutPoint{TxHash: testHash(9, 9), Index: 0}
+	block3 := rpctypes.BlockView{
+		Transactions: []rpctypes.TransactionView{
+			rpctypes.TransactionView{
+				Transaction: testTransaction([]rpctypes.OutPoint{unknown}, testCell(100, 1)),
+				Hash:        testHash(9, 3),
+			},
+		},
+	}
+	err = i.resolveInputs(&block3)
+	if err == nil || !strings.Contains(err.Error(), "cannot be found") {
+		t.Errorf("Resolving unknown inputs should fail, got: %v", err)
+	}
+}
+
+func TestCellHeaders(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	genesis := mine(t, n, testTransaction(nil, testCell(100, 1)))
+	cellA := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 0}
+	mine(t, n)
+	block2 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellA}, testCell(60, 1)))
+
+	s := store.NewMemoryStore()
+	// Streams number of the block creating each cell
+	i, result := startTestIndexer(t, s, n, Options{}, &ast.Stream{
+		Name:   "numbers",
+		Filter: fetchField(ast.Value_GET_NUMBER, fetchField(ast.Value_GET_HEADER, arg(0))),
+	})
+	waitForBlock(t, s, block2, result)
+	i.Stop()
+	err := <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := s.Range("STREAM:numbers:EVENTS", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []uint64{0, 0, 2}
+	if len(events) != len(expected) {
+		t.Fatalf("Invalid number of events: %d, expected: %d", len(events), len(expected))
+	}
+	for k, data := range events {
+		var event Event
+		err = json.Unmarshal(data, &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value := &ast.Value{}
+		err = proto.Unmarshal(event.Value, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value.GetU() != expected[k] {
+			t.Errorf("Invalid block number of event %d: %d, expected: %d", k, value.GetU(), expected[k])
+		}
+	}
+	if calls := n.Calls("get_header"); calls != 0 {
+		t.Errorf("Headers are resolved with %d RPC calls", calls)
+	}
+}
+
+func TestStartBlock(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	genesis := mine(t, n, testTransaction(nil, testCell(100, 1), testCell(200, 2)))
+	cellA := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 0}
+	block1 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellA}, testCell(60, 1)))
+	cellC := rpctypes.OutPoint{TxHash: block1.Transactions[0].Hash, Index: 0}
+
+	s := store.NewMemoryStore()
+	i, result := startTestIndexer(t, s, n, Options{StartBlock: 1})
+	waitForBlock(t, s, block1, result)
+	// Cells of skipped blocks are not indexed, but can still be consumed
+	assertIndexedCells(t, s, i, 1, cellC)
+	assertIndexedCells(t, s, i, 2)
+
+	i.Stop()
+	err := <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Neither skipped blocks nor the start block can be reverted
+	for _, blockNumber := range []uint64{0, 1} {
+		err = i.revertBlock(blockNumber)
+		if err == nil || !strings.Contains(err.Error(), "cannot be reverted") {
+			t.Errorf("Reverting block %d should fail, got: %v", blockNumber, err)
+		}
+	}
+	assertIndexedCells(t, s, i, 1, cellC)
+	assertIndexedCells(t, s, i, 2)
+}
+
+func TestCheckpoint(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	genesis := mine(t, n, testTransaction(nil, testCell(100, 1), testCell(200, 2)))
+	cellA := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 0}
+	cellB := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 1}
+	block1 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellA}, testCell(60, 1)))
+	cellC := rpctypes.OutPoint{TxHash: block1.Transactions[0].Hash, Index: 0}
+	block2 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellC}, testCell(50, 2)))
+	cellD := rpctypes.OutPoint{TxHash: block2.Transactions[0].Hash, Index: 0}
+
+	checkpoint := &Checkpoint{
+		Header: block1.Header,
+		Cells: []CheckpointCell{
+			CheckpointCell{OutPoint: cellB, Cell: testCell(200, 2), Data: rpctypes.Raw{}, BlockHash: genesis.Header.Hash},
+			CheckpointCell{OutPoint: cellC, Cell: testCell(60, 1), Data: rpctypes.Raw{}, BlockHash: block1.Header.Hash},
+		},
+	}
+	s := store.NewMemoryStore()
+	i, result := startTestIndexer(t, s, n, Options{Checkpoint: checkpoint})
+	waitForBlock(t, s, block2, result)
+	assertIndexedCells(t, s, i, 1)
+	assertIndexedCells(t, s, i, 2, cellB, cellD)
+	if calls := n.Calls("get_transaction"); calls != 0 {
+		t.Errorf("Cells are resolved with %d RPC calls", calls)
+	}
+	// Only the header of genesis block is missing in the checkpoint
+	if calls := n.Calls("get_header"); calls != 1 {
+		t.Errorf("Expected 1 RPC call to fetch headers, got %d", calls)
+	}
+
+	i.Stop()
+	err := <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = i.revertBlock(1)
+	if err == nil || !strings.Contains(err.Error(), "cannot be reverted") {
+		t.Errorf("Reverting the checkpoint block should fail, got: %v", err)
+	}
+	assertIndexedCells(t, s, i, 2, cellB, cellD)
+}
+
+// interruptedStore fails all commands after executing a number of batches.
+type interruptedStore struct {
+	store.Store
+	batches int
+}
+
+func (s *interruptedStore) Execute(commands []store.Command) error {
+	if s.batches == 0 {
+		return fmt.Errorf("Interrupted!")
+	}
+	s.batches--
+	return s.Store.Execute(commands)
+}
+
+func TestResumeCheckpoint(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	genesis := mine(t, n, testTransaction(nil, testCell(100, 1), testCell(200, 2), testCell(300, 1)))
+	block1 := mine(t, n)
+	checkpoint := &Checkpoint{Header: block1.Header}
+	var cells []rpctypes.OutPoint
+	for index := range genesis.Transactions[0].Outputs {
+		outPoint := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: rpctypes.Uint32(index)}
+		cells = append(cells, outPoint)
+		checkpoint.Cells = append(checkpoint.Cells, CheckpointCell{
+			OutPoint:  outPoint,
+			Cell:      genesis.Transactions[0].Outputs[index],
+			Data:      rpctypes.Raw{},
+			BlockHash: genesis.Header.Hash,
+		})
+	}
+
+	// Marking the store version, writing 2 headers, marking queries and
+	// seeding the first cell succeed
+	root := &ast.Root{
+		Calls: []*ast.Call{
+			&ast.Call{
+				Name:   "cells",
+				Result: cellsByLockArgs(),
+			},
+		},
+	}
+	content, err := proto.Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.NewMemoryStore()
+	interrupted := &interruptedStore{Store: s, batches: 5}
+	i, err := NewIndexer([]ASTFile{ASTFile{Content: content}}, interrupted, n.URL(), Options{Checkpoint: checkpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.seedBatchSize = 1
+	err = i.Run()
+	if err == nil || !strings.Contains(err.Error(), "Interrupted") {
+		t.Fatalf("Seeding should be interrupted, got: %v", err)
+	}
+	assertIndexedCells(t, s, i, 1, cells[0])
+	lastBlock, err := s.Get("LAST_BLOCK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastBlock != nil {
+		t.Errorf("Interrupted seed sets last block!")
+	}
+
+	// Resuming requires the same checkpoint
+	other := *checkpoint
+	other.Header = genesis.Header
+	_, result := startTestIndexer(t, s, n, Options{Checkpoint: &other})
+	err = <-result
+	if err == nil || !strings.Contains(err.Error(), "the same checkpoint is required") {
+		t.Errorf("Resuming with another checkpoint should fail, got: %v", err)
+	}
+
+	i, result = startTestIndexer(t, s, n, Options{Checkpoint: checkpoint})
+	waitForBlock(t, s, block1, result)
+	assertIndexedCells(t, s, i, 1, cells[0], cells[2])
+	assertIndexedCells(t, s, i, 2, cells[1])
+	i.Stop()
+	err = <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress, err := s.Get("CHECKPOINT_SEEDING")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress != nil {
+		t.Errorf("Seeding progress is kept after seeding!")
+	}
+}
+
+func waitForSynced(t *testing.T, s store.Store, valueContext ValueContext, result chan error) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-result:
+			t.Fatalf("Indexer stopped: %v", err)
+		default:
+		}
+		synced, err := s.Get(valueContext.SyncedKey(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if synced != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timeout waiting for call %s to be synced", valueContext.Name)
+}
+
+func TestBackfillNewQuery(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	genesis := mine(t, n, testTransaction(nil, testCell(100, 1), testCell(200, 2)))
+	cellA := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 0}
+	cellB := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 1}
+	block1 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellA}, testCell(60, 1)))
+	cellC := rpctypes.OutPoint{TxHash: block1.Transactions[0].Hash, Index: 0}
+	block2 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellC}, testCell(50, 2)))
+	cellD := rpctypes.OutPoint{TxHash: block2.Transactions[0].Hash, Index: 0}
+
+	s := store.NewMemoryStore()
+	i, result := startTestIndexer(t, s, n, Options{})
+	waitForBlock(t, s, block2, result)
+	i.Stop()
+	err := <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same query requiring 1 confirmation lives in a new namespace
+	root := &ast.Root{
+		Calls: []*ast.Call{
+			&ast.Call{
+				Name:   "cells",
+				Result: cellsByLockArgs(),
+			},
+			&ast.Call{
+				Name:          "confirmedCells",
+				Result:        cellsByLockArgs(),
+				Confirmations: 1,
+			},
+		},
+	}
+	content, err := proto.Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err = NewIndexer([]ASTFile{ASTFile{Content: content}}, s, n.URL(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.pollInterval = 10 * time.Millisecond
+	result = make(chan error, 1)
+	go func() {
+		result <- i.Run()
+	}()
+	waitForSynced(t, s, i.values[1], result)
+	assertValueCells(t, s, i.values[0], 1)
+	assertValueCells(t, s, i.values[0], 2, cellB, cellD)
+	assertValueCells(t, s, i.values[1], 1, cellC)
+	assertValueCells(t, s, i.values[1], 2, cellB)
+
+	// Back-filled blocks are reverted in reorgs
+	err = n.Rollback(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fork2 := mine(t, n)
+	fork3 := mine(t, n)
+	waitForBlock(t, s, fork3, result)
+	assertValueCells(t, s, i.values[0], 1, cellC)
+	assertValueCells(t, s, i.values[0], 2, cellB)
+	assertValueCells(t, s, i.values[1], 1, cellC)
+	assertValueCells(t, s, i.values[1], 2, cellB)
+	if fork2.Header.Hash == block2.Header.Hash {
+		t.Fatalf("Fork is not created!")
+	}
+
+	i.Stop()
+	err = <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func marshalRoot(t *testing.T, calls ...*ast.Call) []ASTFile {
+	content, err := proto.Marshal(&ast.Root{Calls: calls})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []ASTFile{ASTFile{Content: content}}
+}
+
+func TestReload(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	genesis := mine(t, n, testTransaction(nil, testCell(100, 1), testCell(200, 2)))
+	cellA := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 0}
+	cellB := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 1}
+	block1 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellA}, testCell(60, 1)))
+	cellC := rpctypes.OutPoint{TxHash: block1.Transactions[0].Hash, Index: 0}
+
+	s := store.NewMemoryStore()
+	i, result := startTestIndexer(t, s, n, Options{})
+	waitForBlock(t, s, block1, result)
+	cells := i.values[0]
+
+	err := i.Reload(marshalRoot(t, &ast.Call{
+		Name:   "invalid",
+		Result: &ast.Value{T: ast.Value_UINT64},
+	}))
+	if err == nil {
+		t.Errorf("Invalid AST should be rejected")
+	}
+	i.mutex.Lock()
+	if len(i.values) != 1 || i.values[0].Name != "cells" {
+		t.Errorf("Current calls should be kept when reloading fails")
+	}
+	i.mutex.Unlock()
+
+	err = i.Reload(marshalRoot(t, &ast.Call{
+		Name:   "cells",
+		Result: cellsByLockArgs(),
+	}, &ast.Call{
+		Name:          "confirmedCells",
+		Result:        cellsByLockArgs(),
+		Confirmations: 1,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.mutex.Lock()
+	confirmedCells := i.values[1]
+	i.mutex.Unlock()
+	waitForSynced(t, s, confirmedCells, result)
+	assertValueCells(t, s, confirmedCells, 1, cellA)
+	assertValueCells(t, s, confirmedCells, 2, cellB)
+
+	block2 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellC}, testCell(50, 2)))
+	cellD := rpctypes.OutPoint{TxHash: block2.Transactions[0].Hash, Index: 0}
+	waitForBlock(t, s, block2, result)
+	assertValueCells(t, s, cells, 1)
+	assertValueCells(t, s, cells, 2, cellB, cellD)
+	assertValueCells(t, s, confirmedCells, 1, cellC)
+	assertValueCells(t, s, confirmedCells, 2, cellB)
+
+	i.Stop()
+	err = <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func scanKeys(t *testing.T, s store.Store, prefix string) []string {
+	var result []string
+	cursor := ""
+	for {
+		keys, next, err := s.ScanKeys(prefix, cursor, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, keys...)
+		if next == "" {
+			return result
+		}
+		cursor = next
+	}
+}
+
+// waitForPurged waits till data of dropped queries and confirmation depths
+// is removed in the background.
+func waitForPurged(t *testing.T, s store.Store, result chan error) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-result:
+			t.Fatalf("Indexer stopped: %v", err)
+		default:
+		}
+		queries, err := s.Count("DROPPED_QUERIES")
+		if err != nil {
+			t.Fatal(err)
+		}
+		depths, err := s.Count("DROPPED_DEPTHS")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if queries == 0 && depths == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timeout waiting for dropped queries to be removed")
+}
+
+// assertDropped checks nothing of the query is left in the store, including
+// commands kept for reverting or confirming blocks.
+func assertDropped(t *testing.T, s store.Store, valueContext ValueContext) {
+	prefix := fmt.Sprintf("QUERY:%x:", valueContext.QueryHashes[0])
+	keys := scanKeys(t, s, prefix)
+	if len(keys) > 0 {
+		t.Errorf("Keys of dropped call %s are left: %v", valueContext.Name, keys)
+	}
+	for _, key := range scanKeys(t, s, "BLOCK:") {
+		if strings.HasSuffix(key, ":HASH") {
+			continue
+		}
+		data, err := s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var commands []store.Command
+		if strings.Contains(key, ":DEFERRED:") {
+			var deferred revertibleCommands
+			err = decodeCommands(data, &deferred)
+			commands = append(deferred.Commands, deferred.RevertCommands...)
+		} else {
+			err = decodeCommands(data, &commands)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, command := range commands {
+			if strings.HasPrefix(command.Key, prefix) {
+				t.Errorf("Command of dropped call %s is left in %s: %s %s", valueContext.Name, key, command.Name, command.Key)
+			}
+		}
+	}
+}
+
+func TestReloadDroppedQuery(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	genesis := mine(t, n, testTransaction(nil, testCell(500, 1), testCell(300, 2)))
+	cellA := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 0}
+	cellB := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 1}
+	block1 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellA}, testCell(100, 1)))
+	cellC := rpctypes.OutPoint{TxHash: block1.Transactions[0].Hash, Index: 0}
+
+	cells := &ast.Call{
+		Name:   "cells",
+		Result: cellsByLockArgs(),
+	}
+	balance := &ast.Call{
+		Name:          "balance",
+		Result:        balanceByLockArgs(),
+		Confirmations: 2,
+	}
+	confirmedCells := &ast.Call{
+		Name:          "confirmedCells",
+		Result:        cellsByLockArgs(),
+		Confirmations: 2,
+	}
+	s := store.NewMemoryStore()
+	i, result := startTestIndexerFiles(t, s, n, Options{}, marshalRoot(t, cells, balance))
+	waitForBlock(t, s, block1, result)
+	i.mutex.Lock()
+	balanceContext := i.values[1]
+	// Blocks are purged in several batches
+	i.purgeBatchSize = 1
+	i.mutex.Unlock()
+	deferred, err := s.Get("BLOCK:1:DEFERRED:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deferred == nil {
+		t.Fatalf("Commands of block 1 should be deferred")
+	}
+
+	// No other value requires 2 confirmations, deferred commands are
+	// dropped together with the query
+	err = i.Reload(marshalRoot(t, cells))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForPurged(t, s, result)
+	assertDropped(t, s, balanceContext)
+	for _, key := range []string{"BLOCK:0:DEFERRED:2", "BLOCK:1:DEFERRED:2"} {
+		deferred, err = s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deferred != nil {
+			t.Errorf("Deferred commands of dropped confirmation depth are left at %s", key)
+		}
+	}
+
+	block2 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellB}, testCell(50, 2)))
+	waitForBlock(t, s, block2, result)
+
+	// Added back, the query is back-filled from scratch instead of being
+	// considered synced with blocks missing
+	err = i.Reload(marshalRoot(t, cells, balance, confirmedCells))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.mutex.Lock()
+	balanceContext = i.values[1]
+	confirmedCellsContext := i.values[2]
+	i.mutex.Unlock()
+	waitForSynced(t, s, balanceContext, result)
+	waitForSynced(t, s, confirmedCellsContext, result)
+	assertAggregate(t, s, balanceContext, 1, 1, 500)
+	assertAggregate(t, s, balanceContext, 2, 1, 300)
+
+	mine(t, n)
+	mine(t, n)
+	waitForBlock(t, s, mine(t, n), result)
+	assertAggregate(t, s, balanceContext, 1, 1, 100)
+	assertAggregate(t, s, balanceContext, 2, 1, 50)
+
+	// Reverting blocks indexed before the query is dropped must not revert
+	// it twice
+	err = n.Rollback(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j := 0; j < 4; j++ {
+		mine(t, n)
+	}
+	waitForBlock(t, s, mine(t, n), result)
+	assertAggregate(t, s, balanceContext, 1, 1, 100)
+	assertAggregate(t, s, balanceContext, 2, 1, 300)
+
+	// Depth 2 is still used by another query, only commands of the dropped
+	// one are removed
+	err = i.Reload(marshalRoot(t, cells, confirmedCells))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForPurged(t, s, result)
+	assertDropped(t, s, balanceContext)
+	block7 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellC}, testCell(70, 2)))
+	cellE := rpctypes.OutPoint{TxHash: block7.Transactions[0].Hash, Index: 0}
+	mine(t, n)
+	waitForBlock(t, s, mine(t, n), result)
+	assertValueCells(t, s, confirmedCellsContext, 1)
+	assertValueCells(t, s, confirmedCellsContext, 2, cellB, cellE)
+	assertDropped(t, s, balanceContext)
+
+	i.Stop()
+	err = <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Queries dropped while animagus is not running are removed on start
+	i, result = startTestIndexerFiles(t, s, n, Options{}, marshalRoot(t, cells))
+	waitForBlock(t, s, mine(t, n), result)
+	waitForPurged(t, s, result)
+	assertDropped(t, s, confirmedCellsContext)
+	queries, err := s.Members("QUERIES")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 1 {
+		t.Errorf("Invalid number of queries registered: %d, expected: 1", len(queries))
+	}
+	for _, key := range scanKeys(t, s, "BLOCK:") {
+		if strings.HasSuffix(key, ":2") {
+			t.Errorf("Data of dropped confirmation depth is left at %s", key)
+		}
+	}
+
+	i.Stop()
+	err = <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// registryFailingStore fails commands on registered queries while failing
+// is set.
+type registryFailingStore struct {
+	store.Store
+	failing int32
+}
+
+func (s *registryFailingStore) Execute(commands []store.Command) error {
+	if atomic.LoadInt32(&s.failing) != 0 {
+		for _, command := range commands {
+			if command.Key == "QUERIES" {
+				return fmt.Errorf("Registry is not writable!")
+			}
+		}
+	}
+	return s.Store.Execute(commands)
+}
+
+func TestReloadStoreFailure(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	genesis := mine(t, n, testTransaction(nil, testCell(500, 1), testCell(300, 2)))
+	cellA := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 0}
+	block1 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellA}, testCell(100, 1)))
+
+	cells := &ast.Call{
+		Name:   "cells",
+		Result: cellsByLockArgs(),
+	}
+	balance := &ast.Call{
+		Name:   "balance",
+		Result: balanceByLockArgs(),
+	}
+	confirmedCells := &ast.Call{
+		Name:          "confirmedCells",
+		Result:        cellsByLockArgs(),
+		Confirmations: 1,
+	}
+	s := &registryFailingStore{Store: store.NewMemoryStore()}
+	i, result := startTestIndexerFiles(t, s, n, Options{}, marshalRoot(t, cells, balance))
+	waitForBlock(t, s, block1, result)
+	i.mutex.Lock()
+	balanceContext := i.values[1]
+	i.mutex.Unlock()
+
+	// Neither dropping nor adding queries takes effect when the store
+	// cannot be updated
+	atomic.StoreInt32(&s.failing, 1)
+	for _, files := range [][]ASTFile{
+		marshalRoot(t, cells),
+		marshalRoot(t, cells, balance, confirmedCells),
+	} {
+		err := i.Reload(files)
+		if err == nil {
+			t.Errorf("Reloading should fail when the store cannot be updated")
+		}
+		i.mutex.Lock()
+		if len(i.values) != 2 || i.values[1].Name != "balance" {
+			t.Errorf("Current calls should be kept when reloading fails")
+		}
+		if !i.synced[string(balanceContext.QueryHashes[0])] || len(i.dropping) > 0 || len(i.backfilling) > 0 {
+			t.Errorf("Queries should be left as is when reloading fails")
+		}
+		i.mutex.Unlock()
+	}
+	dropped, err := s.Count("DROPPED_QUERIES")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 0 {
+		t.Errorf("No query should be dropped when reloading fails")
+	}
+	block2 := mine(t, n)
+	waitForBlock(t, s, block2, result)
+	assertAggregate(t, s, balanceContext, 1, 1, 100)
+
+	atomic.StoreInt32(&s.failing, 0)
+	err = i.Reload(marshalRoot(t, cells))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForPurged(t, s, result)
+	assertDropped(t, s, balanceContext)
+
+	i.Stop()
+	err = <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAggregateStartBlock(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	genesis := mine(t, n, testTransaction(nil, testCell(500, 1), testCell(300, 2)))
+	cellA := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 0}
+	cellB := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 1}
+	block1 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellA}, testCell(100, 1)))
+
+	s := store.NewMemoryStore()
+	i, result := startTestIndexerFiles(t, s, n, Options{StartBlock: 1}, marshalRoot(t, &ast.Call{
+		Name:   "balance",
+		Result: balanceByLockArgs(),
+	}))
+	waitForBlock(t, s, block1, result)
+	// Cells created before the start block are never added, consuming them
+	// must not change the aggregate either
+	balance := i.values[0]
+	assertAggregate(t, s, balance, 1, 1, 100)
+
+	block2 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellB}, testCell(50, 2)))
+	waitForBlock(t, s, block2, result)
+	assertAggregate(t, s, balance, 2, 1, 50)
+
+	i.Stop()
+	err := <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackfillAggregate(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	genesis := mine(t, n, testTransaction(nil, testCell(500, 1), testCell(300, 1)))
+	cellA := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 0}
+	cellB := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 1}
+	block1 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellB}, testCell(100, 1)))
+
+	s := store.NewMemoryStore()
+	i, result := startTestIndexer(t, s, n, Options{StartBlock: 1})
+	waitForBlock(t, s, block1, result)
+
+	// The aggregate is added after blocks are indexed, consuming cells older
+	// than the start block is skipped both when back-filling and afterwards
+	err := i.Reload(marshalRoot(t, &ast.Call{
+		Name:   "cells",
+		Result: cellsByLockArgs(),
+	}, &ast.Call{
+		Name:   "balance",
+		Result: balanceByLockArgs(),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.mutex.Lock()
+	balance := i.values[1]
+	i.mutex.Unlock()
+	waitForSynced(t, s, balance, result)
+	assertAggregate(t, s, balance, 1, 1, 100)
+
+	block2 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellA}, testCell(40, 1)))
+	waitForBlock(t, s, block2, result)
+	assertAggregate(t, s, balance, 1, 2, 140)
+
+	i.Stop()
+	err = <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInvalidAggregate(t *testing.T) {
+	s := aggregatingStore{store.NewMemoryStore()}
+	delta, err := json.Marshal(Aggregate{Count: 1, Sum: big.NewInt(500)}.negate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Execute([]store.Command{
+		store.Command{Name: commandAggregate, Key: "AGGREGATE", Value: delta},
+	})
+	if err == nil {
+		t.Errorf("Removing items never added should fail")
+	}
+}
+
+func TestRunWithPrefetching(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	genesis := mine(t, n, testTransaction(nil, testCell(100, 1), testCell(200, 2)))
+	cellA := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 0}
+	cellB := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 1}
+	block1 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellA}, testCell(60, 1)))
+	cellC := rpctypes.OutPoint{TxHash: block1.Transactions[0].Hash, Index: 0}
+	block2 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellC}, testCell(50, 2)))
+	cellD := rpctypes.OutPoint{TxHash: block2.Transactions[0].Hash, Index: 0}
+	tip := block2
+	for k := 0; k < 5; k++ {
+		tip = mine(t, n)
+	}
+
+	s := store.NewMemoryStore()
+	i, result := startTestIndexer(t, s, n, Options{PrefetchWindow: 4})
+	waitForBlock(t, s, tip, result)
+	assertIndexedCells(t, s, i, 1)
+	assertIndexedCells(t, s, i, 2, cellB, cellD)
+	// Blocks past the tip are not fetched while polling
+	calls := n.Calls("get_block_by_number")
+	time.Sleep(10 * i.pollInterval)
+	if extra := n.Calls("get_block_by_number") - calls; extra != 0 {
+		t.Errorf("Blocks past the tip are fetched %d times", extra)
+	}
+
+	err := n.Rollback(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fork2 := mine(t, n, testTransaction([]rpctypes.OutPoint{cellB}, testCell(150, 1)))
+	cellE := rpctypes.OutPoint{TxHash: fork2.Transactions[0].Hash, Index: 0}
+	for k := 0; k < 7; k++ {
+		tip = mine(t, n)
+	}
+	waitForBlock(t, s, tip, result)
+	assertIndexedCells(t, s, i, 1, cellC, cellE)
+	assertIndexedCells(t, s, i, 2)
+
+	i.Stop()
+	err = <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunWithEmptyChain(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+
+	// CKB reports no tip till genesis is mined, the indexer keeps polling
+	s := store.NewMemoryStore()
+	i, result := startTestIndexer(t, s, n, Options{PrefetchWindow: 4})
+	time.Sleep(10 * i.pollInterval)
+	if calls := n.Calls("get_block_by_number"); calls != 0 {
+		t.Errorf("Blocks of an empty chain are fetched %d times", calls)
+	}
+	genesis := mine(t, n, testTransaction(nil, testCell(100, 1)))
+	cellA := rpctypes.OutPoint{TxHash: genesis.Transactions[0].Hash, Index: 0}
+	waitForBlock(t, s, genesis, result)
+	assertIndexedCells(t, s, i, 1, cellA)
+
+	i.Stop()
+	err := <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveInputsConcurrently(t *testing.T) {
+	n := fakenode.NewNode()
+	defer n.Close()
+	// Cells of skipped blocks are fetched from CKB in multiple batches
+	var transactions []rpctypes.Transaction
+	for k := 0; k < 120; k++ {
+		transactions = append(transactions, testTransaction(nil, testCell(uint64(100+k), 1)))
+	}
+	genesis := mine(t, n, transactions...)
+	var inputs []rpctypes.OutPoint
+	for _, tx := range genesis.Transactions {
+		inputs = append(inputs, rpctypes.OutPoint{TxHash: tx.Hash, Index: 0})
+	}
+	block1 := mine(t, n, testTransaction(inputs, testCell(100, 2)))
+	cellA := rpctypes.OutPoint{TxHash: block1.Transactions[0].Hash, Index: 0}
+
+	s := store.NewMemoryStore()
+	i, result := startTestIndexer(t, s, n, Options{StartBlock: 1, PrefetchWindow: 2})
+	waitForBlock(t, s, block1, result)
+	assertIndexedCells(t, s, i, 1)
+	assertIndexedCells(t, s, i, 2, cellA)
+	if calls := n.Calls("get_transaction"); calls != 120 {
+		t.Errorf("Expected 120 RPC calls to resolve cells, got %d", calls)
+	}
+
+	i.Stop()
+	err := <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func firstOutputCapacity(tx *ast.Value) *ast.Value {
+	return fetchField(ast.Value_GET_CAPACITY, &ast.Value{
+		T: ast.Value_INDEX,
+		Children: []*ast.Value{
+			&ast.Value{
+				T:         ast.Value_UINT64,
+				Primitive: &ast.Value_U{U: 0},
+			},
+			fetchField(ast.Value_GET_OUTPUTS, tx),
+		},
+	})
+}
+
+func TestTransactionStream(t *testing.T) {
+	s := store.NewMemoryStore()
+	i := newTestIndexer(t, s)
+	// Streams capacity of the first output plus the block number
+	i.streams = []StreamContext{
+		NewStreamContext(&ast.Stream{
+			Name: "transactions",
+			Kind: ast.Stream_TRANSACTION,
+			Filter: &ast.Value{
+				T: ast.Value_ADD,
+				Children: []*ast.Value{
+					firstOutputCapacity(arg(0)),
+					fetchField(ast.Value_GET_NUMBER, arg(1)),
+				},
+			},
+		}),
+	}
+	subscription, err := s.Subscribe("STREAM:transactions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+
+	block0 := testBlock(0, rpctypes.Hash{}, 1, nil, []rpctypes.CellOutput{
+		testCell(100, 1),
+		testCell(200, 2),
+	})
+	indexTestBlock(t, i, block0)
+	assertStreamedCapacity(t, subscription, 100)
+
+	cellA := rpctypes.OutPoint{TxHash: block0.Transactions[0].Hash, Index: 0}
+	block1 := testBlock(1, block0.Header.Hash, 1, []testInput{
+		testInput{outPoint: cellA, cell: testCell(100, 1)},
+	}, []rpctypes.CellOutput{
+		testCell(60, 1),
+	})
+	indexTestBlock(t, i, block1)
+	assertStreamedCapacity(t, subscription, 61)
+
+	err = i.revertBlock(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStreamedCapacity(t, subscription, 61)
+}
+
+func TestBlockStream(t *testing.T) {
+	s := store.NewMemoryStore()
+	i := newTestIndexer(t, s)
+	// Streams the block number plus capacities of each transaction's first output
+	filter := &ast.Value{
+		T: ast.Value_REDUCE,
+		Children: []*ast.Value{
+			&ast.Value{
+				T:        ast.Value_ADD,
+				Children: []*ast.Value{arg(0), firstOutputCapacity(arg(1))},
+			},
+			fetchField(ast.Value_GET_NUMBER, arg(0)),
+			arg(1),
+		},
+	}
+	err := verifier.Verify(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.streams = []StreamContext{
+		NewStreamContext(&ast.Stream{
+			Name:   "blocks",
+			Kind:   ast.Stream_BLOCK,
+			Filter: filter,
+		}),
+	}
+	subscription, err := s.Subscribe("STREAM:blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+
+	block0 := testBlock(0, rpctypes.Hash{}, 1, nil, []rpctypes.CellOutput{
+		testCell(100, 1),
+	})
+	indexTestBlock(t, i, block0)
+	assertStreamedCapacity(t, subscription, 100)
+
+	block1 := testBlock(1, block0.Header.Hash, 1, nil, []rpctypes.CellOutput{
+		testCell(60, 1),
+	})
+	indexTestBlock(t, i, block1)
+	assertStreamedCapacity(t, subscription, 61)
+
+	err = i.revertBlock(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStreamedCapacity(t, subscription, 61)
+}
+
+func assertStreamLength(t *testing.T, s store.Store, key string, expected uint64) {
+	length, err := s.Length(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if length != expected {
+		t.Errorf("Invalid number of events in %s: %d, expected: %d", key, length, expected)
+	}
+}
+
+func TestConfirmations(t *testing.T) {
+	s := store.NewMemoryStore()
+	i := newTestIndexerWithConfirmations(t, s, 1)
+	i.streams[0].Stream.Confirmations = 1
+	eventsKey := "STREAM:capacities:EVENTS"
+
+	block0 := testBlock(0, rpctypes.Hash{}, 1, nil, []rpctypes.CellOutput{
+		testCell(100, 1),
+		testCell(200, 2),
+	})
+	indexTestBlock(t, i, block0)
+	cellA := rpctypes.OutPoint{TxHash: block0.Transactions[0].Hash, Index: 0}
+	cellB := rpctypes.OutPoint{TxHash: block0.Transactions[0].Hash, Index: 1}
+	assertIndexedCells(t, s, i, 1)
+	assertIndexedCells(t, s, i, 2)
+	assertStreamLength(t, s, eventsKey, 0)
+
+	block1 := testBlock(1, block0.Header.Hash, 1, []testInput{
+		testInput{outPoint: cellA, cell: testCell(100, 1)},
+	}, []rpctypes.CellOutput{
+		testCell(60, 1),
+		testCell(40, 2),
+	})
+	indexTestBlock(t, i, block1)
+	cellC := rpctypes.OutPoint{TxHash: block1.Transactions[0].Hash, Index: 0}
+	cellD := rpctypes.OutPoint{TxHash: block1.Transactions[0].Hash, Index: 1}
+	assertIndexedCells(t, s, i, 1, cellA)
+	assertIndexedCells(t, s, i, 2, cellB)
+	assertStreamLength(t, s, eventsKey, 2)
+
+	// Reverting block 1 keeps the already confirmed block 0
+	err := i.revertBlock(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIndexedCells(t, s, i, 1, cellA)
+	assertIndexedCells(t, s, i, 2, cellB)
+	assertStreamLength(t, s, eventsKey, 2)
+
+	indexTestBlock(t, i, block1)
+	assertStreamLength(t, s, eventsKey, 2)
+	block2 := testBlock(2, block1.Header.Hash, 1, nil, nil)
+	indexTestBlock(t, i, block2)
+	assertIndexedCells(t, s, i, 1, cellC)
+	assertIndexedCells(t, s, i, 2, cellB, cellD)
+	assertStreamLength(t, s, eventsKey, 5)
+
+	err = i.revertBlock(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = i.revertBlock(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIndexedCells(t, s, i, 1, cellA)
+	assertIndexedCells(t, s, i, 2, cellB)
+	assertStreamLength(t, s, eventsKey, 8)
+}
+
+func TestPruneRevertJournals(t *testing.T) {
+	s := store.NewMemoryStore()
+	i := newTestIndexer(t, s)
+	i.options.MaxReorgDepth = 2
+
+	parentHash := rpctypes.Hash{}
+	for number := uint64(0); number < 4; number++ {
+		block := testBlock(number, parentHash, 1, nil, []rpctypes.CellOutput{
+			testCell(100, 1),
+		})
+		indexTestBlock(t, i, block)
+		parentHash = block.Header.Hash
+	}
+	for number, pruned := range []bool{true, true, false, false} {
+		journal, err := s.Get(fmt.Sprintf("BLOCK:%d:REVERT_COMMANDS", number))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (journal == nil) != pruned {
+			t.Errorf("Invalid revert journal state for block %d, pruned: %t", number, journal == nil)
+		}
+	}
+
+	for _, number := range []uint64{3, 2} {
+		err := i.revertBlock(number)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := i.revertBlock(1)
+	if err == nil || !strings.Contains(err.Error(), "max reorg depth") {
+		t.Errorf("Invalid error reverting pruned block: %v", err)
+	}
+}
@@ -221,6 +221,35 @@ func (c *Client) GetAllTransactions(txHashes []rpctypes.Hash, size int) ([]*rpct
 	return transactionWithStatusViews, nil
 }
 
+// CommittedTransactions maps transactions fetched by GetAllTransactions by
+// their hashes. CKB returns null for transactions it does not know, and
+// ones pruned or not committed yet come without a block hash, all of them
+// are left out.
+func CommittedTransactions(views []*rpctypes.TransactionWithStatusView) map[rpctypes.Hash]*rpctypes.TransactionWithStatusView {
+	transactions := make(map[rpctypes.Hash]*rpctypes.TransactionWithStatusView)
+	for _, view := range views {
+		if view == nil || view.TxStatus.BlockHash == nil {
+			continue
+		}
+		transactions[view.Transaction.Hash] = view
+	}
+	return transactions
+}
+
+// CommittedCell looks up the cell at outPoint among transactions returned by
+// CommittedTransactions, together with the hash of the block committing it.
+func CommittedCell(transactions map[rpctypes.Hash]*rpctypes.TransactionWithStatusView, outPoint rpctypes.OutPoint) (*rpctypes.CellOutput, *rpctypes.Raw, rpctypes.Hash, bool) {
+	view, found := transactions[outPoint.TxHash]
+	if !found ||
+		int(outPoint.Index) >= len(view.Transaction.Outputs) ||
+		int(outPoint.Index) >= len(view.Transaction.OutputsData) {
+		return nil, nil, rpctypes.Hash{}, false
+	}
+	cell := view.Transaction.Outputs[outPoint.Index]
+	data := rpctypes.Raw([]byte(view.Transaction.OutputsData[outPoint.Index]))
+	return &cell, &data, *view.TxStatus.BlockHash, true
+}
+
 func (c *Client) GetHeader(blockHash *rpctypes.Hash) (*rpctypes.HeaderView, error) {
 	blockHashStr := fmt.Sprintf("0x%x", *blockHash)
 	params := NewRequestParams(
@@ -47,7 +47,7 @@ type Transaction struct {
 
 type TxStatus struct {
 	BlockHash *Hash  `json:"block_hash"`
-	Status    string `json:status`
+	Status    string `json:"status"`
 }
 
 type RawHeader struct {
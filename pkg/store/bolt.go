@@ -0,0 +1,296 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	valuesBucket = []byte("values")
+	setsBucket   = []byte("sets")
+	listsBucket  = []byte("lists")
+	sortedBucket = []byte("sorted")
+)
+
+// BoltStore keeps all data in a single embedded bbolt database file, it lets
+// animagus run as a single binary without Redis.
+type BoltStore struct {
+	db     *bolt.DB
+	broker *broker
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(valuesBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(setsBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(listsBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(sortedBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{
+		db:     db,
+		broker: newBroker(),
+	}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) Get(key string) ([]byte, error) {
+	var result []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(valuesBucket).Get([]byte(key))
+		if value != nil {
+			result = copyBytes(value)
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (s *BoltStore) Members(key string) ([][]byte, error) {
+	result := [][]byte{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		set := tx.Bucket(setsBucket).Bucket([]byte(key))
+		if set == nil {
+			return nil
+		}
+		return set.ForEach(func(member, _ []byte) error {
+			result = append(result, copyBytes(member))
+			return nil
+		})
+	})
+	return result, err
+}
+
+func (s *BoltStore) Count(key string) (uint64, error) {
+	var result uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		set := tx.Bucket(setsBucket).Bucket([]byte(key))
+		if set != nil {
+			result = uint64(set.Stats().KeyN)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Lists are kept in nested buckets, items are keyed by their big endian
+// index so bucket order matches list order, the bucket sequence tracks the
+// list length.
+func (s *BoltStore) Length(key string) (uint64, error) {
+	var result uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		list := tx.Bucket(listsBucket).Bucket([]byte(key))
+		if list != nil {
+			result = list.Sequence()
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (s *BoltStore) Range(key string, start uint64, count int) ([][]byte, error) {
+	result := [][]byte{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		list := tx.Bucket(listsBucket).Bucket([]byte(key))
+		if list == nil {
+			return nil
+		}
+		c := list.Cursor()
+		for k, v := c.Seek(listIndex(start)); k != nil && len(result) < count; k, v = c.Next() {
+			result = append(result, copyBytes(v))
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Sorted sets are kept in nested buckets like sets, bbolt keeps keys in
+// byte order already.
+func (s *BoltStore) RangeSorted(key string, below []byte, start uint64, count int) ([][]byte, error) {
+	result := [][]byte{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		set := tx.Bucket(sortedBucket).Bucket([]byte(key))
+		if set == nil {
+			return nil
+		}
+		c := set.Cursor()
+		skipped := uint64(0)
+		for k, _ := c.First(); k != nil && len(result) < count; k, _ = c.Next() {
+			if below != nil && bytes.Compare(k, below) >= 0 {
+				break
+			}
+			if skipped < start {
+				skipped++
+				continue
+			}
+			result = append(result, copyBytes(k))
+		}
+		return nil
+	})
+	return result, err
+}
+
+// ScanKeys uses the last key returned as cursor, keys of all kinds are merged
+// in order. Sets, lists and sorted sets are nested buckets named after their
+// keys.
+func (s *BoltStore) ScanKeys(prefix string, cursor string, count int) ([]string, string, error) {
+	if count < 1 {
+		count = 1
+	}
+	start := []byte(prefix)
+	if cursor > prefix {
+		start = []byte(cursor)
+	}
+	keys := make(map[string]bool)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// Taking one more key than needed from each bucket tells if any is
+		// left after this batch.
+		for _, name := range [][]byte{valuesBucket, setsBucket, listsBucket, sortedBucket} {
+			c := tx.Bucket(name).Cursor()
+			taken := 0
+			for k, _ := c.Seek(start); k != nil && bytes.HasPrefix(k, []byte(prefix)) && taken <= count; k, _ = c.Next() {
+				if string(k) == cursor {
+					continue
+				}
+				keys[string(k)] = true
+				taken++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	result := make([]string, 0, len(keys))
+	for key := range keys {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	if len(result) <= count {
+		return result, "", nil
+	}
+	return result[:count], result[count-1], nil
+}
+
+// Execute runs all commands in a single bbolt transaction, published values
+// are only delivered after the transaction commits.
+func (s *BoltStore) Execute(commands []Command) error {
+	var published []Command
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		values := tx.Bucket(valuesBucket)
+		sets := tx.Bucket(setsBucket)
+		lists := tx.Bucket(listsBucket)
+		sorted := tx.Bucket(sortedBucket)
+		for _, command := range commands {
+			key := []byte(command.Key)
+			var err error
+			switch command.Name {
+			case CommandSet:
+				err = values.Put(key, command.Value)
+			case CommandDelete:
+				err = values.Delete(key)
+				if err == nil && sets.Bucket(key) != nil {
+					err = sets.DeleteBucket(key)
+				}
+				if err == nil && lists.Bucket(key) != nil {
+					err = lists.DeleteBucket(key)
+				}
+				if err == nil && sorted.Bucket(key) != nil {
+					err = sorted.DeleteBucket(key)
+				}
+			case CommandSetAdd, CommandSortedAdd:
+				parent := sets
+				if command.Name == CommandSortedAdd {
+					parent = sorted
+				}
+				var set *bolt.Bucket
+				set, err = parent.CreateBucketIfNotExists(key)
+				if err == nil {
+					err = set.Put(command.Value, []byte{})
+				}
+			case CommandSetRemove, CommandSortedRemove:
+				parent := sets
+				if command.Name == CommandSortedRemove {
+					parent = sorted
+				}
+				set := parent.Bucket(key)
+				if set == nil {
+					continue
+				}
+				err = set.Delete(command.Value)
+				if err == nil {
+					// Empty sets are dropped, as Redis does
+					if k, _ := set.Cursor().First(); k == nil {
+						err = parent.DeleteBucket(key)
+					}
+				}
+			case CommandPush:
+				var list *bolt.Bucket
+				list, err = lists.CreateBucketIfNotExists(key)
+				if err == nil {
+					var index uint64
+					index, err = list.NextSequence()
+					if err == nil {
+						err = list.Put(listIndex(index-1), command.Value)
+					}
+				}
+			case CommandPublish:
+				published = append(published, command)
+			default:
+				err = fmt.Errorf("Invalid command: %s", command.Name)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, command := range published {
+		s.broker.publish(command.Key, command.Value)
+	}
+	return nil
+}
+
+func (s *BoltStore) Subscribe(channel string) (Subscription, error) {
+	return s.broker.subscribe(channel), nil
+}
+
+func listIndex(index uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, index)
+	return key
+}
+
+func copyBytes(b []byte) []byte {
+	result := make([]byte, len(b))
+	copy(result, b)
+	return result
+}
@@ -0,0 +1,100 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+)
+
+// broker delivers published values to in-process subscribers, it is used by
+// the embedded backends which have no server to do this for them.
+type broker struct {
+	mutex       sync.Mutex
+	subscribers map[string]map[*brokerSubscription]bool
+}
+
+func newBroker() *broker {
+	return &broker{
+		subscribers: make(map[string]map[*brokerSubscription]bool),
+	}
+}
+
+func (b *broker) subscribe(channel string) *brokerSubscription {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	subscription := &brokerSubscription{
+		broker:  b,
+		channel: channel,
+	}
+	subscription.cond = sync.NewCond(&subscription.mutex)
+	if b.subscribers[channel] == nil {
+		b.subscribers[channel] = make(map[*brokerSubscription]bool)
+	}
+	b.subscribers[channel][subscription] = true
+	return subscription
+}
+
+func (b *broker) unsubscribe(subscription *brokerSubscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.subscribers[subscription.channel], subscription)
+	if len(b.subscribers[subscription.channel]) == 0 {
+		delete(b.subscribers, subscription.channel)
+	}
+}
+
+func (b *broker) publish(channel string, value []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for subscription := range b.subscribers[channel] {
+		subscription.push(value)
+	}
+}
+
+// Values are queued without bound, so a slow subscriber never blocks the
+// publisher.
+type brokerSubscription struct {
+	broker  *broker
+	channel string
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	queue   [][]byte
+	closed  bool
+}
+
+func (s *brokerSubscription) push(value []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.queue = append(s.queue, value)
+	s.cond.Signal()
+}
+
+func (s *brokerSubscription) Receive() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for len(s.queue) == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return nil, fmt.Errorf("Subscription to %s is closed!", s.channel)
+	}
+	value := s.queue[0]
+	s.queue = s.queue[1:]
+	return value, nil
+}
+
+func (s *brokerSubscription) Close() error {
+	s.broker.unsubscribe(s)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	s.queue = nil
+	s.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,203 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryStore keeps everything in process memory, data is lost once the
+// process exits. It is mainly intended for tests and ephemeral runs.
+type MemoryStore struct {
+	mutex  sync.RWMutex
+	values map[string][]byte
+	sets   map[string]map[string]bool
+	lists  map[string][][]byte
+	sorted map[string][][]byte
+	broker *broker
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		values: make(map[string][]byte),
+		sets:   make(map[string]map[string]bool),
+		lists:  make(map[string][][]byte),
+		sorted: make(map[string][][]byte),
+		broker: newBroker(),
+	}
+}
+
+func (s *MemoryStore) Get(key string) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	value, found := s.values[key]
+	if !found {
+		return nil, nil
+	}
+	return copyBytes(value), nil
+}
+
+func (s *MemoryStore) Members(key string) ([][]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	result := make([][]byte, 0, len(s.sets[key]))
+	for member := range s.sets[key] {
+		result = append(result, []byte(member))
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) Count(key string) (uint64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return uint64(len(s.sets[key])), nil
+}
+
+func (s *MemoryStore) Length(key string) (uint64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return uint64(len(s.lists[key])), nil
+}
+
+func (s *MemoryStore) Range(key string, start uint64, count int) ([][]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	list := s.lists[key]
+	result := [][]byte{}
+	for i := start; i < uint64(len(list)) && len(result) < count; i++ {
+		result = append(result, copyBytes(list[i]))
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) RangeSorted(key string, below []byte, start uint64, count int) ([][]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	members := s.sorted[key]
+	result := [][]byte{}
+	for i := start; i < uint64(len(members)) && len(result) < count; i++ {
+		if below != nil && bytes.Compare(members[i], below) >= 0 {
+			break
+		}
+		result = append(result, copyBytes(members[i]))
+	}
+	return result, nil
+}
+
+// ScanKeys uses the last key returned as cursor.
+func (s *MemoryStore) ScanKeys(prefix string, cursor string, count int) ([]string, string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	keys := make(map[string]bool)
+	for key := range s.values {
+		keys[key] = true
+	}
+	for key := range s.sets {
+		keys[key] = true
+	}
+	for key := range s.lists {
+		keys[key] = true
+	}
+	for key := range s.sorted {
+		keys[key] = true
+	}
+	result := []string{}
+	for key := range keys {
+		if strings.HasPrefix(key, prefix) && key > cursor {
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	if count < 1 {
+		count = 1
+	}
+	if len(result) <= count {
+		return result, "", nil
+	}
+	return result[:count], result[count-1], nil
+}
+
+func (s *MemoryStore) Execute(commands []Command) error {
+	// Validate first so a batch is either fully applied or not at all
+	for _, command := range commands {
+		switch command.Name {
+		case CommandSet, CommandDelete, CommandSetAdd, CommandSetRemove, CommandPublish, CommandPush,
+			CommandSortedAdd, CommandSortedRemove:
+		default:
+			return fmt.Errorf("Invalid command: %s", command.Name)
+		}
+	}
+
+	var published []Command
+	s.mutex.Lock()
+	for _, command := range commands {
+		switch command.Name {
+		case CommandSet:
+			s.values[command.Key] = copyBytes(command.Value)
+		case CommandDelete:
+			delete(s.values, command.Key)
+			delete(s.sets, command.Key)
+			delete(s.lists, command.Key)
+			delete(s.sorted, command.Key)
+		case CommandSetAdd:
+			if s.sets[command.Key] == nil {
+				s.sets[command.Key] = make(map[string]bool)
+			}
+			s.sets[command.Key][string(command.Value)] = true
+		case CommandSetRemove:
+			delete(s.sets[command.Key], string(command.Value))
+			if len(s.sets[command.Key]) == 0 {
+				delete(s.sets, command.Key)
+			}
+		case CommandSortedAdd:
+			members := s.sorted[command.Key]
+			i := sort.Search(len(members), func(i int) bool {
+				return bytes.Compare(members[i], command.Value) >= 0
+			})
+			if i < len(members) && bytes.Equal(members[i], command.Value) {
+				continue
+			}
+			members = append(members, nil)
+			copy(members[i+1:], members[i:])
+			members[i] = copyBytes(command.Value)
+			s.sorted[command.Key] = members
+		case CommandSortedRemove:
+			members := s.sorted[command.Key]
+			i := sort.Search(len(members), func(i int) bool {
+				return bytes.Compare(members[i], command.Value) >= 0
+			})
+			if i == len(members) || !bytes.Equal(members[i], command.Value) {
+				continue
+			}
+			members = append(members[:i], members[i+1:]...)
+			if len(members) == 0 {
+				delete(s.sorted, command.Key)
+			} else {
+				s.sorted[command.Key] = members
+			}
+		case CommandPush:
+			s.lists[command.Key] = append(s.lists[command.Key], copyBytes(command.Value))
+		case CommandPublish:
+			published = append(published, command)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, command := range published {
+		s.broker.publish(command.Key, copyBytes(command.Value))
+	}
+	return nil
+}
+
+func (s *MemoryStore) Subscribe(channel string) (Subscription, error) {
+	return s.broker.subscribe(channel), nil
+}
@@ -0,0 +1,218 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+type RedisStore struct {
+	pool *redis.Pool
+}
+
+func NewRedisStore(pool *redis.Pool) *RedisStore {
+	return &RedisStore{
+		pool: pool,
+	}
+}
+
+func (s *RedisStore) Get(key string) ([]byte, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	value, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (s *RedisStore) Members(key string) ([][]byte, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return redis.ByteSlices(conn.Do("SMEMBERS", key))
+}
+
+func (s *RedisStore) Count(key string) (uint64, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return redis.Uint64(conn.Do("SCARD", key))
+}
+
+func (s *RedisStore) Length(key string) (uint64, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return redis.Uint64(conn.Do("LLEN", key))
+}
+
+func (s *RedisStore) Range(key string, start uint64, count int) ([][]byte, error) {
+	if count <= 0 {
+		return [][]byte{}, nil
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return redis.ByteSlices(conn.Do("LRANGE", key, start, start+uint64(count)-1))
+}
+
+func (s *RedisStore) RangeSorted(key string, below []byte, start uint64, count int) ([][]byte, error) {
+	if count <= 0 {
+		return [][]byte{}, nil
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	max := []byte("+")
+	if below != nil {
+		max = append([]byte("("), below...)
+	}
+	return redis.ByteSlices(conn.Do("ZRANGEBYLEX", key, "-", max, "LIMIT", start, count))
+}
+
+// ScanKeys walks the key space with SCAN, so Redis is not blocked the way
+// KEYS would. Prefix is escaped since SCAN matches glob patterns.
+func (s *RedisStore) ScanKeys(prefix string, cursor string, count int) ([]string, string, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	if cursor == "" {
+		cursor = "0"
+	}
+	reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", globEscaper.Replace(prefix)+"*", "COUNT", count))
+	if err != nil {
+		return nil, "", err
+	}
+	var keys []string
+	_, err = redis.Scan(reply, &cursor, &keys)
+	if err != nil {
+		return nil, "", err
+	}
+	if cursor == "0" {
+		cursor = ""
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+	return keys, cursor, nil
+}
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func (s *RedisStore) Execute(commands []Command) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	for _, command := range commands {
+		switch command.Name {
+		case CommandDelete:
+			conn.Send(command.Name, command.Key)
+		case CommandSet, CommandSetAdd, CommandSetRemove, CommandPublish, CommandPush:
+			conn.Send(command.Name, command.Key, command.Value)
+		case CommandSortedAdd:
+			conn.Send(command.Name, command.Key, 0, command.Value)
+		case CommandSortedRemove:
+			conn.Send(command.Name, command.Key, command.Value)
+		default:
+			conn.Do("DISCARD")
+			return fmt.Errorf("Invalid command: %s", command.Name)
+		}
+	}
+	// Redis aborts the whole transaction on commands it refuses to queue,
+	// but applies the rest of it when a command fails at runtime, such as
+	// one on a key of another type. There is no rollback, so the store is
+	// left partially updated, which is reported instead of ignored.
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+	for j, reply := range replies {
+		if replyErr, ok := reply.(redis.Error); ok {
+			return fmt.Errorf("Command %s on %s failed after the rest of its batch was applied, the store is likely inconsistent: %v", commands[j].Name, commands[j].Key, replyErr)
+		}
+	}
+	return nil
+}
+
+func (s *RedisStore) Subscribe(channel string) (Subscription, error) {
+	psc := redis.PubSubConn{Conn: s.pool.Get()}
+	err := psc.Subscribe(channel)
+	if err != nil {
+		psc.Close()
+		return nil, err
+	}
+	return &redisSubscription{
+		psc:     psc,
+		channel: channel,
+	}, nil
+}
+
+// redisSubscription might be closed while Receive blocks on the connection,
+// only UNSUBSCRIBE is sent then, Receive returns the connection to the pool
+// once it stops reading. Redis connections allow one reader and one writer
+// at a time, but not two readers.
+type redisSubscription struct {
+	psc       redis.PubSubConn
+	channel   string
+	mutex     sync.Mutex
+	receiving bool
+	closed    bool
+}
+
+func (s *redisSubscription) Receive() ([]byte, error) {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil, fmt.Errorf("Subscription to %s is closed!", s.channel)
+	}
+	s.receiving = true
+	s.mutex.Unlock()
+
+	var data []byte
+	var err error
+	for data == nil && err == nil {
+		switch v := s.psc.Receive().(type) {
+		case redis.Message:
+			if v.Channel == s.channel {
+				data = v.Data
+				if data == nil {
+					data = []byte{}
+				}
+			}
+		case redis.Subscription:
+			if v.Kind == "unsubscribe" {
+				err = fmt.Errorf("Subscription to %s is closed!", s.channel)
+			}
+		case error:
+			err = v
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.receiving = false
+	if s.closed {
+		s.psc.Close()
+		return nil, fmt.Errorf("Subscription to %s is closed!", s.channel)
+	}
+	return data, err
+}
+
+func (s *redisSubscription) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.receiving {
+		return s.psc.Unsubscribe()
+	}
+	return s.psc.Close()
+}
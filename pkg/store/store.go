@@ -0,0 +1,69 @@
+package store
+
+// Names of the commands a Store must be able to execute. They mirror the
+// Redis commands animagus used originally, so revert journals written by
+// the indexer stay readable regardless of the backend in use.
+const (
+	CommandSet       = "SET"
+	CommandDelete    = "DEL"
+	CommandSetAdd    = "SADD"
+	CommandSetRemove = "SREM"
+	CommandPublish   = "PUBLISH"
+	CommandPush      = "RPUSH"
+	// Sorted sets keep members in ascending byte order, all members are
+	// added with score 0 in Redis so they are ordered lexicographically.
+	CommandSortedAdd    = "ZADD"
+	CommandSortedRemove = "ZREM"
+)
+
+// Command is a single mutation applied to a Store. For set commands, Key
+// denotes the set and Value the member, for publish commands, Key denotes
+// the channel, for push commands, Key denotes the list Value is appended to.
+// Sorted set commands work like set commands.
+type Command struct {
+	Name  string `json:"n"`
+	Key   string `json:"k"`
+	Value []byte `json:"v,omitempty"`
+}
+
+type Store interface {
+	// Get returns the value stored at key, or nil if key does not exist.
+	Get(key string) ([]byte, error)
+	// Members returns all members of the set stored at key.
+	Members(key string) ([][]byte, error)
+	// Count returns the number of members of the set stored at key.
+	Count(key string) (uint64, error)
+	// Length returns the number of items in the list stored at key.
+	Length(key string) (uint64, error)
+	// Range returns at most count items of the list stored at key, starting
+	// from the item at index start. Items are indexed from 0 in the order
+	// they are pushed, and are never renumbered.
+	Range(key string, start uint64, count int) ([][]byte, error)
+	// RangeSorted returns at most count members of the sorted set stored at
+	// key in ascending order, skipping the first start ones. Only members
+	// less than below are included, unless below is nil.
+	RangeSorted(key string, below []byte, start uint64, count int) ([][]byte, error)
+	// ScanKeys returns a batch of about count keys starting with prefix, in
+	// no particular order and regardless of the kind of data stored at them.
+	// Scanning starts from an empty cursor and continues from the returned
+	// one, till an empty cursor is returned. Keys might be returned more than
+	// once, and keys changed during the scan might be missed.
+	ScanKeys(prefix string, cursor string, count int) ([]string, string, error)
+	// Execute applies all commands atomically: either all of them take
+	// effect or none of them do. Published values are only delivered to
+	// subscribers once the whole batch has been applied. Redis cannot roll
+	// back a command failing while the batch is applied, such as one on a
+	// key holding another kind of data, the rest of the batch still takes
+	// effect then, and an error is returned.
+	Execute(commands []Command) error
+	// Subscribe listens on channel for values published via Execute.
+	Subscribe(channel string) (Subscription, error)
+}
+
+type Subscription interface {
+	// Receive blocks until a value is published on the channel.
+	Receive() ([]byte, error)
+	// Close makes a blocking Receive return an error, it is safe to call
+	// more than once, and from other goroutines.
+	Close() error
+}
@@ -0,0 +1,335 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func assertMembers(t *testing.T, s Store, key string, expected ...string) {
+	members, err := s.Members(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := make([]string, len(members))
+	for i, member := range members {
+		actual[i] = string(member)
+	}
+	sort.Strings(actual)
+	sort.Strings(expected)
+	if len(actual) != len(expected) {
+		t.Fatalf("Invalid members of %s: %v, expected: %v", key, actual, expected)
+	}
+	for i := range actual {
+		if actual[i] != expected[i] {
+			t.Fatalf("Invalid members of %s: %v, expected: %v", key, actual, expected)
+		}
+	}
+	count, err := s.Count(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != uint64(len(expected)) {
+		t.Fatalf("Invalid member count of %s: %d, expected: %d", key, count, len(expected))
+	}
+}
+
+func testStore(t *testing.T, s Store) {
+	subscription, err := s.Subscribe("STREAM:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+
+	err = s.Execute([]Command{
+		Command{Name: CommandSet, Key: "LAST_BLOCK", Value: []byte("block1")},
+		Command{Name: CommandSetAdd, Key: "CELLS", Value: []byte("a")},
+		Command{Name: CommandSetAdd, Key: "CELLS", Value: []byte("b")},
+		Command{Name: CommandPublish, Key: "STREAM:test", Value: []byte("event1")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := s.Get("LAST_BLOCK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, []byte("block1")) {
+		t.Errorf("Invalid value: %s", value)
+	}
+	assertMembers(t, s, "CELLS", "a", "b")
+	data, err := subscription.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("event1")) {
+		t.Errorf("Invalid published value: %s", data)
+	}
+
+	err = s.Execute([]Command{
+		Command{Name: CommandSetRemove, Key: "CELLS", Value: []byte("a")},
+		Command{Name: CommandDelete, Key: "LAST_BLOCK"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err = s.Get("LAST_BLOCK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != nil {
+		t.Errorf("Deleted key still has value: %s", value)
+	}
+	assertMembers(t, s, "CELLS", "b")
+	assertMembers(t, s, "MISSING")
+
+	// A failing batch must not be partially applied
+	err = s.Execute([]Command{
+		Command{Name: CommandSetAdd, Key: "CELLS", Value: []byte("c")},
+		Command{Name: "INVALID", Key: "CELLS"},
+	})
+	if err == nil {
+		t.Fatal("Invalid command is accepted!")
+	}
+	assertMembers(t, s, "CELLS", "b")
+
+	var commands []Command
+	for _, item := range []string{"a", "b", "c"} {
+		commands = append(commands, Command{Name: CommandPush, Key: "LOG", Value: []byte(item)})
+	}
+	err = s.Execute(commands)
+	if err != nil {
+		t.Fatal(err)
+	}
+	length, err := s.Length("LOG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if length != 3 {
+		t.Errorf("Invalid list length: %d, expected: 3", length)
+	}
+	items, err := s.Range("LOG", 1, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || string(items[0]) != "b" || string(items[1]) != "c" {
+		t.Errorf("Invalid list items: %q", items)
+	}
+	items, err = s.Range("LOG", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || string(items[0]) != "a" {
+		t.Errorf("Invalid list items: %q", items)
+	}
+	items, err = s.Range("MISSING", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Errorf("Missing list has items: %q", items)
+	}
+
+	commands = nil
+	for _, member := range []string{"c", "a", "d", "b", "a"} {
+		commands = append(commands, Command{Name: CommandSortedAdd, Key: "HISTORY", Value: []byte(member)})
+	}
+	commands = append(commands, Command{Name: CommandSortedRemove, Key: "HISTORY", Value: []byte("d")})
+	err = s.Execute(commands)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		below    []byte
+		start    uint64
+		count    int
+		expected string
+	}{
+		{nil, 0, 10, "abc"},
+		{nil, 1, 1, "b"},
+		{[]byte("c"), 0, 10, "ab"},
+		{[]byte("bb"), 1, 10, "b"},
+		{[]byte("a"), 0, 10, ""},
+		{nil, 3, 10, ""},
+	} {
+		items, err = s.RangeSorted("HISTORY", test.below, test.start, test.count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bytes.Join(items, nil)) != test.expected {
+			t.Errorf("Invalid sorted set members below %q from %d: %q, expected: %q",
+				test.below, test.start, items, test.expected)
+		}
+	}
+	err = s.Execute([]Command{
+		Command{Name: CommandSortedRemove, Key: "HISTORY", Value: []byte("a")},
+		Command{Name: CommandSortedRemove, Key: "HISTORY", Value: []byte("b")},
+		Command{Name: CommandSortedRemove, Key: "HISTORY", Value: []byte("c")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err = s.RangeSorted("HISTORY", nil, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Errorf("Emptied sorted set has members: %q", items)
+	}
+
+	err = s.Execute([]Command{
+		Command{Name: CommandSet, Key: "QUERY:a:CELLS", Value: []byte("1")},
+		Command{Name: CommandSetAdd, Key: "QUERY:a:PARAM:1", Value: []byte("a")},
+		Command{Name: CommandPush, Key: "QUERY:a:LOG", Value: []byte("a")},
+		Command{Name: CommandSortedAdd, Key: "QUERY:a:PARAM:1:TRANSACTIONS", Value: []byte("a")},
+		Command{Name: CommandSet, Key: "QUERY:ab:CELLS", Value: []byte("1")},
+		Command{Name: CommandSet, Key: "QUERY:*:CELLS", Value: []byte("1")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		prefix   string
+		expected []string
+	}{
+		{"QUERY:a:", []string{"QUERY:a:CELLS", "QUERY:a:LOG", "QUERY:a:PARAM:1", "QUERY:a:PARAM:1:TRANSACTIONS"}},
+		{"QUERY:*:", []string{"QUERY:*:CELLS"}},
+		{"QUERY:b", []string{}},
+	} {
+		// Small batches make scanning continue across kinds of data
+		found := make(map[string]bool)
+		cursor := ""
+		for {
+			var keys []string
+			keys, cursor, err = s.ScanKeys(test.prefix, cursor, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range keys {
+				found[key] = true
+			}
+			if cursor == "" {
+				break
+			}
+		}
+		keys := []string{}
+		for key := range found {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if strings.Join(keys, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("Invalid keys starting with %s: %v, expected: %v", test.prefix, keys, test.expected)
+		}
+	}
+}
+
+// testSubscriptionClose closes a subscription while Receive blocks on it,
+// from two goroutines at once, the way the generic server does when a client
+// goes away.
+func testSubscriptionClose(t *testing.T, s Store) {
+	subscription, err := s.Subscribe("STREAM:close")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan error, 1)
+	go func() {
+		_, err := subscription.Receive()
+		received <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	var wg sync.WaitGroup
+	for j := 0; j < 2; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			subscription.Close()
+		}()
+	}
+	wg.Wait()
+	select {
+	case err := <-received:
+		if err == nil {
+			t.Errorf("Receive should fail once the subscription is closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Receive is not unblocked by Close")
+	}
+	err = subscription.Close()
+	if err != nil {
+		t.Errorf("Closing a subscription again fails: %v", err)
+	}
+	_, err = subscription.Receive()
+	if err == nil {
+		t.Errorf("Receive should fail once the subscription is closed")
+	}
+}
+
+// newRedisTestPool connects to the Redis database at ANIMAGUS_TEST_REDIS_URL,
+// which is flushed, Redis backed tests are skipped when it is not set.
+func newRedisTestPool(t *testing.T) *redis.Pool {
+	url := os.Getenv("ANIMAGUS_TEST_REDIS_URL")
+	if url == "" {
+		t.Skip("ANIMAGUS_TEST_REDIS_URL is not set")
+	}
+	pool := &redis.Pool{
+		MaxIdle: 10,
+		Dial:    func() (redis.Conn, error) { return redis.DialURL(url) },
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("FLUSHDB")
+	if err != nil {
+		pool.Close()
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func TestRedisStore(t *testing.T) {
+	pool := newRedisTestPool(t)
+	defer pool.Close()
+	s := NewRedisStore(pool)
+	testStore(t, s)
+	testSubscriptionClose(t, s)
+	err := s.Execute([]Command{
+		Command{Name: CommandSet, Key: "WRONG_TYPE", Value: []byte("a")},
+		Command{Name: CommandSetAdd, Key: "WRONG_TYPE", Value: []byte("b")},
+	})
+	if err == nil {
+		t.Errorf("Commands failing inside a batch should be reported")
+	}
+	// Each connection is returned to the pool exactly once
+	if pool.IdleCount() != pool.ActiveCount() {
+		t.Errorf("Invalid pool state: %d idle connections, %d active ones", pool.IdleCount(), pool.ActiveCount())
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "animagus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewBoltStore(filepath.Join(dir, "animagus.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testStore(t, s)
+	testSubscriptionClose(t, s)
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	testStore(t, s)
+	testSubscriptionClose(t, s)
+}
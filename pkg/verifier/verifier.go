@@ -67,7 +67,7 @@ func Verify(expr *ast.Value) error {
 			return fmt.Errorf("Invalid number of arguments for %s!", expr.GetT().String())
 		}
 	case ast.Value_CELL_INPUT:
-		if len(expr.GetChildren()) != 2 {
+		if len(expr.GetChildren()) != 2 && len(expr.GetChildren()) != 3 {
 			return fmt.Errorf("Invalid number of arguments for %s!", expr.GetT().String())
 		}
 	case ast.Value_CELL_DEP:
@@ -83,7 +83,7 @@ func Verify(expr *ast.Value) error {
 			return fmt.Errorf("Invalid number of arguments for %s!", expr.GetT().String())
 		}
 	case ast.Value_TRANSACTION:
-		if len(expr.GetChildren()) != 3 {
+		if len(expr.GetChildren()) != 3 && len(expr.GetChildren()) != 5 && len(expr.GetChildren()) != 6 {
 			return fmt.Errorf("Invalid number of arguments for %s!", expr.GetT().String())
 		}
 	case ast.Value_HEADER:
@@ -112,6 +112,13 @@ func Verify(expr *ast.Value) error {
 		if err := verifyFuncArgs(expr.GetChildren()[0], 1); err != nil {
 			return fmt.Errorf("ERROR occured verifying QUERY_CELLS argument length: %s", err)
 		}
+	case ast.Value_QUERY_TRANSACTIONS:
+		if len(expr.GetChildren()) < 1 || len(expr.GetChildren()) > 3 {
+			return fmt.Errorf("Invalid number of arguments for %s!", expr.GetT().String())
+		}
+		if err := verifyFuncArgs(expr.GetChildren()[0], 1); err != nil {
+			return fmt.Errorf("ERROR occured verifying QUERY_TRANSACTIONS argument length: %s", err)
+		}
 	case ast.Value_MAP:
 		if len(expr.GetChildren()) != 2 {
 			return fmt.Errorf("Invalid number of arguments for %s!", expr.GetT().String())
@@ -268,10 +275,17 @@ func Verify(expr *ast.Value) error {
 
 func isList(l *ast.Value) bool {
 	switch l.GetT() {
+	case ast.Value_ARG:
 	case ast.Value_LIST:
 	case ast.Value_MAP:
 	case ast.Value_FILTER:
 	case ast.Value_QUERY_CELLS:
+	case ast.Value_QUERY_TRANSACTIONS:
+	case ast.Value_GET_CELL_DEPS:
+	case ast.Value_GET_HEADER_DEPS:
+	case ast.Value_GET_INPUTS:
+	case ast.Value_GET_OUTPUTS:
+	case ast.Value_GET_WITNESSES:
 	default:
 		return false
 	}
@@ -35,6 +35,7 @@ Google::Protobuf::DescriptorPool.generated_pool.build do
       value :QUERY_CELLS, 28
       value :MAP, 29
       value :FILTER, 30
+      value :QUERY_TRANSACTIONS, 31
       value :GET_CAPACITY, 48
       value :GET_DATA, 49
       value :GET_LOCK, 50
@@ -82,10 +83,18 @@ Google::Protobuf::DescriptorPool.generated_pool.build do
     add_message "ast.Call" do
       optional :name, :string, 1
       optional :result, :message, 3, "ast.Value"
+      optional :confirmations, :uint64, 4
     end
     add_message "ast.Stream" do
       optional :name, :string, 1
       optional :filter, :message, 2, "ast.Value"
+      optional :kind, :enum, 3, "ast.Stream.Kind"
+      optional :confirmations, :uint64, 4
+    end
+    add_enum "ast.Stream.Kind" do
+      value :CELL, 0
+      value :TRANSACTION, 1
+      value :BLOCK, 2
     end
     add_message "ast.Root" do
       repeated :calls, :message, 1, "ast.Call"
@@ -99,5 +108,6 @@ module Ast
   Value::Type = ::Google::Protobuf::DescriptorPool.generated_pool.lookup("ast.Value.Type").enummodule
   Call = ::Google::Protobuf::DescriptorPool.generated_pool.lookup("ast.Call").msgclass
   Stream = ::Google::Protobuf::DescriptorPool.generated_pool.lookup("ast.Stream").msgclass
+  Stream::Kind = ::Google::Protobuf::DescriptorPool.generated_pool.lookup("ast.Stream.Kind").enummodule
   Root = ::Google::Protobuf::DescriptorPool.generated_pool.lookup("ast.Root").msgclass
 end
@@ -9,10 +9,59 @@ Google::Protobuf::DescriptorPool.generated_pool.build do
     add_message "generic.GenericParams" do
       optional :name, :string, 1
       repeated :params, :message, 2, "ast.Value"
+      oneof :start do
+        optional :cursor, :uint64, 3
+        optional :from_block, :uint64, 4
+      end
+      oneof :at do
+        optional :block_number, :uint64, 5
+      end
+    end
+    add_message "generic.CallResult" do
+      optional :value, :message, 1, "ast.Value"
+      optional :block_number, :uint64, 2
+      optional :block_hash, :bytes, 3
+    end
+    add_message "generic.StreamEvent" do
+      optional :block_number, :uint64, 1
+      optional :block_hash, :bytes, 2
+      optional :tx_hash, :bytes, 3
+      optional :cell_index, :uint64, 4
+      optional :kind, :enum, 5, "generic.StreamEvent.Kind"
+      optional :cursor, :uint64, 6
+      optional :value, :message, 7, "ast.Value"
+    end
+    add_enum "generic.StreamEvent.Kind" do
+      value :INDEX, 0
+      value :REVERT, 1
+    end
+    add_message "generic.StatusParams" do
+    end
+    add_message "generic.QueryStatus" do
+      optional :hash, :bytes, 1
+      repeated :calls, :string, 2
+      optional :synced, :bool, 3
+      optional :backfilled_block, :uint64, 4
+      optional :cells, :uint64, 5
+    end
+    add_message "generic.IndexerStatus" do
+      optional :block_number, :uint64, 1
+      optional :block_hash, :bytes, 2
+      optional :tip_block_number, :uint64, 3
+      optional :lag, :uint64, 4
+      optional :ast_hash, :bytes, 5
+      optional :reorganizing, :bool, 6
+      repeated :queries, :message, 7, "generic.QueryStatus"
     end
   end
 end
 
 module Generic
   GenericParams = ::Google::Protobuf::DescriptorPool.generated_pool.lookup("generic.GenericParams").msgclass
+  CallResult = ::Google::Protobuf::DescriptorPool.generated_pool.lookup("generic.CallResult").msgclass
+  StreamEvent = ::Google::Protobuf::DescriptorPool.generated_pool.lookup("generic.StreamEvent").msgclass
+  StreamEvent::Kind = ::Google::Protobuf::DescriptorPool.generated_pool.lookup("generic.StreamEvent.Kind").enummodule
+  StatusParams = ::Google::Protobuf::DescriptorPool.generated_pool.lookup("generic.StatusParams").msgclass
+  QueryStatus = ::Google::Protobuf::DescriptorPool.generated_pool.lookup("generic.QueryStatus").msgclass
+  IndexerStatus = ::Google::Protobuf::DescriptorPool.generated_pool.lookup("generic.IndexerStatus").msgclass
 end
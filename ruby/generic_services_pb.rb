@@ -14,8 +14,9 @@ module Generic
       self.unmarshal_class_method = :decode
       self.service_name = 'generic.GenericService'
 
-      rpc :Call, ::Generic::GenericParams, ::Ast::Value
-      rpc :Stream, ::Generic::GenericParams, stream(::Ast::Value)
+      rpc :Call, ::Generic::GenericParams, ::Generic::CallResult
+      rpc :Stream, ::Generic::GenericParams, stream(::Generic::StreamEvent)
+      rpc :Status, ::Generic::StatusParams, ::Generic::IndexerStatus
     end
 
     Stub = Service.rpc_stub_class